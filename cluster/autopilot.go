@@ -0,0 +1,478 @@
+package cluster
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dihedron/brokerd/log"
+	"github.com/hashicorp/raft"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultAutopilotInterval is the default interval at which the
+	// autopilot checks the health of the servers.
+	DefaultAutopilotInterval = 2 * time.Second
+	// DefaultDeadServerThreshold is the default time a server must have
+	// been unhealthy before the autopilot removes it from the cluster.
+	DefaultDeadServerThreshold = 5 * time.Minute
+	// DefaultMaxLastContact is the default maximum time since a server
+	// last heard from the leader for it to be considered healthy.
+	DefaultMaxLastContact = 2 * time.Second
+	// DefaultMaxLag is the default maximum number of log entries a server
+	// can be behind the leader for it to be considered healthy.
+	DefaultMaxLag = 250
+	// DefaultStabilizationTime is the default time a non-voter must have
+	// been healthy before the autopilot promotes it to voter.
+	DefaultStabilizationTime = 10 * time.Second
+)
+
+// StateFunc retrieves the state of a server in the cluster, as reported by
+// the server itself.
+type StateFunc func(server raft.Server) (*NodeState, error)
+
+// ServerHealth is the health of a server, as tracked by the autopilot.
+type ServerHealth struct {
+	// ID is the unique ID of the server in the cluster.
+	ID string
+	// Address is the address of the Raft transport of the server.
+	Address string
+	// Suffrage is the suffrage of the server in the Raft configuration.
+	Suffrage raft.ServerSuffrage
+	// State is the Raft state of the server, as reported by the server
+	// itself, or the empty string if it could not be reached.
+	State string
+	// Healthy is whether the server is reachable, in touch with the leader
+	// and caught up with its log.
+	Healthy bool
+	// LastContact is the time elapsed since the server last heard from the
+	// leader; it is negative if the server never did, or is unreachable.
+	LastContact time.Duration
+	// Lag is the number of log entries the server is behind the leader.
+	Lag uint64
+	// StableSince is the time since which the server has been healthy, or
+	// unhealthy, as far as the current leader knows.
+	StableSince time.Time
+	// Error is the reason why the server could not be reached, if any.
+	Error string
+}
+
+// AutopilotState is the health of the cluster, as tracked by the
+// autopilot on the leader.
+type AutopilotState struct {
+	// Healthy is whether all the servers in the cluster are healthy.
+	Healthy bool
+	// FailureTolerance is the number of voters that can fail without the
+	// cluster losing its quorum.
+	FailureTolerance int
+	// Servers is the health of each server in the cluster.
+	Servers []ServerHealth
+}
+
+// PromotionStore keeps the IDs of the non-voters that joined the cluster
+// and are waiting to be promoted to voters; it should be replicated, so
+// that a new leader carries on with the promotions of the previous one.
+type PromotionStore interface {
+	// PendingPromotions returns the IDs of the non-voters waiting to be
+	// promoted.
+	PendingPromotions() ([]string, error)
+	// SetPendingPromotions sets the IDs of the non-voters waiting to be
+	// promoted.
+	SetPendingPromotions(ids []string) error
+}
+
+// memoryPromotions is a PromotionStore that only lives in memory, so the
+// pending promotions are lost when the leadership changes.
+type memoryPromotions struct {
+	lock sync.Mutex
+	ids  []string
+}
+
+// PendingPromotions returns the IDs of the non-voters waiting to be
+// promoted.
+func (m *memoryPromotions) PendingPromotions() ([]string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]string{}, m.ids...), nil
+}
+
+// SetPendingPromotions sets the IDs of the non-voters waiting to be
+// promoted.
+func (m *memoryPromotions) SetPendingPromotions(ids []string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.ids = append([]string{}, ids...)
+	return nil
+}
+
+// Autopilot runs on the leader and takes care of the servers in the
+// cluster: it removes the servers that have been unhealthy for too long,
+// provided the quorum is not broken, and promotes the non-voters that
+// joined the cluster once they have caught up with the leader. Pending
+// promotions are kept in the PromotionStore, so that a new leader can
+// complete them if the leadership changes in the meantime.
+type Autopilot struct {
+	// Interval is the interval at which the health of the servers is
+	// checked.
+	Interval time.Duration
+	// DeadServerThreshold is the time a server must have been unhealthy
+	// before it is removed from the cluster; if 0, servers are never
+	// removed.
+	DeadServerThreshold time.Duration
+	// MaxLastContact is the maximum time since a server last heard from
+	// the leader for it to be healthy.
+	MaxLastContact time.Duration
+	// MaxLag is the maximum number of log entries a server can be behind
+	// the leader for it to be healthy.
+	MaxLag uint64
+	// StabilizationTime is the time a joining non-voter must have been
+	// healthy before it is promoted to voter.
+	StabilizationTime time.Duration
+
+	cluster    *Cluster
+	probe      StateFunc
+	lock       sync.Mutex
+	servers    []ServerHealth
+	promotions PromotionStore
+	pending    sync.Mutex
+	stop       chan struct{}
+}
+
+// AutopilotOption represents the optional function.
+type AutopilotOption func(autopilot *Autopilot)
+
+// WithAutopilotInterval sets up the interval at which the health of the
+// servers is checked.
+func WithAutopilotInterval(value time.Duration) AutopilotOption {
+	return func(autopilot *Autopilot) {
+		autopilot.Interval = value
+	}
+}
+
+// WithDeadServerThreshold sets up the time a server must have been
+// unhealthy before it is removed from the cluster.
+func WithDeadServerThreshold(value time.Duration) AutopilotOption {
+	return func(autopilot *Autopilot) {
+		autopilot.DeadServerThreshold = value
+	}
+}
+
+// WithMaxLastContact sets up the maximum time since a server last heard
+// from the leader for it to be healthy.
+func WithMaxLastContact(value time.Duration) AutopilotOption {
+	return func(autopilot *Autopilot) {
+		autopilot.MaxLastContact = value
+	}
+}
+
+// WithMaxLag sets up the maximum number of log entries a server can be
+// behind the leader for it to be healthy.
+func WithMaxLag(value uint64) AutopilotOption {
+	return func(autopilot *Autopilot) {
+		autopilot.MaxLag = value
+	}
+}
+
+// WithStabilizationTime sets up the time a joining non-voter must have
+// been healthy before it is promoted to voter.
+func WithStabilizationTime(value time.Duration) AutopilotOption {
+	return func(autopilot *Autopilot) {
+		autopilot.StabilizationTime = value
+	}
+}
+
+// WithPromotionStore sets up the store where the non-voters waiting to be
+// promoted are kept; by default, they are only kept in memory.
+func WithPromotionStore(store PromotionStore) AutopilotOption {
+	return func(autopilot *Autopilot) {
+		autopilot.promotions = store
+	}
+}
+
+// StartAutopilot starts the autopilot, which retrieves the state of the
+// other servers through the given function; from now on, joining nodes
+// are added as non-voters and promoted once they have caught up. The
+// autopilot is stopped when the Cluster is shut down.
+func (c *Cluster) StartAutopilot(probe StateFunc, options ...AutopilotOption) *Autopilot {
+	// setup with defaults
+	a := &Autopilot{
+		Interval:            DefaultAutopilotInterval,
+		DeadServerThreshold: DefaultDeadServerThreshold,
+		MaxLastContact:      DefaultMaxLastContact,
+		MaxLag:              DefaultMaxLag,
+		StabilizationTime:   DefaultStabilizationTime,
+		cluster:             c,
+		probe:               probe,
+		promotions:          &memoryPromotions{},
+		stop:                make(chan struct{}),
+	}
+	// apply functional options to override
+	for _, option := range options {
+		option(a)
+	}
+	c.Autopilot = a
+	go func() {
+		ticker := time.NewTicker(a.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-a.stop:
+				return
+			case <-ticker.C:
+				a.update()
+			}
+		}
+	}()
+	log.L.Info("autopilot started", zap.Duration("interval", a.Interval), zap.Duration("dead server threshold", a.DeadServerThreshold))
+	return a
+}
+
+// Stop stops the autopilot.
+func (a *Autopilot) Stop() {
+	close(a.stop)
+}
+
+// State returns the health of the cluster; it is only known on the leader.
+func (a *Autopilot) State() (*AutopilotState, error) {
+	if a.cluster.Raft.State() != raft.Leader {
+		return nil, ErrNotLeader
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	state := &AutopilotState{
+		Healthy: true,
+		Servers: make([]ServerHealth, len(a.servers)),
+	}
+	copy(state.Servers, a.servers)
+	voters, healthy := 0, 0
+	for _, server := range a.servers {
+		if !server.Healthy {
+			state.Healthy = false
+		}
+		if server.Suffrage == raft.Voter {
+			voters++
+			if server.Healthy {
+				healthy++
+			}
+		}
+	}
+	if tolerance := healthy - (voters/2 + 1); tolerance > 0 {
+		state.FailureTolerance = tolerance
+	}
+	return state, nil
+}
+
+// join adds the node to the cluster as a non-voter, to be promoted once
+// it has caught up with the leader.
+func (a *Autopilot) join(nodeID string, address string) error {
+	servers, err := a.cluster.Servers()
+	if err != nil {
+		return err
+	}
+	if server := find(servers, func(server raft.Server) bool { return string(server.ID) == nodeID }); server != nil &&
+		server.Address == raft.ServerAddress(address) && server.Suffrage == raft.Voter {
+		log.L.Debug("node is already a voter, ignoring join request", zap.String("nodeID", nodeID), zap.String("address", address))
+		return nil
+	}
+	if err := a.cluster.add(nodeID, address, raft.Nonvoter); err != nil {
+		return err
+	}
+	if err := a.setPending(nodeID, true); err != nil {
+		return err
+	}
+	log.L.Info("node will be promoted to voter once caught up", zap.String("nodeID", nodeID))
+	return nil
+}
+
+// setPending adds the node to, or removes it from, the non-voters waiting
+// to be promoted.
+func (a *Autopilot) setPending(nodeID string, pending bool) error {
+	a.pending.Lock()
+	defer a.pending.Unlock()
+	ids, err := a.promotions.PendingPromotions()
+	if err != nil {
+		log.L.Error("error reading pending promotions", zap.Error(err))
+		return err
+	}
+	updated := []string{}
+	for _, id := range ids {
+		if id != nodeID {
+			updated = append(updated, id)
+		}
+	}
+	if pending {
+		updated = append(updated, nodeID)
+	}
+	if !pending && len(updated) == len(ids) {
+		return nil
+	}
+	if err := a.promotions.SetPendingPromotions(updated); err != nil {
+		log.L.Error("error storing pending promotions", zap.String("nodeID", nodeID), zap.Bool("pending", pending), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// pendingPromotions returns the non-voters waiting to be promoted, after
+// forgetting about those that are no longer non-voters.
+func (a *Autopilot) pendingPromotions(servers []raft.Server) (map[raft.ServerID]bool, error) {
+	a.pending.Lock()
+	defer a.pending.Unlock()
+	ids, err := a.promotions.PendingPromotions()
+	if err != nil {
+		log.L.Error("error reading pending promotions", zap.Error(err))
+		return nil, err
+	}
+	pending := map[raft.ServerID]bool{}
+	updated := []string{}
+	for _, id := range ids {
+		if server := find(servers, func(server raft.Server) bool { return string(server.ID) == id }); server != nil && server.Suffrage == raft.Nonvoter {
+			pending[raft.ServerID(id)] = true
+			updated = append(updated, id)
+		}
+	}
+	if len(updated) != len(ids) {
+		if err := a.promotions.SetPendingPromotions(updated); err != nil {
+			log.L.Warn("error storing pending promotions", zap.Error(err))
+		}
+	}
+	return pending, nil
+}
+
+// update checks the health of the servers and acts upon it.
+func (a *Autopilot) update() {
+	if a.cluster.Raft.State() != raft.Leader {
+		a.lock.Lock()
+		a.servers = nil
+		a.lock.Unlock()
+		return
+	}
+	servers, err := a.cluster.Servers()
+	if err != nil {
+		return
+	}
+
+	// ask all other servers for their state, concurrently
+	states := make([]*NodeState, len(servers))
+	errs := make([]error, len(servers))
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		if string(server.ID) == a.cluster.NodeID {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, server raft.Server) {
+			defer wg.Done()
+			states[i], errs[i] = a.probe(server)
+		}(i, server)
+	}
+	wg.Wait()
+
+	now := time.Now()
+	applied := a.cluster.Raft.AppliedIndex()
+	a.lock.Lock()
+	previous := map[string]ServerHealth{}
+	for _, server := range a.servers {
+		previous[server.ID] = server
+	}
+	a.servers = make([]ServerHealth, len(servers))
+	for i, server := range servers {
+		health := ServerHealth{
+			ID:          string(server.ID),
+			Address:     string(server.Address),
+			Suffrage:    server.Suffrage,
+			LastContact: -1,
+		}
+		switch {
+		case string(server.ID) == a.cluster.NodeID:
+			health.State = "leader"
+			health.Healthy = true
+			health.LastContact = 0
+		case errs[i] != nil:
+			health.Error = errs[i].Error()
+		default:
+			state := states[i]
+			health.State = state.State
+			health.LastContact = state.LastContact
+			health.Lag, health.Healthy = healthy(state, applied, a.MaxLastContact, a.MaxLag)
+		}
+		health.StableSince = now
+		if p, ok := previous[health.ID]; ok && p.Healthy == health.Healthy {
+			health.StableSince = p.StableSince
+		} else {
+			log.L.Info("server health changed", zap.String("id", health.ID), zap.Bool("healthy", health.Healthy), zap.String("error", health.Error))
+		}
+		a.servers[i] = health
+	}
+	health := make([]ServerHealth, len(a.servers))
+	copy(health, a.servers)
+	a.lock.Unlock()
+
+	a.cleanup(health, now)
+	if pending, err := a.pendingPromotions(servers); err == nil {
+		a.promote(health, pending, now)
+	}
+}
+
+// healthy checks whether a server, as reported by its state, is in touch
+// with the leader and caught up with the given applied index; it also
+// returns the number of log entries it is behind.
+func healthy(state *NodeState, applied uint64, maxLastContact time.Duration, maxLag uint64) (uint64, bool) {
+	var lag uint64
+	if applied > state.AppliedIndex {
+		lag = applied - state.AppliedIndex
+	}
+	return lag, state.State == "follower" && state.LastContact >= 0 && state.LastContact <= maxLastContact && lag <= maxLag
+}
+
+// cleanup removes from the cluster one of the servers that have been
+// unhealthy for longer than the threshold, as long as the remaining
+// healthy voters are enough to make a quorum.
+func (a *Autopilot) cleanup(servers []ServerHealth, now time.Time) {
+	if a.DeadServerThreshold <= 0 {
+		return
+	}
+	voters, healthy := 0, 0
+	for _, server := range servers {
+		if server.Suffrage == raft.Voter {
+			voters++
+			if server.Healthy {
+				healthy++
+			}
+		}
+	}
+	for _, server := range servers {
+		if server.Healthy || now.Sub(server.StableSince) < a.DeadServerThreshold {
+			continue
+		}
+		if server.Suffrage == raft.Voter && healthy < (voters-1)/2+1 {
+			log.L.Warn("not removing dead server, too few healthy voters would be left", zap.String("id", server.ID), zap.Int("healthy voters", healthy))
+			continue
+		}
+		log.L.Info("removing dead server", zap.String("id", server.ID), zap.Time("unhealthy since", server.StableSince))
+		if err := a.cluster.RemoveNode(server.ID, false); err != nil {
+			log.L.Warn("error removing dead server", zap.String("id", server.ID), zap.Error(err))
+			continue
+		}
+		// one change at a time: the configuration is checked again next time
+		return
+	}
+}
+
+// promote turns the joining non-voters that have been healthy for long
+// enough into voters.
+func (a *Autopilot) promote(servers []ServerHealth, pending map[raft.ServerID]bool, now time.Time) {
+	for _, server := range servers {
+		if !pending[raft.ServerID(server.ID)] || !server.Healthy || now.Sub(server.StableSince) < a.StabilizationTime {
+			continue
+		}
+		log.L.Info("promoting server to voter", zap.String("id", server.ID), zap.Uint64("lag", server.Lag))
+		if err := a.cluster.add(server.ID, server.Address, raft.Voter); err != nil {
+			log.L.Warn("error promoting server", zap.String("id", server.ID), zap.Error(err))
+			continue
+		}
+		if err := a.setPending(server.ID, false); err != nil {
+			log.L.Warn("error forgetting pending promotion", zap.String("id", server.ID), zap.Error(err))
+		}
+	}
+}
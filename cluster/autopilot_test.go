@@ -0,0 +1,60 @@
+package cluster
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+// Test_PendingPromotions tests that the non-voters waiting to be promoted
+// are kept in the store, and forgotten once no longer non-voters.
+func Test_PendingPromotions(t *testing.T) {
+	tests := []struct {
+		name      string
+		joined    []string
+		promoted  []string
+		voters    []string
+		nonvoters []string
+		expected  []string
+	}{
+		{"all pending", []string{"d", "e"}, nil, []string{"a"}, []string{"d", "e"}, []string{"d", "e"}},
+		{"joined twice", []string{"d", "d"}, nil, []string{"a"}, []string{"d"}, []string{"d"}},
+		{"promoted", []string{"d", "e"}, []string{"d"}, []string{"a", "d"}, []string{"e"}, []string{"e"}},
+		{"promoted by another leader", []string{"d", "e"}, nil, []string{"a", "d"}, []string{"e"}, []string{"e"}},
+		{"removed", []string{"d", "e"}, nil, []string{"a"}, []string{"e"}, []string{"e"}},
+		{"non-voters added explicitly", []string{"d"}, nil, []string{"a"}, []string{"d", "e"}, []string{"d"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := &memoryPromotions{}
+			a := &Autopilot{promotions: store}
+			for _, id := range test.joined {
+				if err := a.setPending(id, true); err != nil {
+					t.Fatalf("failed to add pending promotion: %v", err)
+				}
+			}
+			for _, id := range test.promoted {
+				if err := a.setPending(id, false); err != nil {
+					t.Fatalf("failed to remove pending promotion: %v", err)
+				}
+			}
+			pending, err := a.pendingPromotions(servers(test.voters, test.nonvoters))
+			if err != nil {
+				t.Fatalf("failed to read pending promotions: %v", err)
+			}
+			expected := map[raft.ServerID]bool{}
+			for _, id := range test.expected {
+				expected[raft.ServerID(id)] = true
+			}
+			if !reflect.DeepEqual(pending, expected) {
+				t.Fatalf("wrong pending promotions: %v (expected %v)", pending, expected)
+			}
+			// the servers that are no longer non-voters are forgotten in the store too
+			ids, _ := store.PendingPromotions()
+			if !reflect.DeepEqual(ids, test.expected) {
+				t.Fatalf("wrong pending promotions in store: %v (expected %v)", ids, test.expected)
+			}
+		})
+	}
+}
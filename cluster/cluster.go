@@ -1,7 +1,9 @@
 package cluster
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
@@ -35,6 +37,27 @@ type Cluster struct {
 	Transport *raft.NetworkTransport
 	// Snapshots is the underlying snapshots store.
 	Snapshots *raft.FileSnapshotStore
+	// Autopilot is the autopilot taking care of the servers in the cluster,
+	// if started.
+	Autopilot *Autopilot
+	// Rebalancer hands the leadership over to the preferred nodes, if
+	// started.
+	Rebalancer *Rebalancer
+	// EventHistory is the number of cluster events kept in the history.
+	EventHistory int
+	// Events is the history of the cluster events observed by this node.
+	Events *EventLog
+	// fsm is the finite state machine, as provided by the caller.
+	fsm raft.FSM
+	// observed is the Raft transport, as wrapped to observe it.
+	observed *observedTransport
+	// stopObserving stops the Raft observer.
+	stopObserving chan struct{}
+	// existingState records whether the node had any Raft state (log
+	// entries, term or snapshots) when it was started.
+	existingState bool
+	// boltDB is the store of the Raft log and stable state.
+	boltDB *raftboltdb.BoltStore
 }
 
 // New creates a new Cluster and associates it with the given finite
@@ -46,6 +69,8 @@ func New(nodeID string, fsm raft.FSM, options ...Option) (*Cluster, error) {
 		RaftDirectory:           "raft",
 		RaftBindAddress:         "127.0.0.1:12000",
 		RaftRetainSnapshotCount: DefaultRetainSnapshotCount,
+		EventHistory:            DefaultEventHistory,
+		stopObserving:           make(chan struct{}),
 	}
 	// apply functional options to override
 	for _, option := range options {
@@ -79,27 +104,124 @@ func New(nodeID string, fsm raft.FSM, options ...Option) (*Cluster, error) {
 	if err != nil {
 		return nil, fmt.Errorf("new bolt store: %s", err)
 	}
+	c.boltDB = boltDB
+
+	// check whether the node is restarting, before Raft writes anything
+	if c.existingState, err = raft.HasExistingState(boltDB, boltDB, snapshots); err != nil {
+		log.L.Error("error checking for existing Raft state", zap.Error(err))
+		return nil, err
+	}
+
+	// load the history of cluster events; the FSM and the transport are
+	// wrapped to report the events that Raft does not notify observers of
+	if c.Events, err = NewEventLog(filepath.Join(c.RaftDirectory, "events.json"), c.EventHistory); err != nil {
+		return nil, err
+	}
+	c.fsm = fsm
+	fsm = &observedFSM{FSM: fsm, cluster: c}
+	c.observed = &observedTransport{NetworkTransport: transport, cluster: c, failing: map[raft.ServerAddress]bool{}, contact: map[raft.ServerAddress]time.Time{}}
 
 	// instantiate the Raft systems
 	config := raft.DefaultConfig()
 	config.LocalID = raft.ServerID(nodeID)
-	r, err := raft.NewRaft(config, fsm, boltDB, boltDB, snapshots, transport)
+	config.NoSnapshotRestoreOnStart = c.skipSnapshotRestore()
+	r, err := raft.NewRaft(config, fsm, boltDB, boltDB, snapshots, c.observed)
 	if err != nil {
 		return nil, fmt.Errorf("new raft: %s", err)
 	}
 	c.Raft = r
+	c.observe()
 	return c, nil
 }
 
+// IndexedFSM is implemented by the finite state machines that persist the
+// index of the latest log entry they applied, and skip the entries up to it
+// when Raft replays the log on start.
+type IndexedFSM interface {
+	// AppliedIndex returns the index of the latest log entry applied, or 0
+	// if unknown.
+	AppliedIndex() uint64
+}
+
+// skipSnapshotRestore returns whether the FSM already holds the entries in
+// the latest snapshot, so that restoring it on start can be skipped.
+func (c *Cluster) skipSnapshotRestore() bool {
+	fsm, ok := c.fsm.(IndexedFSM)
+	if !ok {
+		return false
+	}
+	snapshots, err := c.Snapshots.List()
+	if err != nil || len(snapshots) == 0 {
+		return false
+	}
+	applied := fsm.AppliedIndex()
+	if applied < snapshots[0].Index {
+		log.L.Info("restoring latest snapshot", zap.Uint64("snapshot index", snapshots[0].Index), zap.Uint64("applied index", applied))
+		return false
+	}
+	log.L.Info("skipping restore of latest snapshot, already applied", zap.Uint64("snapshot index", snapshots[0].Index), zap.Uint64("applied index", applied))
+	return true
+}
+
+// HasExistingState returns whether the node already had Raft state when
+// it was started, in which case it is already a member of a cluster and
+// must neither bootstrap nor join one.
+func (c *Cluster) HasExistingState() bool {
+	return c.existingState
+}
+
+// Shutdown stops Raft on this node and closes its transport; the node
+// is still a member of the cluster, and will resume its role when
+// restarted.
+func (c *Cluster) Shutdown() error {
+	if c.Autopilot != nil {
+		c.Autopilot.Stop()
+	}
+	if c.Rebalancer != nil {
+		c.Rebalancer.Stop()
+	}
+	close(c.stopObserving)
+	if err := c.Raft.Shutdown().Error(); err != nil {
+		log.L.Error("error shutting down Raft", zap.Error(err))
+		return err
+	}
+	if err := c.Transport.Close(); err != nil {
+		log.L.Error("error closing Raft transport", zap.Error(err))
+		return err
+	}
+	if err := c.boltDB.Close(); err != nil {
+		log.L.Error("error closing Raft log store", zap.Error(err))
+		return err
+	}
+	if err := c.Events.Close(); err != nil {
+		log.L.Error("error closing cluster event history", zap.Error(err))
+		return err
+	}
+	log.L.Info("Raft shut down", zap.String("node ID", c.NodeID))
+	return nil
+}
+
 // Node represents a node in the Cluster.
 type Node struct {
-	ID      string
-	Address string
+	ID      string `json:"id"`
+	Address string `json:"address"`
 }
 
 // Bootstrap bootstraps the Cluster with the set of nodes; if none is
-// provided, the cluster is bootstrapped with this single node.
+// provided, the cluster is bootstrapped with this single node. All the
+// nodes of a new cluster can be bootstrapped with the same set of nodes.
+// If the node already has Raft state, it is already a member of a cluster
+// and the bootstrap is skipped.
 func (c *Cluster) Bootstrap(nodes ...Node) error {
+	if c.existingState {
+		log.L.Info("node has existing Raft state, skipping bootstrap", zap.String("node ID", c.NodeID))
+		return nil
+	}
+	if len(nodes) > 0 && !containsNode(nodes, c.NodeID) {
+		err := fmt.Errorf("node %s is not among the bootstrap nodes", c.NodeID)
+		log.L.Error("error bootstrapping cluster", zap.Error(err))
+		return err
+	}
 	configuration := raft.Configuration{
 		Servers: []raft.Server{},
 	}
@@ -121,44 +243,53 @@ func (c *Cluster) Bootstrap(nodes ...Node) error {
 		log.L.Error("error bootstrapping cluster", zap.Error(f.Error()))
 		return f.Error()
 	}
-	log.L.Info("cluster bootstrapped successfully", zap.String("master node ID", c.NodeID))
+	log.L.Info("cluster bootstrapped successfully", zap.String("master node ID", c.NodeID), zap.Int("nodes", len(configuration.Servers)))
 	return nil
 }
 
-// Join joins a node, identified by nodeID and located at address, to
-// this cluster. The node must be ready to respond to Raft communications
-// at that address.
-func (c *Cluster) Join(nodeID string, address string) error {
-	log.L.Info("received join request for remote node", zap.String("nodeID", nodeID), zap.String("address", address))
-
-	configFuture := c.Raft.GetConfiguration()
-	if err := configFuture.Error(); err != nil {
-		log.L.Error("failed to get raft configuration", zap.Error(err))
-		return err
+// LoadNodes reads the set of nodes to bootstrap the Cluster with from a
+// JSON file, containing an array of objects with the "id" and "address"
+// of each node.
+func LoadNodes(path string) ([]Node, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.L.Error("error reading bootstrap nodes file", zap.String("path", path), zap.Error(err))
+		return nil, err
 	}
+	nodes := []Node{}
+	if err := json.Unmarshal(data, &nodes); err != nil {
+		log.L.Error("error parsing bootstrap nodes file", zap.String("path", path), zap.Error(err))
+		return nil, err
+	}
+	for _, node := range nodes {
+		if node.ID == "" || node.Address == "" {
+			return nil, fmt.Errorf("invalid bootstrap node in %s: id and address are required", path)
+		}
+	}
+	return nodes, nil
+}
 
-	for _, srv := range configFuture.Configuration().Servers {
-		// If a node already exists with either the joining node's ID or address,
-		// that node may need to be removed from the config first.
-		if srv.ID == raft.ServerID(nodeID) || srv.Address == raft.ServerAddress(address) {
-			// However if *both* the ID and the address are the same, then nothing -- not even
-			// a join operation -- is needed.
-			if srv.Address == raft.ServerAddress(address) && srv.ID == raft.ServerID(nodeID) {
-				log.L.Debug("node is already member of cluster, ignoring join request", zap.String("nodeID", nodeID), zap.String("address", address))
-				return nil
-			}
-
-			future := c.Raft.RemoveServer(srv.ID, 0, 0)
-			if err := future.Error(); err != nil {
-				return fmt.Errorf("error removing existing node %s at %s: %s", nodeID, address, err)
-			}
+// containsNode checks whether the node with the given ID is in the set.
+func containsNode(nodes []Node, id string) bool {
+	for _, node := range nodes {
+		if node.ID == id {
+			return true
 		}
 	}
+	return false
+}
 
-	if f := c.Raft.AddVoter(raft.ServerID(nodeID), raft.ServerAddress(address), 0, 0); f.Error() != nil {
-		log.L.Error("error adding voter to cluster", zap.Error(f.Error()), zap.String("node ID", nodeID), zap.String("address", address))
-		return f.Error()
+// Join joins a node, identified by nodeID and located at address, to
+// this cluster as a voter; if the autopilot is running, the node is
+// added as a non-voter and promoted once it has caught up. The node must
+// be ready to respond to Raft communications at that address.
+func (c *Cluster) Join(nodeID string, address string) error {
+	log.L.Info("received join request for remote node", zap.String("nodeID", nodeID), zap.String("address", address))
+	if c.Autopilot != nil {
+		if c.Raft.State() != raft.Leader {
+			return ErrNotLeader
+		}
+		return c.Autopilot.join(nodeID, address)
 	}
-	log.L.Info("node joined successfully", zap.String("node ID", nodeID), zap.String("address", address))
-	return nil
+	return c.add(nodeID, address, raft.Voter)
 }
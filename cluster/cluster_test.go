@@ -0,0 +1,98 @@
+package cluster
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+// indexedFSM is a finite state machine that reports the index of the
+// latest log entry it applied.
+type indexedFSM struct {
+	raft.MockFSM
+	applied uint64
+}
+
+func (f *indexedFSM) AppliedIndex() uint64 { return f.applied }
+
+// Test_HasExistingState tests that a node is only bootstrapped the first
+// time it is started, and joins its cluster again when restarted.
+func Test_HasExistingState(t *testing.T) {
+	directory := t.TempDir()
+	start := func() *Cluster {
+		c, err := New("node0", &raft.MockFSM{}, WithRaftDirectory(directory), WithRaftBindAddress("127.0.0.1:0"))
+		if err != nil {
+			t.Fatalf("failed to create cluster: %v", err)
+		}
+		return c
+	}
+
+	c := start()
+	if c.HasExistingState() {
+		t.Fatal("new node reported as having existing state")
+	}
+	if err := c.Bootstrap(); err != nil {
+		t.Fatalf("failed to bootstrap cluster: %v", err)
+	}
+	waitFor(t, func() bool { return c.Raft.State() == raft.Leader })
+	if err := c.Shutdown(); err != nil {
+		t.Fatalf("failed to shut down cluster: %v", err)
+	}
+
+	c = start()
+	defer c.Shutdown()
+	if !c.HasExistingState() {
+		t.Fatal("restarted node reported as having no existing state")
+	}
+	// bootstrapping again, even with another configuration, is skipped
+	if err := c.Bootstrap(Node{ID: "node0", Address: "127.0.0.1:1"}, Node{ID: "node1", Address: "127.0.0.1:2"}); err != nil {
+		t.Fatalf("failed to skip bootstrap: %v", err)
+	}
+	waitFor(t, func() bool { return c.Raft.State() == raft.Leader })
+	servers, err := c.Servers()
+	if err != nil || len(servers) != 1 || servers[0].ID != "node0" {
+		t.Fatalf("wrong servers after restart: %v, %v (expected node0 only)", servers, err)
+	}
+}
+
+// Test_SkipSnapshotRestore tests that the latest snapshot is only restored
+// on start if the finite state machine does not hold its entries already.
+func Test_SkipSnapshotRestore(t *testing.T) {
+	tests := []struct {
+		name      string
+		fsm       raft.FSM
+		snapshots bool
+		expected  bool
+	}{
+		{"not indexed", &raft.MockFSM{}, true, false},
+		{"no snapshots", &indexedFSM{applied: 12}, false, false},
+		{"behind the snapshot", &indexedFSM{applied: 5}, true, false},
+		{"unknown applied index", &indexedFSM{applied: 0}, true, false},
+		{"at the snapshot", &indexedFSM{applied: 10}, true, true},
+		{"ahead of the snapshot", &indexedFSM{applied: 12}, true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			snapshots, err := raft.NewFileSnapshotStore(t.TempDir(), DefaultRetainSnapshotCount, ioutil.Discard)
+			if err != nil {
+				t.Fatalf("failed to create snapshot store: %v", err)
+			}
+			if test.snapshots {
+				for _, index := range []uint64{4, 10} {
+					sink, err := snapshots.Create(raft.SnapshotVersionMax, index, 1, raft.Configuration{}, 1, nil)
+					if err != nil {
+						t.Fatalf("failed to create snapshot: %v", err)
+					}
+					if err := sink.Close(); err != nil {
+						t.Fatalf("failed to close snapshot: %v", err)
+					}
+				}
+			}
+			c := &Cluster{fsm: test.fsm, Snapshots: snapshots}
+			if skip := c.skipSnapshotRestore(); skip != test.expected {
+				t.Fatalf("wrong skip: %t (expected %t)", skip, test.expected)
+			}
+		})
+	}
+}
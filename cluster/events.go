@@ -0,0 +1,229 @@
+package cluster
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dihedron/brokerd/log"
+	"go.uber.org/zap"
+)
+
+// DefaultEventHistory is the default number of cluster events kept in the
+// local history.
+const DefaultEventHistory = 1000
+
+// ErrEventsDropped is the error returned when some of the events following
+// the requested sequence number are no longer in the history.
+var ErrEventsDropped error = fmt.Errorf("events dropped from the history")
+
+// EventType is the type of a cluster event.
+type EventType string
+
+const (
+	// EventLeaderElected is the event of a node becoming the leader.
+	EventLeaderElected EventType = "leader-elected"
+	// EventLeaderLost is the event of the cluster having no known leader.
+	EventLeaderLost EventType = "leader-lost"
+	// EventStateChanged is the event of this node changing its Raft state.
+	EventStateChanged EventType = "state-changed"
+	// EventPeerAdded is the event of the leader starting to replicate to a
+	// new peer.
+	EventPeerAdded EventType = "peer-added"
+	// EventPeerRemoved is the event of the leader stopping replicating to a
+	// removed peer.
+	EventPeerRemoved EventType = "peer-removed"
+	// EventHeartbeatFailed is the event of the leader failing to reach a
+	// peer, after having reached it before.
+	EventHeartbeatFailed EventType = "heartbeat-failed"
+	// EventHeartbeatResumed is the event of the leader reaching a peer
+	// again, after having failed to.
+	EventHeartbeatResumed EventType = "heartbeat-resumed"
+	// EventSnapshotTaken is the event of this node taking a snapshot of
+	// its state.
+	EventSnapshotTaken EventType = "snapshot-taken"
+	// EventSnapshotRestored is the event of this node restoring its state
+	// from a snapshot.
+	EventSnapshotRestored EventType = "snapshot-restored"
+)
+
+// Event is an event in the cluster, as observed by this node.
+type Event struct {
+	// Sequence is the sequence number of the event on this node.
+	Sequence uint64 `json:"sequence"`
+	// Type is the type of the event.
+	Type EventType `json:"type"`
+	// Timestamp is the time the event was observed.
+	Timestamp time.Time `json:"timestamp"`
+	// Term is the Raft term of this node when the event was observed.
+	Term uint64 `json:"term,omitempty"`
+	// NodeID is the ID of the node the event refers to, if known.
+	NodeID string `json:"node_id,omitempty"`
+	// Address is the Raft address of the node the event refers to.
+	Address string `json:"address,omitempty"`
+	// State is the new Raft state of this node, for state changes.
+	State string `json:"state,omitempty"`
+	// Error is the error that caused the event, if any.
+	Error string `json:"error,omitempty"`
+}
+
+// EventLog keeps the most recent cluster events observed by this node,
+// persisting them to a file so that they survive restarts.
+type EventLog struct {
+	// Capacity is the number of events kept in the history.
+	Capacity int
+
+	path     string
+	lock     sync.Mutex
+	file     *os.File
+	lines    int
+	events   []Event
+	sequence uint64
+	notify   chan struct{}
+}
+
+// NewEventLog creates an EventLog that persists the events to the file at
+// the given path, loading the events already in it.
+func NewEventLog(path string, capacity int) (*EventLog, error) {
+	l := &EventLog{
+		Capacity: capacity,
+		path:     path,
+		notify:   make(chan struct{}),
+	}
+	if file, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var event Event
+			if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+				log.L.Warn("skipping invalid event in history", zap.String("path", path), zap.Error(err))
+				continue
+			}
+			l.append(event)
+			l.lines++
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			log.L.Error("error reading event history", zap.String("path", path), zap.Error(err))
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		log.L.Error("error opening event history", zap.String("path", path), zap.Error(err))
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		log.L.Error("error opening event history", zap.String("path", path), zap.Error(err))
+		return nil, err
+	}
+	l.file = file
+	return l, nil
+}
+
+// Since returns the events in the history following the given sequence
+// number, along with the sequence number of the latest event and a
+// channel that is closed when further events are published; if some of
+// the following events have already been dropped from the history, it
+// returns ErrEventsDropped along with those still in it.
+func (l *EventLog) Since(sequence uint64) ([]Event, uint64, <-chan struct{}, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	events := []Event{}
+	for _, event := range l.events {
+		if event.Sequence > sequence {
+			events = append(events, event)
+		}
+	}
+	if len(l.events) > 0 && sequence < l.events[0].Sequence-1 {
+		return events, l.sequence, l.notify, ErrEventsDropped
+	}
+	return events, l.sequence, l.notify, nil
+}
+
+// Close closes the file the events are persisted to.
+func (l *EventLog) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.file.Close()
+}
+
+// publish records the event, stamping it with the next sequence number
+// and the current time, and wakes up the callers waiting for it.
+func (l *EventLog) publish(event Event) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	event.Sequence = l.sequence + 1
+	event.Timestamp = time.Now()
+	l.append(event)
+	log.L.Debug("cluster event", zap.Uint64("sequence", event.Sequence), zap.String("type", string(event.Type)), zap.String("node ID", event.NodeID))
+	if err := l.persist(event); err != nil {
+		log.L.Error("error persisting cluster event", zap.String("path", l.path), zap.Error(err))
+	}
+	close(l.notify)
+	l.notify = make(chan struct{})
+}
+
+// append adds the event to the history, discarding the oldest events
+// beyond the capacity.
+func (l *EventLog) append(event Event) {
+	l.events = append(l.events, event)
+	if l.Capacity > 0 && len(l.events) > l.Capacity {
+		l.events = append([]Event{}, l.events[len(l.events)-l.Capacity:]...)
+	}
+	if event.Sequence > l.sequence {
+		l.sequence = event.Sequence
+	}
+}
+
+// persist appends the event to the file; when the file holds twice as
+// many events as the history, it is rewritten with the history only.
+func (l *EventLog) persist(event Event) error {
+	if l.Capacity > 0 && l.lines >= 2*l.Capacity {
+		return l.compact()
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	l.lines++
+	return nil
+}
+
+// compact rewrites the file with the events in the history.
+func (l *EventLog) compact() error {
+	temp := l.path + ".tmp"
+	file, err := os.OpenFile(temp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	for _, event := range l.events {
+		data, err := json.Marshal(event)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		writer.Write(append(data, '\n'))
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(temp, l.path); err != nil {
+		return err
+	}
+	l.file.Close()
+	if l.file, err = os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND, 0o600); err != nil {
+		return err
+	}
+	l.lines = len(l.events)
+	return nil
+}
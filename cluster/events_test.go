@@ -0,0 +1,64 @@
+package cluster
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// sequences returns the sequence numbers of the given events.
+func sequences(events []Event) []uint64 {
+	result := []uint64{}
+	for _, event := range events {
+		result = append(result, event.Sequence)
+	}
+	return result
+}
+
+// Test_EventLogSince tests that the events following a sequence number are
+// returned, and that events dropped from the history are reported.
+func Test_EventLogSince(t *testing.T) {
+	tests := []struct {
+		name     string
+		since    uint64
+		expected []uint64
+		dropped  bool
+	}{
+		{"from the start", 0, []uint64{3, 4, 5}, true},
+		{"from a dropped event", 1, []uint64{3, 4, 5}, true},
+		{"from the last dropped event", 2, []uint64{3, 4, 5}, false},
+		{"from a retained event", 4, []uint64{5}, false},
+		{"from the latest event", 5, []uint64{}, false},
+		{"from now on", ^uint64(0), []uint64{}, false},
+	}
+	path := filepath.Join(t.TempDir(), "events.json")
+	events, err := NewEventLog(path, 3)
+	if err != nil {
+		t.Fatalf("failed to create event log: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		events.publish(Event{Type: EventStateChanged})
+	}
+	events.Close()
+	// the history is loaded again from the file, as after a restart
+	events, err = NewEventLog(path, 3)
+	if err != nil {
+		t.Fatalf("failed to reopen event log: %v", err)
+	}
+	defer events.Close()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, latest, _, err := events.Since(test.since)
+			if dropped := errors.Is(err, ErrEventsDropped); dropped != test.dropped {
+				t.Fatalf("wrong error: %v (dropped events expected: %t)", err, test.dropped)
+			}
+			if actual := sequences(result); !reflect.DeepEqual(actual, test.expected) {
+				t.Fatalf("wrong events: %v (expected %v)", actual, test.expected)
+			}
+			if latest != 5 {
+				t.Fatalf("wrong latest sequence number: %d (expected 5)", latest)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package cluster
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dihedron/brokerd/log"
+	"github.com/hashicorp/raft"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrNotLeader is the error returned when an operation that can only
+	// be performed by the leader is attempted on a follower.
+	ErrNotLeader error = fmt.Errorf("node is not the leader")
+	// ErrUnknownNode is the error returned when the requested node is not
+	// in the cluster configuration.
+	ErrUnknownNode error = fmt.Errorf("unknown node")
+	// ErrInvalidTarget is the error returned when the leadership cannot be
+	// transferred to the requested node, e.g. because it is not a voter.
+	ErrInvalidTarget error = fmt.Errorf("invalid leadership transfer target")
+	// ErrTransferFailed is the error returned when no new leader, or a
+	// leader other than the requested one, is confirmed in time after a
+	// leadership transfer.
+	ErrTransferFailed error = fmt.Errorf("leadership transfer failed")
+)
+
+// TransferLeadership hands the leadership over to the node with the given
+// ID or, if empty, to the most up-to-date voter in the cluster; it only
+// returns once the new leader is confirmed, with the server that has
+// taken over.
+func (c *Cluster) TransferLeadership(id string) (*raft.Server, error) {
+	if c.Raft.State() != raft.Leader {
+		return nil, ErrNotLeader
+	}
+	servers, err := c.Servers()
+	if err != nil {
+		return nil, err
+	}
+	var future raft.Future
+	if id == "" {
+		log.L.Info("transferring leadership")
+		future = c.Raft.LeadershipTransfer()
+	} else {
+		target := find(servers, func(server raft.Server) bool { return string(server.ID) == id })
+		if target == nil {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownNode, id)
+		}
+		if id == c.NodeID {
+			return nil, fmt.Errorf("%w: node %s is already the leader", ErrInvalidTarget, id)
+		}
+		if target.Suffrage != raft.Voter {
+			return nil, fmt.Errorf("%w: node %s is not a voter", ErrInvalidTarget, id)
+		}
+		log.L.Info("transferring leadership", zap.String("target", id))
+		future = c.Raft.LeadershipTransferToServer(target.ID, target.Address)
+	}
+	if err := future.Error(); err != nil {
+		log.L.Error("error transferring leadership", zap.String("target", id), zap.Error(err))
+		if err == raft.ErrNotLeader {
+			return nil, ErrNotLeader
+		}
+		return nil, fmt.Errorf("%w: %v", ErrTransferFailed, err)
+	}
+
+	// the transfer completes when the target has been asked to start an
+	// election: wait for the cluster to confirm a new leader
+	timeout := c.RaftTimeout
+	if timeout == 0 {
+		timeout = DefaultRaftTimeout
+	}
+	self := c.Transport.LocalAddr()
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		leader := c.Raft.Leader()
+		if leader == "" || leader == self {
+			continue
+		}
+		server := find(servers, func(server raft.Server) bool { return server.Address == leader })
+		if server == nil {
+			server = &raft.Server{Address: leader}
+		}
+		if id != "" && string(server.ID) != id {
+			log.L.Error("leadership taken over by another node", zap.String("target", id), zap.String("leader", string(server.ID)))
+			return server, fmt.Errorf("%w: node %s became the leader instead of %s", ErrTransferFailed, server.ID, id)
+		}
+		log.L.Info("leadership transferred", zap.String("leader", string(server.ID)))
+		return server, nil
+	}
+	log.L.Error("no new leader confirmed after leadership transfer", zap.Duration("timeout", timeout))
+	return nil, fmt.Errorf("%w: no new leader confirmed within %v", ErrTransferFailed, timeout)
+}
+
+// find returns the first server satisfying the given condition, or nil.
+func find(servers []raft.Server, match func(server raft.Server) bool) *raft.Server {
+	for i := range servers {
+		if match(servers[i]) {
+			return &servers[i]
+		}
+	}
+	return nil
+}
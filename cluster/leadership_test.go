@@ -0,0 +1,55 @@
+package cluster
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+// Test_TransferLeadership tests that the leadership is handed over to the
+// requested voter, and that invalid or failed transfers are reported.
+func Test_TransferLeadership(t *testing.T) {
+	tests := []struct {
+		name     string
+		node     int
+		target   string
+		down     string
+		expected string
+		err      error
+	}{
+		{name: "to a voter", target: "node1", expected: "node1"},
+		{name: "to any voter", target: "", expected: "any"},
+		{name: "unknown target", target: "node9", err: ErrUnknownNode},
+		{name: "to itself", target: "node0", err: ErrInvalidTarget},
+		{name: "to a non-voter", target: "node3", err: ErrInvalidTarget},
+		{name: "not leader", node: 1, target: "node2", err: ErrNotLeader},
+		{name: "target down", target: "node2", down: "node2", err: ErrTransferFailed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clusters := newTestCluster(t, 3, 1)
+			for _, c := range clusters {
+				if c.NodeID == test.down {
+					c.Raft.Shutdown().Error()
+				}
+			}
+			server, err := clusters[test.node].TransferLeadership(test.target)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("wrong error: %v (expected %v)", err, test.err)
+			}
+			if err != nil {
+				return
+			}
+			if test.expected != "any" && string(server.ID) != test.expected {
+				t.Fatalf("wrong new leader: %s (expected %s)", server.ID, test.expected)
+			}
+			if server.ID == "node0" || server.Suffrage != raft.Voter {
+				t.Fatalf("leadership transferred to an invalid server: %v", server)
+			}
+			if clusters[0].Raft.State() == raft.Leader {
+				t.Fatal("leadership not handed over")
+			}
+		})
+	}
+}
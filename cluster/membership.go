@@ -0,0 +1,191 @@
+package cluster
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dihedron/brokerd/log"
+	"github.com/hashicorp/raft"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrQuorum is the error returned when a membership change would
+	// remove the last voter, or leave fewer healthy voters than are needed
+	// for a quorum of the new configuration.
+	ErrQuorum error = fmt.Errorf("membership change would break the quorum")
+)
+
+// AddNonvoter adds a node, identified by nodeID and located at address,
+// to this cluster as a non-voter: it receives the log entries, so it can
+// serve reads, but it takes no part in elections and commits. The node
+// must be ready to respond to Raft communications at that address.
+func (c *Cluster) AddNonvoter(nodeID string, address string) error {
+	log.L.Info("received request to add non-voter", zap.String("nodeID", nodeID), zap.String("address", address))
+	if err := c.add(nodeID, address, raft.Nonvoter); err != nil {
+		return err
+	}
+	if c.Autopilot != nil {
+		// explicitly added non-voters are not to be promoted
+		return c.Autopilot.setPending(nodeID, false)
+	}
+	return nil
+}
+
+// RemoveNode removes the node with the given ID from the cluster; unless
+// forced, it refuses to remove the leader itself, or a voter if the
+// remaining healthy voters would be too few to make a quorum of the new
+// configuration.
+func (c *Cluster) RemoveNode(nodeID string, force bool) error {
+	server, err := c.check(nodeID, force)
+	if err != nil {
+		return err
+	}
+	log.L.Info("removing node from cluster", zap.String("nodeID", nodeID), zap.Bool("force", force))
+	if err := c.Raft.RemoveServer(server.ID, 0, 0).Error(); err != nil {
+		log.L.Error("error removing node from cluster", zap.String("nodeID", nodeID), zap.Error(err))
+		return mapRaftError(err)
+	}
+	log.L.Info("node removed successfully", zap.String("nodeID", nodeID))
+	return nil
+}
+
+// DemoteNode turns the voter with the given ID into a non-voter; the same
+// safety checks as in RemoveNode apply.
+func (c *Cluster) DemoteNode(nodeID string, force bool) error {
+	server, err := c.check(nodeID, force)
+	if err != nil {
+		return err
+	}
+	if server.Suffrage != raft.Voter {
+		log.L.Debug("node is not a voter, ignoring demote request", zap.String("nodeID", nodeID))
+		return nil
+	}
+	log.L.Info("demoting node", zap.String("nodeID", nodeID), zap.Bool("force", force))
+	if err := c.Raft.DemoteVoter(server.ID, 0, 0).Error(); err != nil {
+		log.L.Error("error demoting node", zap.String("nodeID", nodeID), zap.Error(err))
+		return mapRaftError(err)
+	}
+	log.L.Info("node demoted successfully", zap.String("nodeID", nodeID))
+	return nil
+}
+
+// add adds the node to the cluster with the given suffrage; if a node
+// with the same ID or address already exists, it is removed first, unless
+// both match, in which case the node is only promoted if needed.
+func (c *Cluster) add(nodeID string, address string, suffrage raft.ServerSuffrage) error {
+	if c.Raft.State() != raft.Leader {
+		return ErrNotLeader
+	}
+	servers, err := c.Servers()
+	if err != nil {
+		return err
+	}
+	for _, srv := range servers {
+		// If a node already exists with either the joining node's ID or address,
+		// that node may need to be removed from the config first.
+		if srv.ID == raft.ServerID(nodeID) || srv.Address == raft.ServerAddress(address) {
+			// However if *both* the ID and the address are the same, then nothing -- not even
+			// a join operation -- is needed, unless a non-voter is joining as a voter.
+			if srv.Address == raft.ServerAddress(address) && srv.ID == raft.ServerID(nodeID) {
+				if srv.Suffrage == suffrage || suffrage == raft.Nonvoter {
+					log.L.Debug("node is already member of cluster, ignoring join request", zap.String("nodeID", nodeID), zap.String("address", address))
+					return nil
+				}
+				break
+			}
+
+			future := c.Raft.RemoveServer(srv.ID, 0, 0)
+			if err := future.Error(); err != nil {
+				return fmt.Errorf("error removing existing node %s at %s: %s", nodeID, address, err)
+			}
+		}
+	}
+
+	var future raft.IndexFuture
+	if suffrage == raft.Voter {
+		future = c.Raft.AddVoter(raft.ServerID(nodeID), raft.ServerAddress(address), 0, 0)
+	} else {
+		future = c.Raft.AddNonvoter(raft.ServerID(nodeID), raft.ServerAddress(address), 0, 0)
+	}
+	if err := future.Error(); err != nil {
+		log.L.Error("error adding node to cluster", zap.Error(err), zap.String("node ID", nodeID), zap.String("address", address), zap.Stringer("suffrage", suffrage))
+		return mapRaftError(err)
+	}
+	log.L.Info("node joined successfully", zap.String("node ID", nodeID), zap.String("address", address), zap.Stringer("suffrage", suffrage))
+	return nil
+}
+
+// check makes sure that the node with the given ID is not the leader and
+// that it can be removed from the voters without breaking the quorum,
+// unless forced; it returns the node in the current configuration.
+func (c *Cluster) check(nodeID string, force bool) (*raft.Server, error) {
+	if c.Raft.State() != raft.Leader {
+		return nil, ErrNotLeader
+	}
+	servers, err := c.Servers()
+	if err != nil {
+		return nil, err
+	}
+	server := find(servers, func(server raft.Server) bool { return string(server.ID) == nodeID })
+	if server == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownNode, nodeID)
+	}
+	if force {
+		return server, nil
+	}
+	if nodeID == c.NodeID {
+		return nil, fmt.Errorf("%w: node %s is the leader, transfer the leadership first", ErrInvalidTarget, nodeID)
+	}
+	if err := checkQuorum(servers, server.ID, c.reachable); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// checkQuorum makes sure that, once the server with the given ID is no
+// longer a voter, the voters left that are healthy are enough to make a
+// quorum of the new configuration.
+func checkQuorum(servers []raft.Server, id raft.ServerID, healthy func(server raft.Server) bool) error {
+	target := find(servers, func(server raft.Server) bool { return server.ID == id })
+	if target == nil || target.Suffrage != raft.Voter {
+		return nil
+	}
+	voters, alive := 0, 0
+	for _, server := range servers {
+		if server.Suffrage != raft.Voter || server.ID == id {
+			continue
+		}
+		voters++
+		if healthy(server) {
+			alive++
+		}
+	}
+	if voters == 0 {
+		return fmt.Errorf("%w: node %s is the last voter", ErrQuorum, id)
+	}
+	if quorum := voters/2 + 1; alive < quorum {
+		return fmt.Errorf("%w: %d healthy voters would be left, %d are needed", ErrQuorum, alive, quorum)
+	}
+	return nil
+}
+
+// reachable checks whether the server is this node, or whether this node
+// has recently reached it through Raft; it is only meaningful on the
+// leader, which sends the heartbeats.
+func (c *Cluster) reachable(server raft.Server) bool {
+	if string(server.ID) == c.NodeID {
+		return true
+	}
+	contact := c.observed.lastContact(server.Address)
+	return !contact.IsZero() && time.Since(contact) <= DefaultMaxLastContact
+}
+
+// mapRaftError maps the errors returned by Raft onto the cluster errors,
+// where applicable.
+func mapRaftError(err error) error {
+	if err == raft.ErrNotLeader || err == raft.ErrLeadershipLost {
+		return ErrNotLeader
+	}
+	return err
+}
@@ -0,0 +1,61 @@
+package cluster
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+// servers returns a configuration with the given voters and non-voters.
+func servers(voters []string, nonvoters []string) []raft.Server {
+	result := []raft.Server{}
+	for _, id := range voters {
+		result = append(result, raft.Server{Suffrage: raft.Voter, ID: raft.ServerID(id), Address: raft.ServerAddress(id + ":7000")})
+	}
+	for _, id := range nonvoters {
+		result = append(result, raft.Server{Suffrage: raft.Nonvoter, ID: raft.ServerID(id), Address: raft.ServerAddress(id + ":7000")})
+	}
+	return result
+}
+
+// Test_CheckQuorum tests that a voter can only be removed or demoted if the
+// healthy voters left are enough to make a quorum of the new configuration.
+func Test_CheckQuorum(t *testing.T) {
+	tests := []struct {
+		name      string
+		voters    []string
+		nonvoters []string
+		unhealthy []string
+		target    string
+		err       error
+	}{
+		{"healthy cluster of three", []string{"a", "b", "c"}, nil, nil, "c", nil},
+		{"healthy cluster of two", []string{"a", "b"}, nil, nil, "b", nil},
+		{"last voter", []string{"a"}, []string{"b"}, nil, "a", ErrQuorum},
+		{"removing the unhealthy voter", []string{"a", "b", "c"}, nil, []string{"c"}, "c", nil},
+		{"removing a healthy voter with one unhealthy", []string{"a", "b", "c"}, nil, []string{"c"}, "b", ErrQuorum},
+		{"cluster of five with one unhealthy", []string{"a", "b", "c", "d", "e"}, nil, []string{"e"}, "d", nil},
+		{"cluster of five with two unhealthy", []string{"a", "b", "c", "d", "e"}, nil, []string{"d", "e"}, "c", ErrQuorum},
+		{"cluster of five removing an unhealthy one of two", []string{"a", "b", "c", "d", "e"}, nil, []string{"d", "e"}, "e", nil},
+		{"non-voters do not count", []string{"a", "b", "c"}, []string{"d", "e"}, []string{"c"}, "b", ErrQuorum},
+		{"removing a non-voter", []string{"a", "b", "c"}, []string{"d"}, []string{"b", "c"}, "d", nil},
+		{"unknown server", []string{"a"}, nil, nil, "x", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			unhealthy := map[raft.ServerID]bool{}
+			for _, id := range test.unhealthy {
+				unhealthy[raft.ServerID(id)] = true
+			}
+			healthy := func(server raft.Server) bool { return !unhealthy[server.ID] }
+			err := checkQuorum(servers(test.voters, test.nonvoters), raft.ServerID(test.target), healthy)
+			if test.err == nil && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if test.err != nil && !errors.Is(err, test.err) {
+				t.Fatalf("wrong error: %v (expected %v)", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package cluster
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dihedron/brokerd/log"
+	"github.com/hashicorp/raft"
+	"go.uber.org/zap"
+)
+
+// observe registers a Raft observer and turns its observations into
+// cluster events, until the Cluster is shut down.
+func (c *Cluster) observe() {
+	observations := make(chan raft.Observation, 64)
+	observer := raft.NewObserver(observations, false, func(o *raft.Observation) bool {
+		// vote requests are too frequent to be of interest
+		_, vote := o.Data.(raft.RequestVoteRequest)
+		return !vote
+	})
+	c.Raft.RegisterObserver(observer)
+	go func() {
+		defer c.Raft.DeregisterObserver(observer)
+		// Raft may notify the same leader more than once
+		var leader raft.ServerAddress
+		for {
+			select {
+			case <-c.stopObserving:
+				return
+			case o := <-observations:
+				var event Event
+				switch data := o.Data.(type) {
+				case raft.LeaderObservation:
+					if data.Leader == leader {
+						continue
+					}
+					leader = data.Leader
+					if data.Leader == "" {
+						event = Event{Type: EventLeaderLost}
+					} else {
+						event = Event{Type: EventLeaderElected, NodeID: c.nodeIDOf(data.Leader), Address: string(data.Leader)}
+					}
+				case raft.PeerObservation:
+					event = Event{Type: EventPeerAdded, NodeID: string(data.Peer.ID), Address: string(data.Peer.Address)}
+					if data.Removed {
+						event.Type = EventPeerRemoved
+					}
+				case raft.RaftState:
+					event = Event{Type: EventStateChanged, NodeID: c.NodeID, State: strings.ToLower(data.String())}
+				default:
+					continue
+				}
+				event.Term, _ = strconv.ParseUint(c.Raft.Stats()["term"], 10, 64)
+				c.publish(event)
+			}
+		}
+	}()
+}
+
+// publish records the event in the history, if any; it must not query
+// Raft, as it is also called from within Raft's own goroutines.
+func (c *Cluster) publish(event Event) {
+	if c.Events != nil {
+		c.Events.publish(event)
+	}
+}
+
+// nodeIDOf returns the ID of the server with the given address in the
+// current configuration, or the empty string if unknown.
+func (c *Cluster) nodeIDOf(address raft.ServerAddress) string {
+	servers, err := c.Servers()
+	if err != nil {
+		return ""
+	}
+	if server := find(servers, func(server raft.Server) bool { return server.Address == address }); server != nil {
+		return string(server.ID)
+	}
+	return ""
+}
+
+// observedTransport wraps the Raft transport to detect when the leader
+// fails to reach a peer, and when it reaches it again; Raft does not
+// report failed heartbeats to observers, nor when it last reached a peer.
+type observedTransport struct {
+	*raft.NetworkTransport
+	cluster *Cluster
+	lock    sync.Mutex
+	failing map[raft.ServerAddress]bool
+	contact map[raft.ServerAddress]time.Time
+}
+
+// AppendEntries sends the append entries request, used for heartbeats
+// too, and records whether the peer could be reached.
+func (t *observedTransport) AppendEntries(id raft.ServerID, target raft.ServerAddress, args *raft.AppendEntriesRequest, resp *raft.AppendEntriesResponse) error {
+	err := t.NetworkTransport.AppendEntries(id, target, args, resp)
+	t.lock.Lock()
+	failing := t.failing[target]
+	t.failing[target] = err != nil
+	if err == nil {
+		t.contact[target] = time.Now()
+	}
+	t.lock.Unlock()
+	if err != nil && !failing {
+		t.cluster.publish(Event{Type: EventHeartbeatFailed, Term: args.Term, NodeID: string(id), Address: string(target), Error: err.Error()})
+	} else if err == nil && failing {
+		t.cluster.publish(Event{Type: EventHeartbeatResumed, Term: args.Term, NodeID: string(id), Address: string(target)})
+	}
+	return err
+}
+
+// lastContact returns the time at which the peer at the given address was
+// last reached, or the zero time if never.
+func (t *observedTransport) lastContact(target raft.ServerAddress) time.Time {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.contact[target]
+}
+
+// observedFSM wraps the finite state machine to report when a snapshot
+// is taken or restored.
+type observedFSM struct {
+	raft.FSM
+	cluster *Cluster
+}
+
+// Snapshot returns a snapshot of the FSM, which reports when persisted.
+func (f *observedFSM) Snapshot() (raft.FSMSnapshot, error) {
+	snapshot, err := f.FSM.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &observedSnapshot{FSMSnapshot: snapshot, cluster: f.cluster}, nil
+}
+
+// Restore restores the FSM from a snapshot.
+func (f *observedFSM) Restore(data io.ReadCloser) error {
+	if err := f.FSM.Restore(data); err != nil {
+		f.cluster.publish(Event{Type: EventSnapshotRestored, NodeID: f.cluster.NodeID, Error: err.Error()})
+		return err
+	}
+	f.cluster.publish(Event{Type: EventSnapshotRestored, NodeID: f.cluster.NodeID})
+	return nil
+}
+
+// observedSnapshot wraps an FSM snapshot to report when it is persisted.
+type observedSnapshot struct {
+	raft.FSMSnapshot
+	cluster *Cluster
+}
+
+// Persist writes the snapshot to the sink.
+func (s *observedSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := s.FSMSnapshot.Persist(sink); err != nil {
+		s.cluster.publish(Event{Type: EventSnapshotTaken, NodeID: s.cluster.NodeID, Error: err.Error()})
+		return err
+	}
+	s.cluster.publish(Event{Type: EventSnapshotTaken, NodeID: s.cluster.NodeID})
+	log.L.Debug("snapshot persisted", zap.String("id", sink.ID()))
+	return nil
+}
@@ -42,3 +42,11 @@ func WithRaftTimeout(value time.Duration) Option {
 		cluster.RaftTimeout = value
 	}
 }
+
+// WithEventHistory sets up the number of cluster events kept in the
+// history.
+func WithEventHistory(value int) Option {
+	return func(cluster *Cluster) {
+		cluster.EventHistory = value
+	}
+}
@@ -0,0 +1,193 @@
+package cluster
+
+import (
+	"time"
+
+	"github.com/dihedron/brokerd/log"
+	"github.com/hashicorp/raft"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultRebalanceInterval is the default interval at which the leader
+	// checks whether a more preferred node can take over.
+	DefaultRebalanceInterval = 2 * time.Second
+	// DefaultHysteresis is the default time a more preferred node must have
+	// been healthy before the leadership is handed over to it, which is
+	// also the minimum time between two handovers.
+	DefaultHysteresis = 30 * time.Second
+)
+
+// PreferenceFunc retrieves the IDs of the nodes that should lead the
+// cluster, in order of preference.
+type PreferenceFunc func() ([]string, error)
+
+// Rebalancer runs on the leader and hands the leadership over to the
+// most preferred node, as soon as it is a healthy voter and has caught up
+// with the leader; to avoid flapping, the node must have been healthy for
+// a while, and the leadership is not handed over again too soon.
+type Rebalancer struct {
+	// Interval is the interval at which the leader checks whether a more
+	// preferred node can take over.
+	Interval time.Duration
+	// Hysteresis is the time a more preferred node must have been healthy
+	// before the leadership is handed over to it, and the minimum time
+	// between two handovers.
+	Hysteresis time.Duration
+	// MaxLastContact is the maximum time since a node last heard from the
+	// leader for it to be healthy.
+	MaxLastContact time.Duration
+	// MaxLag is the maximum number of log entries a node can be behind the
+	// leader for it to be healthy.
+	MaxLag uint64
+
+	cluster     *Cluster
+	preference  PreferenceFunc
+	probe       StateFunc
+	candidate   string
+	since       time.Time
+	transferred time.Time
+	stop        chan struct{}
+}
+
+// RebalancerOption represents the optional function.
+type RebalancerOption func(rebalancer *Rebalancer)
+
+// WithRebalanceInterval sets up the interval at which the leader checks
+// whether a more preferred node can take over.
+func WithRebalanceInterval(value time.Duration) RebalancerOption {
+	return func(rebalancer *Rebalancer) {
+		rebalancer.Interval = value
+	}
+}
+
+// WithHysteresis sets up the time a more preferred node must have been
+// healthy before the leadership is handed over to it.
+func WithHysteresis(value time.Duration) RebalancerOption {
+	return func(rebalancer *Rebalancer) {
+		rebalancer.Hysteresis = value
+	}
+}
+
+// StartRebalancer starts handing the leadership over to the preferred
+// nodes, as retrieved through the given function; the state of the other
+// nodes is retrieved through the probe function. The rebalancer is
+// stopped when the Cluster is shut down.
+func (c *Cluster) StartRebalancer(preference PreferenceFunc, probe StateFunc, options ...RebalancerOption) *Rebalancer {
+	// setup with defaults
+	r := &Rebalancer{
+		Interval:       DefaultRebalanceInterval,
+		Hysteresis:     DefaultHysteresis,
+		MaxLastContact: DefaultMaxLastContact,
+		MaxLag:         DefaultMaxLag,
+		cluster:        c,
+		preference:     preference,
+		probe:          probe,
+		stop:           make(chan struct{}),
+	}
+	// apply functional options to override
+	for _, option := range options {
+		option(r)
+	}
+	c.Rebalancer = r
+	go func() {
+		ticker := time.NewTicker(r.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+				r.update()
+			}
+		}
+	}()
+	return r
+}
+
+// Stop stops the rebalancer.
+func (r *Rebalancer) Stop() {
+	close(r.stop)
+}
+
+// LeaderPreference returns the IDs of the nodes that should lead the
+// cluster, in order of preference.
+func (c *Cluster) LeaderPreference() ([]string, error) {
+	if c.Rebalancer == nil {
+		return []string{}, nil
+	}
+	ids, err := c.Rebalancer.preference()
+	if err != nil {
+		return nil, err
+	}
+	if ids == nil {
+		ids = []string{}
+	}
+	return ids, nil
+}
+
+// update hands the leadership over to the most preferred healthy voter,
+// if it has been healthy for long enough.
+func (r *Rebalancer) update() {
+	if r.cluster.Raft.State() != raft.Leader {
+		r.candidate = ""
+		return
+	}
+	ids, err := r.preference()
+	if err != nil {
+		log.L.Warn("error retrieving leader preference", zap.Error(err))
+		return
+	}
+	target := r.target(ids)
+	now := time.Now()
+	if target == "" {
+		r.candidate = ""
+		return
+	}
+	if target != r.candidate {
+		log.L.Info("preferred node available to lead", zap.String("id", target), zap.Duration("hysteresis", r.Hysteresis))
+		r.candidate = target
+		r.since = now
+		return
+	}
+	if now.Sub(r.since) < r.Hysteresis || now.Sub(r.transferred) < r.Hysteresis {
+		return
+	}
+	r.transferred = now
+	log.L.Info("handing leadership over to preferred node", zap.String("id", target))
+	if _, err := r.cluster.TransferLeadership(target); err != nil {
+		log.L.Warn("error handing leadership over to preferred node", zap.String("id", target), zap.Error(err))
+	}
+}
+
+// target returns the ID of the node that should take over the leadership
+// from this node, i.e. the first healthy voter in the preference list if
+// it comes before this node, or the empty string.
+func (r *Rebalancer) target(ids []string) string {
+	if len(ids) == 0 {
+		return ""
+	}
+	servers, err := r.cluster.Servers()
+	if err != nil {
+		return ""
+	}
+	applied := r.cluster.Raft.AppliedIndex()
+	for _, id := range ids {
+		if id == r.cluster.NodeID {
+			return ""
+		}
+		server := find(servers, func(server raft.Server) bool { return string(server.ID) == id })
+		if server == nil || server.Suffrage != raft.Voter {
+			continue
+		}
+		state, err := r.probe(*server)
+		if err != nil {
+			log.L.Debug("preferred node not reachable", zap.String("id", id), zap.Error(err))
+			continue
+		}
+		if _, ok := healthy(state, applied, r.MaxLastContact, r.MaxLag); ok {
+			return id
+		}
+	}
+	return ""
+}
@@ -0,0 +1,186 @@
+package cluster
+
+import (
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// newTestCluster creates a cluster of Raft nodes on the loopback interface,
+// with in-memory stores, where "node0" is the leader; the first nodes are
+// voters and the others non-voters.
+func newTestCluster(t *testing.T, voters int, nonvoters int) []*Cluster {
+	t.Helper()
+	clusters := []*Cluster{}
+	for i := 0; i < voters+nonvoters; i++ {
+		id := fmt.Sprintf("node%d", i)
+		transport, err := raft.NewTCPTransport("127.0.0.1:0", nil, 3, time.Second, ioutil.Discard)
+		if err != nil {
+			t.Fatalf("failed to create transport for %s: %v", id, err)
+		}
+		config := raft.DefaultConfig()
+		config.LocalID = raft.ServerID(id)
+		config.HeartbeatTimeout = 100 * time.Millisecond
+		config.ElectionTimeout = 100 * time.Millisecond
+		config.LeaderLeaseTimeout = 100 * time.Millisecond
+		config.CommitTimeout = 5 * time.Millisecond
+		config.LogOutput = ioutil.Discard
+		r, err := raft.NewRaft(config, &raft.MockFSM{}, raft.NewInmemStore(), raft.NewInmemStore(), raft.NewInmemSnapshotStore(), transport)
+		if err != nil {
+			t.Fatalf("failed to create Raft node %s: %v", id, err)
+		}
+		t.Cleanup(func() {
+			r.Shutdown().Error()
+			transport.Close()
+		})
+		clusters = append(clusters, &Cluster{NodeID: id, Raft: r, Transport: transport, RaftTimeout: 5 * time.Second})
+	}
+
+	leader := clusters[0]
+	configuration := raft.Configuration{Servers: []raft.Server{{ID: "node0", Address: leader.Transport.LocalAddr()}}}
+	if err := leader.Raft.BootstrapCluster(configuration).Error(); err != nil {
+		t.Fatalf("failed to bootstrap cluster: %v", err)
+	}
+	waitFor(t, func() bool { return leader.Raft.State() == raft.Leader })
+	for i, c := range clusters[1:] {
+		add := leader.Raft.AddVoter
+		if i+1 >= voters {
+			add = leader.Raft.AddNonvoter
+		}
+		if err := add(raft.ServerID(c.NodeID), c.Transport.LocalAddr(), 0, 0).Error(); err != nil {
+			t.Fatalf("failed to add %s: %v", c.NodeID, err)
+		}
+	}
+	for _, c := range clusters[1:] {
+		c := c
+		waitFor(t, func() bool { return c.Raft.Leader() == leader.Transport.LocalAddr() })
+	}
+	return clusters
+}
+
+// waitFor waits for the condition to hold, failing the test if it does
+// not within a few seconds.
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if condition() {
+			return
+		}
+	}
+	t.Fatalf("condition not met in time")
+}
+
+// probe returns a function that retrieves the state of the nodes in the
+// cluster from the nodes themselves, except for the unreachable ones.
+func probe(clusters []*Cluster, unreachable ...string) StateFunc {
+	return func(server raft.Server) (*NodeState, error) {
+		for _, id := range unreachable {
+			if string(server.ID) == id {
+				return nil, fmt.Errorf("node %s unreachable", id)
+			}
+		}
+		for _, c := range clusters {
+			if c.NodeID == string(server.ID) {
+				state := c.Self()
+				return &state, nil
+			}
+		}
+		return nil, fmt.Errorf("node %s unknown", server.ID)
+	}
+}
+
+// preference returns a function that retrieves the given preference.
+func preference(ids ...string) PreferenceFunc {
+	return func() ([]string, error) {
+		return ids, nil
+	}
+}
+
+// Test_RebalancerTarget tests that the leadership is handed over to the
+// first healthy voter that is preferred to the leader.
+func Test_RebalancerTarget(t *testing.T) {
+	clusters := newTestCluster(t, 3, 1)
+	tests := []struct {
+		name        string
+		preference  []string
+		unreachable []string
+		expected    string
+	}{
+		{"no preference", nil, nil, ""},
+		{"leader first", []string{"node0", "node1"}, nil, ""},
+		{"preferred voter", []string{"node1", "node0"}, nil, "node1"},
+		{"leader not in preference", []string{"node2", "node1"}, nil, "node2"},
+		{"preferred voter unreachable", []string{"node1", "node2"}, []string{"node1"}, "node2"},
+		{"all preferred voters unreachable", []string{"node1", "node2", "node0"}, []string{"node1", "node2"}, ""},
+		{"preferred non-voter", []string{"node3", "node2"}, nil, "node2"},
+		{"preferred unknown node", []string{"node9", "node0", "node1"}, nil, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := &Rebalancer{
+				MaxLastContact: DefaultMaxLastContact,
+				MaxLag:         DefaultMaxLag,
+				cluster:        clusters[0],
+				probe:          probe(clusters, test.unreachable...),
+			}
+			if target := r.target(test.preference); target != test.expected {
+				t.Fatalf("wrong target: %q (expected %q)", target, test.expected)
+			}
+		})
+	}
+}
+
+// Test_RebalancerHysteresis tests that the leadership is only handed over
+// to a preferred node once it has been healthy for long enough, and not
+// too soon after the previous handover.
+func Test_RebalancerHysteresis(t *testing.T) {
+	tests := []struct {
+		name        string
+		preference  []string
+		candidate   string
+		stable      time.Duration
+		transferred time.Duration
+		leader      string
+		expected    string
+	}{
+		{"leader first", []string{"node0", "node1"}, "", 0, time.Hour, "node0", ""},
+		{"new candidate", []string{"node1", "node0"}, "", 0, time.Hour, "node0", "node1"},
+		{"candidate changed", []string{"node1", "node0"}, "node2", time.Hour, time.Hour, "node0", "node1"},
+		{"not stable long enough", []string{"node1", "node0"}, "node1", 30 * time.Second, time.Hour, "node0", "node1"},
+		{"transferred too recently", []string{"node1", "node0"}, "node1", time.Hour, 30 * time.Second, "node0", "node1"},
+		{"stable long enough", []string{"node1", "node0"}, "node1", 2 * time.Minute, time.Hour, "node1", "node1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clusters := newTestCluster(t, 3, 0)
+			now := time.Now()
+			r := &Rebalancer{
+				Hysteresis:     time.Minute,
+				MaxLastContact: DefaultMaxLastContact,
+				MaxLag:         DefaultMaxLag,
+				cluster:        clusters[0],
+				preference:     preference(test.preference...),
+				probe:          probe(clusters),
+				candidate:      test.candidate,
+				since:          now.Add(-test.stable),
+				transferred:    now.Add(-test.transferred),
+			}
+			r.update()
+			if r.candidate != test.expected {
+				t.Fatalf("wrong candidate: %q (expected %q)", r.candidate, test.expected)
+			}
+			leader := ""
+			for _, c := range clusters {
+				if c.Raft.State() == raft.Leader {
+					leader = c.NodeID
+				}
+			}
+			if leader != test.leader {
+				t.Fatalf("wrong leader: %q (expected %q)", leader, test.leader)
+			}
+		})
+	}
+}
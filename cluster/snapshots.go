@@ -0,0 +1,132 @@
+package cluster
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/dihedron/brokerd/log"
+	"github.com/hashicorp/raft"
+	"go.uber.org/zap"
+)
+
+// DefaultRestoreTimeout is the default maximum time allowed to restore
+// the cluster from a snapshot.
+const DefaultRestoreTimeout = 5 * time.Minute
+
+var (
+	// ErrSnapshotNotFound is the error returned when the requested snapshot
+	// is not among those kept by this node.
+	ErrSnapshotNotFound error = fmt.Errorf("snapshot not found")
+	// ErrNothingToSnapshot is the error returned when a snapshot is
+	// requested but nothing has changed since the latest one.
+	ErrNothingToSnapshot error = fmt.Errorf("nothing new to snapshot")
+	// ErrInvalidSnapshot is the error returned when the snapshot to restore
+	// is rejected by the finite state machine.
+	ErrInvalidSnapshot error = fmt.Errorf("snapshot rejected")
+)
+
+// SnapshotVerifier is implemented by the finite state machines that can
+// check the contents of a snapshot without restoring it; Raft cannot
+// recover from a restore failing, so the snapshots to restore are first
+// verified, if the finite state machine allows.
+type SnapshotVerifier interface {
+	// VerifySnapshot checks that the snapshot can be restored.
+	VerifySnapshot(reader io.Reader) error
+}
+
+// TakeSnapshot forces this node to take a snapshot of its state, and
+// returns its metadata.
+func (c *Cluster) TakeSnapshot() (*raft.SnapshotMeta, error) {
+	log.L.Info("taking snapshot")
+	future := c.Raft.Snapshot()
+	if err := future.Error(); err != nil {
+		if err == raft.ErrNothingNewToSnapshot {
+			return nil, ErrNothingToSnapshot
+		}
+		log.L.Error("error taking snapshot", zap.Error(err))
+		return nil, err
+	}
+	meta, reader, err := future.Open()
+	if err != nil {
+		log.L.Error("error opening snapshot", zap.Error(err))
+		return nil, err
+	}
+	reader.Close()
+	log.L.Info("snapshot taken", zap.String("id", meta.ID), zap.Uint64("index", meta.Index))
+	return meta, nil
+}
+
+// ListSnapshots returns the metadata of the snapshots kept by this node,
+// the most recent first.
+func (c *Cluster) ListSnapshots() ([]*raft.SnapshotMeta, error) {
+	snapshots, err := c.Snapshots.List()
+	if err != nil {
+		log.L.Error("error listing snapshots", zap.Error(err))
+		return nil, err
+	}
+	return snapshots, nil
+}
+
+// OpenSnapshot opens the snapshot with the given ID, returning its metadata
+// and a reader of its contents, which must be closed by the caller.
+func (c *Cluster) OpenSnapshot(id string) (*raft.SnapshotMeta, io.ReadCloser, error) {
+	snapshots, err := c.ListSnapshots()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, snapshot := range snapshots {
+		if snapshot.ID == id {
+			return c.Snapshots.Open(id)
+		}
+	}
+	return nil, nil, fmt.Errorf("%w: %s", ErrSnapshotNotFound, id)
+}
+
+// RestoreSnapshot replaces the state of the whole cluster with the contents
+// of a snapshot, e.g. a backup downloaded from a node; it can only be run on
+// the leader, which then replicates the restored state to the followers.
+// The contents are staged to a temporary file first, so that their size is
+// known to Raft and they can be verified before being handed over to it.
+func (c *Cluster) RestoreSnapshot(reader io.Reader) error {
+	if c.Raft.State() != raft.Leader {
+		return ErrNotLeader
+	}
+	staging, err := ioutil.TempFile(c.RaftDirectory, "restore-*.tmp")
+	if err != nil {
+		log.L.Error("error creating snapshot staging file", zap.Error(err))
+		return err
+	}
+	defer os.Remove(staging.Name())
+	defer staging.Close()
+	size, err := io.Copy(staging, reader)
+	if err != nil {
+		log.L.Error("error staging snapshot", zap.Error(err))
+		return err
+	}
+	if _, err := staging.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if verifier, ok := c.fsm.(SnapshotVerifier); ok {
+		if err := verifier.VerifySnapshot(staging); err != nil {
+			log.L.Error("snapshot rejected", zap.Error(err))
+			return fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+		}
+		if _, err := staging.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	log.L.Warn("restoring cluster from snapshot", zap.Int64("size", size))
+	meta := &raft.SnapshotMeta{
+		Version: raft.SnapshotVersionMax,
+		Size:    size,
+	}
+	if err := c.Raft.Restore(meta, staging, DefaultRestoreTimeout); err != nil {
+		log.L.Error("error restoring snapshot", zap.Error(err))
+		return mapRaftError(err)
+	}
+	log.L.Info("cluster restored from snapshot", zap.Int64("size", size))
+	return nil
+}
@@ -0,0 +1,66 @@
+package cluster
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dihedron/brokerd/log"
+	"github.com/hashicorp/raft"
+	"go.uber.org/zap"
+)
+
+// NodeState is the state of a node in the Cluster, as reported by the
+// node itself.
+type NodeState struct {
+	// ID is the unique ID of the node in the cluster.
+	ID string
+	// Address is the address of the Raft transport of the node.
+	Address string
+	// State is the Raft state of the node: "leader", "follower",
+	// "candidate" or "shutdown".
+	State string
+	// LastContact is the time elapsed since the node last heard from the
+	// leader; it is 0 on the leader and negative if the node has never
+	// heard from a leader.
+	LastContact time.Duration
+	// AppliedIndex is the index of the last log entry applied to the FSM.
+	AppliedIndex uint64
+	// CommitIndex is the index of the last log entry known to be committed.
+	CommitIndex uint64
+}
+
+// Self returns the state of this node.
+func (c *Cluster) Self() NodeState {
+	stats := c.Raft.Stats()
+	state := NodeState{
+		ID:          c.NodeID,
+		Address:     string(c.Transport.LocalAddr()),
+		State:       strings.ToLower(c.Raft.State().String()),
+		LastContact: -1,
+	}
+	switch contact := stats["last_contact"]; contact {
+	case "never":
+	case "0":
+		state.LastContact = 0
+	default:
+		if d, err := time.ParseDuration(contact); err == nil {
+			state.LastContact = d
+		} else {
+			log.L.Warn("error parsing last contact", zap.String("value", contact), zap.Error(err))
+		}
+	}
+	state.AppliedIndex, _ = strconv.ParseUint(stats["applied_index"], 10, 64)
+	state.CommitIndex, _ = strconv.ParseUint(stats["commit_index"], 10, 64)
+	return state
+}
+
+// Servers returns the servers in the current Raft configuration.
+func (c *Cluster) Servers() ([]raft.Server, error) {
+	future := c.Raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		log.L.Error("failed to get raft configuration", zap.Error(err))
+		return nil, err
+	}
+	return future.Configuration().Servers, nil
+}
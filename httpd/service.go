@@ -7,11 +7,13 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/dihedron/brokerd/cluster"
 	"github.com/dihedron/brokerd/kvstore"
 	"github.com/dihedron/brokerd/log"
+	"github.com/dihedron/brokerd/web/openapi"
 	"go.uber.org/zap"
 )
 
@@ -133,18 +135,19 @@ func (s *Service) handleKeyRequest(w http.ResponseWriter, r *http.Request) {
 		if k == "" {
 			w.WriteHeader(http.StatusBadRequest)
 		}
-		v, err := s.store.Get(k)
+		p, err := s.store.Lookup(k, kvstore.ConsistencyDefault)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		b, err := json.Marshal(map[string]string{k: v})
+		b, err := json.Marshal(map[string]string{k: p.Value})
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
+		w.Header().Set("ETag", `"`+strconv.FormatUint(p.Index, 10)+`"`)
 		io.WriteString(w, string(b))
 
 	case "POST":
@@ -154,6 +157,40 @@ func (s *Service) handleKeyRequest(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
+		// If-Match is only supported when setting a single key; the
+		// check is performed by the store along with the update.
+		if tag := strings.TrimSpace(r.Header.Get("If-Match")); tag != "" {
+			if len(m) != 1 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			guard := kvstore.Guard{Type: kvstore.Exists}
+			if tag != "*" {
+				index, err := openapi.ParseETag(tag, false)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				guard = kvstore.Guard{Type: kvstore.IndexEquals, Index: index}
+			}
+			for k, v := range m {
+				guard.Key = k
+				result, err := s.store.Transact(kvstore.Transaction{
+					Guards:     []kvstore.Guard{guard},
+					Operations: []kvstore.Operation{{Type: kvstore.Set, Key: k, Value: v}},
+				})
+				if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				if !result.Committed {
+					w.WriteHeader(http.StatusPreconditionFailed)
+					return
+				}
+				w.Header().Set("ETag", `"`+strconv.FormatUint(result.Index, 10)+`"`)
+			}
+			return
+		}
 		for k, v := range m {
 			if err := s.store.Set(k, v); err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
@@ -1,5 +1,74 @@
 package httpd
 
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/dihedron/brokerd/kvstore"
+	"github.com/dihedron/brokerd/sqlite"
+)
+
+// Test_IfMatch tests that conditional updates only accept well-formed,
+// strong entity tags, and are rejected if the key has changed since.
+func Test_IfMatch(t *testing.T) {
+	store, err := kvstore.NewLocalStore(sqlite.WithStoreDirectory(t.TempDir()))
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	defer store.Close()
+	s := &Service{store: store}
+
+	post := func(tag string, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPost, "/key", strings.NewReader(body))
+		request.Header.Set("If-Match", tag)
+		recorder := httptest.NewRecorder()
+		s.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	if w := post("*", `{"key": "value"}`); w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("wrong status for missing key: %d (expected %d)", w.Code, http.StatusPreconditionFailed)
+	}
+	if err := store.Set("key", "value"); err != nil {
+		t.Fatalf("failed to set key: %v", err)
+	}
+	property, err := store.Lookup("key", kvstore.ConsistencyDefault)
+	if err != nil {
+		t.Fatalf("failed to look up key: %v", err)
+	}
+	current := `"` + strconv.FormatUint(property.Index, 10) + `"`
+	stale := `"` + strconv.FormatUint(property.Index+1, 10) + `"`
+
+	tests := []struct {
+		name   string
+		tag    string
+		body   string
+		status int
+	}{
+		{"unquoted", strconv.FormatUint(property.Index, 10), `{"key": "other"}`, http.StatusBadRequest},
+		{"unterminated", `"` + strconv.FormatUint(property.Index, 10), `{"key": "other"}`, http.StatusBadRequest},
+		{"weak", "W/" + current, `{"key": "other"}`, http.StatusBadRequest},
+		{"not a number", `"abc"`, `{"key": "other"}`, http.StatusBadRequest},
+		{"multiple keys", current, `{"key": "other", "another": "value"}`, http.StatusBadRequest},
+		{"stale", stale, `{"key": "other"}`, http.StatusPreconditionFailed},
+		{"current", current, `{"key": "other"}`, http.StatusOK},
+		{"any", "*", `{"key": "another"}`, http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if w := post(test.tag, test.body); w.Code != test.status {
+				t.Fatalf("wrong status: %d (expected %d)", w.Code, test.status)
+			}
+		})
+	}
+	if value, err := store.Get("key", kvstore.ConsistencyDefault); err != nil || value != "another" {
+		t.Fatalf("wrong value: %q, %v (expected %q)", value, err, "another")
+	}
+}
+
 /*
 import (
 	"bytes"
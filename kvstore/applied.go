@@ -0,0 +1,54 @@
+package kvstore
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/dihedron/brokerd/log"
+	"go.uber.org/zap"
+)
+
+// setApplied records the index and term of the log entry being applied.
+func (m *mutation) setApplied(index uint64, term uint64) error {
+	_, err := m.tx.Exec("INSERT INTO applied (id, log_index, log_term) VALUES (0,?,?) ON CONFLICT(id) DO UPDATE SET log_index=excluded.log_index, log_term=excluded.log_term", index, term)
+	if err != nil {
+		log.L.Error("error recording applied index", zap.Uint64("index", index), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// Applied returns the index and term of the latest Raft log entry applied
+// to the store; they are both 0 if the store is not replicated, or if no
+// entry has been applied since it was restored from a snapshot.
+func (s *LocalStore) Applied() (uint64, uint64, error) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.applied()
+}
+
+// applied returns the index and term of the latest Raft log entry applied
+// to the store; the caller must either hold the database lock or be the
+// only one that can replace the database.
+func (s *LocalStore) applied() (uint64, uint64, error) {
+	var index, term uint64
+	err := s.DB.QueryRow("SELECT log_index, log_term FROM applied WHERE id=0").Scan(&index, &term)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, nil
+	} else if err != nil {
+		log.L.Error("error reading applied index", zap.Error(err))
+		return 0, 0, err
+	}
+	return index, term, nil
+}
+
+// resetApplied forgets the index and term of the latest Raft log entry
+// applied to the store; the caller must either hold the database lock or be
+// the only one that can replace the database.
+func (s *LocalStore) resetApplied() error {
+	if _, err := s.DB.Exec("DELETE FROM applied"); err != nil {
+		log.L.Error("error resetting applied index", zap.Error(err))
+		return err
+	}
+	return nil
+}
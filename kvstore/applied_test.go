@@ -0,0 +1,79 @@
+package kvstore
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+// Test_ApplyReplay tests that the log entries replayed by Raft after a
+// restart are only applied if they are not recorded as applied already.
+func Test_ApplyReplay(t *testing.T) {
+	tests := []struct {
+		name     string
+		index    uint64
+		expected string
+		applied  uint64
+	}{
+		{"entry already applied", 2, "3", 3},
+		{"latest entry applied", 3, "3", 3},
+		{"entry following the latest", 4, "replayed", 4},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := newTestStore(t)
+			fsm := NewReplicatedStoreFSM(store)
+			for index := uint64(1); index <= 3; index++ {
+				apply(t, fsm, index, Command{Type: Set, Key: "a", Value: strconv.FormatUint(index, 10)})
+			}
+			// a new finite state machine on the same store, as after a restart
+			fsm = NewReplicatedStoreFSM(store)
+			if fsm.AppliedIndex() != 3 {
+				t.Fatalf("wrong applied index on restart: %d (expected 3)", fsm.AppliedIndex())
+			}
+			data, _ := json.Marshal(Command{Type: Set, Key: "a", Value: "replayed"})
+			fsm.Apply(&raft.Log{Index: test.index, Term: 1, Type: raft.LogCommand, Data: data})
+			if value, _ := store.Get("a", ConsistencyDefault); value != test.expected {
+				t.Fatalf("wrong value: %q (expected %q)", value, test.expected)
+			}
+			index, term, err := store.Applied()
+			if err != nil {
+				t.Fatalf("failed to read applied index: %v", err)
+			}
+			if index != test.applied || term != 1 {
+				t.Fatalf("wrong applied entry: %d/%d (expected %d/1)", index, term, test.applied)
+			}
+		})
+	}
+}
+
+// Test_ApplyFailure tests that the entries that fail to apply are recorded
+// as applied all the same, so that they are not applied again.
+func Test_ApplyFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"invalid command", []byte("{")},
+		{"unknown command type", []byte(`{"type":99}`)},
+		{"bulk delete without filter", []byte(`{"type":3}`)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := newTestStore(t)
+			fsm := NewReplicatedStoreFSM(store)
+			apply(t, fsm, 1, Command{Type: Set, Key: "a", Value: "1"})
+			if _, ok := fsm.Apply(&raft.Log{Index: 2, Term: 1, Type: raft.LogCommand, Data: test.data}).(error); !ok {
+				t.Fatal("invalid entry applied")
+			}
+			if index, _, err := store.Applied(); err != nil || index != 2 {
+				t.Fatalf("wrong applied index: %d, %v (expected 2)", index, err)
+			}
+			if fsm.AppliedIndex() != 2 {
+				t.Fatalf("wrong applied index in memory: %d (expected 2)", fsm.AppliedIndex())
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package kvstore
+
+import (
+	"fmt"
+	"sync"
+)
+
+const (
+	// DefaultChangeFeedCapacity is the default number of events kept
+	// in the change feed.
+	DefaultChangeFeedCapacity = 1000
+)
+
+var (
+	// ErrCompacted is the error returned when the changes following the
+	// requested index are no longer available in the change feed; the
+	// client must list the keys again and resume from the current index.
+	ErrCompacted error = fmt.Errorf("changes compacted")
+)
+
+// Event is a change to a key, as reported by the change feed.
+type Event struct {
+	// Index is the index of the Raft log entry that applied the change;
+	// all the changes applied by the same entry have the same index.
+	Index uint64 `json:"index"`
+	// Key is the key that was changed.
+	Key string `json:"key"`
+	// Operation is either "set" or "delete".
+	Operation string `json:"operation"`
+	// Value is the value of the key after the change, if it was set.
+	Value *string `json:"value,omitempty"`
+}
+
+// ChangeSet is a set of consecutive changes retrieved from the feed.
+type ChangeSet struct {
+	// Events are the changes, in the order they were applied.
+	Events []Event
+	// Index is the index of the latest change known to the feed, from
+	// which clients can resume watching.
+	Index uint64
+	// Wait is closed when further changes are published to the feed.
+	Wait <-chan struct{}
+}
+
+// ChangeFeed is a bounded, in-memory buffer of the most recent changes
+// applied to the store; it knows all the changes with an index greater
+// than its floor and up to its latest index.
+type ChangeFeed struct {
+	// Capacity is the maximum number of events kept in the feed; when it
+	// is exceeded, the oldest events are discarded. If 0 or negative, no
+	// events are kept.
+	Capacity int
+	lock     sync.Mutex
+	events   []Event
+	floor    uint64
+	last     uint64
+	notify   chan struct{}
+}
+
+// NewChangeFeed creates a new ChangeFeed, starting at the given index;
+// changes up to that index are not available.
+func NewChangeFeed(index uint64) *ChangeFeed {
+	return &ChangeFeed{
+		Capacity: DefaultChangeFeedCapacity,
+		floor:    index,
+		last:     index,
+		notify:   make(chan struct{}),
+	}
+}
+
+// Since returns the events with an index greater than the given one; if
+// some of them have already been discarded, it returns ErrCompacted along
+// with a ChangeSet that has no events, but still reports the index of the
+// latest change.
+func (f *ChangeFeed) Since(index uint64) (*ChangeSet, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if index < f.floor {
+		return &ChangeSet{Index: f.last, Wait: f.notify}, ErrCompacted
+	}
+	events := []Event{}
+	for i := len(f.events) - 1; i >= 0 && f.events[i].Index > index; i-- {
+		events = append(events, f.events[i])
+	}
+	// events were collected from the newest, put them back in order
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	return &ChangeSet{Events: events, Index: f.last, Wait: f.notify}, nil
+}
+
+// latest returns the index of the latest change known to the feed.
+func (f *ChangeFeed) latest() uint64 {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.last
+}
+
+// publish appends the events applied at the given index to the feed and
+// wakes up the waiting clients; changes that are already known, as is the
+// case when Raft log entries are replayed at startup, are ignored. When the
+// capacity is exceeded, the oldest events are discarded along with all the
+// others applied at the same index, so that the feed never holds only part
+// of the changes applied by a log entry.
+func (f *ChangeFeed) publish(index uint64, events []Event) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if index <= f.last {
+		return
+	}
+	f.last = index
+	f.events = append(f.events, events...)
+	capacity := f.Capacity
+	if capacity < 0 {
+		capacity = 0
+	}
+	if excess := len(f.events) - capacity; excess > 0 {
+		for excess < len(f.events) && f.events[excess].Index == f.events[excess-1].Index {
+			excess++
+		}
+		f.floor = f.events[excess-1].Index
+		f.events = append([]Event{}, f.events[excess:]...)
+	}
+	close(f.notify)
+	f.notify = make(chan struct{})
+}
+
+// reset discards all the events in the feed, which restarts at the given
+// index; clients waiting for changes are woken up and will find out that
+// the events they were waiting for are no longer available.
+func (f *ChangeFeed) reset(index uint64) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.events = nil
+	f.floor = index
+	f.last = index
+	close(f.notify)
+	f.notify = make(chan struct{})
+}
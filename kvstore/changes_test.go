@@ -0,0 +1,151 @@
+package kvstore
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// indexes returns the indexes of the given events.
+func indexes(events []Event) []uint64 {
+	result := []uint64{}
+	for _, event := range events {
+		result = append(result, event.Index)
+	}
+	return result
+}
+
+// changes returns n events applied at the given index.
+func changes(index uint64, n int) []Event {
+	events := []Event{}
+	for i := 0; i < n; i++ {
+		events = append(events, Event{Index: index, Key: "key", Operation: "delete"})
+	}
+	return events
+}
+
+// Test_ChangeFeedCompaction tests that the feed discards the oldest changes
+// on log entry boundaries, and that clients can only resume from where the
+// changes are still complete.
+func Test_ChangeFeedCompaction(t *testing.T) {
+	tests := []struct {
+		name      string
+		capacity  int
+		published map[uint64]int
+		since     uint64
+		expected  []uint64
+		compacted bool
+		retained  int
+	}{
+		{"within capacity", 10, map[uint64]int{1: 2, 2: 2, 3: 1}, 0, []uint64{1, 1, 2, 2, 3}, false, 5},
+		{"resume within capacity", 10, map[uint64]int{1: 2, 2: 2, 3: 1}, 2, []uint64{3}, false, 5},
+		{"resume at latest", 10, map[uint64]int{1: 2, 2: 2, 3: 1}, 3, []uint64{}, false, 5},
+		{"compacted entry", 4, map[uint64]int{1: 2, 2: 2, 3: 1}, 0, nil, true, 3},
+		{"resume after compacted entry", 4, map[uint64]int{1: 2, 2: 2, 3: 1}, 1, []uint64{2, 2, 3}, false, 3},
+		{"entry split by capacity", 3, map[uint64]int{1: 1, 2: 2, 3: 2}, 1, nil, true, 2},
+		{"resume after split entry", 3, map[uint64]int{1: 1, 2: 2, 3: 2}, 2, []uint64{3, 3}, false, 2},
+		{"entry larger than capacity", 2, map[uint64]int{1: 1, 2: 3}, 1, nil, true, 0},
+		{"resume after entry larger than capacity", 2, map[uint64]int{1: 1, 2: 3}, 2, []uint64{}, false, 0},
+		{"no capacity", 0, map[uint64]int{1: 2, 2: 2, 3: 1}, 2, nil, true, 0},
+		{"resume at latest with no capacity", 0, map[uint64]int{1: 2, 2: 2, 3: 1}, 3, []uint64{}, false, 0},
+		{"negative capacity", -1, map[uint64]int{1: 2, 2: 2, 3: 1}, 2, nil, true, 0},
+		{"resume at latest with negative capacity", -1, map[uint64]int{1: 2, 2: 2, 3: 1}, 3, []uint64{}, false, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			feed := NewChangeFeed(0)
+			feed.Capacity = test.capacity
+			for index := uint64(1); index <= uint64(len(test.published)); index++ {
+				feed.publish(index, changes(index, test.published[index]))
+			}
+			if len(feed.events) != test.retained {
+				t.Fatalf("wrong number of retained changes: %d (expected %d)", len(feed.events), test.retained)
+			}
+			set, err := feed.Since(test.since)
+			if test.compacted {
+				if !errors.Is(err, ErrCompacted) {
+					t.Fatalf("wrong error: %v (expected %v)", err, ErrCompacted)
+				}
+			} else if err != nil {
+				t.Fatalf("failed to retrieve changes: %v", err)
+			} else if actual := indexes(set.Events); !reflect.DeepEqual(actual, test.expected) {
+				t.Fatalf("wrong changes: %v (expected %v)", actual, test.expected)
+			}
+			if set.Index != uint64(len(test.published)) {
+				t.Fatalf("wrong latest index: %d (expected %d)", set.Index, len(test.published))
+			}
+		})
+	}
+}
+
+// Test_ChangeFeedNotify tests that clients waiting for changes are woken up
+// when they are published, and that replayed changes are ignored.
+func Test_ChangeFeedNotify(t *testing.T) {
+	feed := NewChangeFeed(5)
+	set, err := feed.Since(5)
+	if err != nil {
+		t.Fatalf("failed to retrieve changes: %v", err)
+	}
+	feed.publish(5, changes(5, 1))
+	select {
+	case <-set.Wait:
+		t.Fatal("woken up by a replayed change")
+	default:
+	}
+	feed.publish(6, changes(6, 1))
+	select {
+	case <-set.Wait:
+	default:
+		t.Fatal("not woken up by a new change")
+	}
+	set, err = feed.Since(5)
+	if err != nil {
+		t.Fatalf("failed to retrieve changes: %v", err)
+	}
+	if actual := indexes(set.Events); !reflect.DeepEqual(actual, []uint64{6}) {
+		t.Fatalf("wrong changes: %v (expected %v)", actual, []uint64{6})
+	}
+	if _, err := feed.Since(4); !errors.Is(err, ErrCompacted) {
+		t.Fatalf("wrong error before the start of the feed: %v (expected %v)", err, ErrCompacted)
+	}
+	feed.reset(10)
+	select {
+	case <-set.Wait:
+	default:
+		t.Fatal("not woken up by a reset")
+	}
+	if _, err := feed.Since(6); !errors.Is(err, ErrCompacted) {
+		t.Fatalf("wrong error after reset: %v (expected %v)", err, ErrCompacted)
+	}
+}
+
+// Test_Changes tests that the changes applied to the store are published
+// with the index of the mutation that applied them.
+func Test_Changes(t *testing.T) {
+	store := newTestStore(t)
+	store.Set("a", "1")
+	set, err := store.Changes(0)
+	if err != nil {
+		t.Fatalf("failed to retrieve changes: %v", err)
+	}
+	from := set.Index
+	result, err := store.Transact(Transaction{Operations: []Operation{
+		{Type: Set, Key: "b", Value: "2"},
+		{Type: Delete, Key: "a"},
+	}})
+	if err != nil {
+		t.Fatalf("failed to apply transaction: %v", err)
+	}
+	set, err = store.Changes(from)
+	if err != nil {
+		t.Fatalf("failed to retrieve changes: %v", err)
+	}
+	value := "2"
+	expected := []Event{
+		{Index: result.Index, Key: "b", Operation: "set", Value: &value},
+		{Index: result.Index, Key: "a", Operation: "delete"},
+	}
+	if !reflect.DeepEqual(set.Events, expected) {
+		t.Fatalf("wrong changes: %+v (expected %+v)", set.Events, expected)
+	}
+}
@@ -0,0 +1,34 @@
+package kvstore
+
+import (
+	"fmt"
+)
+
+var (
+	// ErrInvalidConsistency is the error returned when an unknown level
+	// of consistency is requested.
+	ErrInvalidConsistency error = fmt.Errorf("invalid consistency level")
+)
+
+// Consistency is the level of consistency required when reading from
+// the store; it only makes a difference when the store is replicated.
+type Consistency int8
+
+const (
+	// ConsistencyDefault is the level of consistency the store was
+	// configured with: for a ReplicatedStore, it is ConsistencyNone if
+	// reads are allowed on followers, ConsistencyWeak otherwise.
+	ConsistencyDefault Consistency = iota
+	// ConsistencyNone reads the local database, whatever the state of the
+	// node; it is the fastest option, but followers may return stale data.
+	ConsistencyNone
+	// ConsistencyWeak reads the local database, provided that the node
+	// believes it is the leader; a leader that has been partitioned away
+	// from the cluster may return stale data until it steps down.
+	ConsistencyWeak
+	// ConsistencyStrong reads the local database once the node has
+	// confirmed with a quorum that it is still the leader and all the
+	// entries committed so far have been applied; reads are linearizable,
+	// at the cost of a round trip to the other nodes.
+	ConsistencyStrong
+)
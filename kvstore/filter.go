@@ -0,0 +1,72 @@
+package kvstore
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvalidFilter is the error returned when the filter used to
+	// select keys is not valid, e.g. because its pattern does not compile.
+	ErrInvalidFilter error = fmt.Errorf("invalid filter")
+)
+
+// clause returns the SQL WHERE clause (and its arguments) selecting the
+// rows in the pairs table that have not expired at the given time, whose
+// key is within the range identified by the filter and strictly follows
+// the given cursor, if any; the pattern cannot be expressed in SQL and
+// must be applied to the returned rows.
+func (f Filter) clause(cursor string, now time.Time) (string, []interface{}) {
+	conditions := []string{"(expires_at IS NULL OR expires_at > ?)"}
+	args := []interface{}{now.UnixNano()}
+	if f.Prefix != "" {
+		conditions = append(conditions, "key >= ?")
+		args = append(args, f.Prefix)
+		if upper, ok := successor(f.Prefix); ok {
+			conditions = append(conditions, "key < ?")
+			args = append(args, upper)
+		}
+	}
+	if f.Start != "" {
+		conditions = append(conditions, "key >= ?")
+		args = append(args, f.Start)
+	}
+	if f.End != "" {
+		conditions = append(conditions, "key < ?")
+		args = append(args, f.End)
+	}
+	if cursor != "" {
+		conditions = append(conditions, "key > ?")
+		args = append(args, cursor)
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// matcher compiles the filter pattern; it returns nil if no pattern
+// is specified.
+func (f Filter) matcher() (*regexp.Regexp, error) {
+	if f.Pattern == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile(f.Pattern)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidFilter, err)
+	}
+	return re, nil
+}
+
+// successor returns the smallest string that is greater than all the
+// strings having the given prefix; it returns false if there is no such
+// string, i.e. when the prefix is made only of 0xFF bytes.
+func successor(prefix string) (string, bool) {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xFF {
+			b[i]++
+			return string(b[:i+1]), true
+		}
+	}
+	return "", false
+}
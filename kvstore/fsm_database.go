@@ -0,0 +1,161 @@
+package kvstore
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/dihedron/brokerd/log"
+	"github.com/dihedron/brokerd/sqlite"
+	"github.com/hashicorp/raft"
+	"go.uber.org/zap"
+)
+
+// SQLiteDatabaseSnapshot is a transient object holding a copy of the
+// whole SQLite database, as it was when the snapshot was created.
+type SQLiteDatabaseSnapshot struct {
+	path        string
+	size        int64
+	index       uint64
+	compression string
+}
+
+// snapshotDatabase copies the whole database to a temporary file, next to
+// the database itself; the copy is taken before returning, so that it is
+// consistent with the latest log entry applied.
+func (s *ReplicatedStoreFSM) snapshotDatabase() (raft.FSMSnapshot, error) {
+	file, err := ioutil.TempFile(s.store.DataDirectory, "snapshot-*.db")
+	if err != nil {
+		log.L.Error("error creating snapshot file", zap.Error(err))
+		return nil, err
+	}
+	file.Close()
+	if err := s.store.Backup(file.Name()); err != nil {
+		os.Remove(file.Name())
+		return nil, err
+	}
+	info, err := os.Stat(file.Name())
+	if err != nil {
+		log.L.Error("error reading snapshot file", zap.Error(err))
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return &SQLiteDatabaseSnapshot{
+		path:        file.Name(),
+		size:        info.Size(),
+		index:       atomic.LoadUint64(&s.applied),
+		compression: s.Compression,
+	}, nil
+}
+
+// Persist streams the copy of the database to the Raft-provided sink, in
+// chunks, in the framed format.
+func (s *SQLiteDatabaseSnapshot) Persist(sink raft.SnapshotSink) error {
+	log.L.Debug("persisting database snapshot...", zap.Uint64("index", s.index), zap.Int64("size", s.size), zap.String("compression", s.compression))
+	err := func() error {
+		file, err := os.Open(s.path)
+		if err != nil {
+			log.L.Error("error opening snapshot file", zap.Error(err))
+			return err
+		}
+		defer file.Close()
+		chunks := uint64((s.size + chunkSize - 1) / chunkSize)
+		writer, err := newSnapshotWriter(sink, snapshotHeader{Contents: SnapshotDatabase, Index: s.index, Rows: chunks, Compression: s.compression})
+		if err != nil {
+			log.L.Error("error writing snapshot header", zap.Error(err))
+			return err
+		}
+		chunk := make([]byte, chunkSize)
+		for {
+			n, err := io.ReadFull(file, chunk)
+			if n > 0 {
+				if err := writer.writeRaw(frameChunk, chunk[:n]); err != nil {
+					log.L.Error("error writing chunk to snapshot", zap.Error(err))
+					return err
+				}
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			} else if err != nil {
+				log.L.Error("error reading snapshot file", zap.Error(err))
+				return err
+			}
+		}
+		if err := writer.close(); err != nil {
+			log.L.Error("error writing snapshot to sink", zap.Error(err))
+			return err
+		}
+		return sink.Close()
+	}()
+	if err != nil {
+		log.L.Error("an error occurred, snapshot cancelled", zap.Error(err))
+		sink.Cancel()
+	}
+	return err
+}
+
+// Release removes the copy of the database.
+func (s *SQLiteDatabaseSnapshot) Release() {
+	log.L.Debug("releasing database snapshot")
+	if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+		log.L.Warn("error removing snapshot file", zap.String("path", s.path), zap.Error(err))
+	}
+}
+
+// stageDatabase writes the database in the snapshot to the given path,
+// and checks its integrity.
+func stageDatabase(path string, frames *snapshotReader) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		log.L.Error("error opening staging database", zap.Error(err))
+		return err
+	}
+	err = func() error {
+		defer file.Close()
+		for {
+			_, chunk, err := frames.next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+			if _, err := file.Write(chunk); err != nil {
+				return err
+			}
+		}
+		return file.Sync()
+	}()
+	if err != nil {
+		log.L.Error("error restoring database snapshot", zap.Error(err))
+		return err
+	}
+	staging, err := sqlite.New(sqlite.WithStoreDirectory(filepath.Dir(path)), sqlite.WithStoreFileName(filepath.Base(path)))
+	if err != nil {
+		log.L.Error("error opening restored database", zap.Error(err))
+		return err
+	}
+	var result string
+	err = staging.DB.QueryRow("PRAGMA quick_check").Scan(&result)
+	if cerr := staging.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.L.Error("error checking restored database", zap.Error(err))
+		return err
+	} else if result != "ok" {
+		err = fmt.Errorf("%w: restored database is corrupted: %s", ErrInvalidSnapshot, result)
+		log.L.Error("error checking restored database", zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// removeDatabase removes a staging database, along with its WAL.
+func removeDatabase(path string) {
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		os.Remove(path + suffix)
+	}
+}
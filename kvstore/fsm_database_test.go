@@ -0,0 +1,116 @@
+package kvstore
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Test_RestoreDatabase tests that a snapshot of the whole database replaces
+// the store, and that the applied index and the change feed start over.
+func Test_RestoreDatabase(t *testing.T) {
+	source := newTestFSM(t)
+	source.Mode = SnapshotDatabase
+	populate(t, source)
+	data := takeSnapshot(t, source)
+
+	target := newTestFSM(t)
+	apply(t, target, 1, Command{Type: Set, Key: "z", Value: "1"})
+	if err := restore(target, data); err != nil {
+		t.Fatalf("failed to restore snapshot: %v", err)
+	}
+	expected, actual := state(t, source.store), state(t, target.store)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("wrong state restored: %v (expected %v)", actual, expected)
+	}
+
+	// the entries applied are unknown until the next one
+	if index, term, err := target.store.Applied(); err != nil || index != 0 || term != 0 {
+		t.Fatalf("wrong applied entry after restore: %d/%d, %v (expected 0/0)", index, term, err)
+	}
+	if target.AppliedIndex() != 0 {
+		t.Fatalf("wrong applied index after restore: %d (expected 0)", target.AppliedIndex())
+	}
+
+	// the change feed restarts at the latest change in the restored state
+	index, err := target.store.index()
+	if err != nil {
+		t.Fatalf("failed to read index: %v", err)
+	}
+	if _, err := target.store.Feed.Since(0); !errors.Is(err, ErrCompacted) {
+		t.Fatalf("wrong error for changes before restore: %v (expected %v)", err, ErrCompacted)
+	}
+	changes, err := target.store.Feed.Since(index)
+	if err != nil || changes.Index != index || len(changes.Events) != 0 {
+		t.Fatalf("wrong changes after restore: %+v, %v (expected none at %d)", changes, err, index)
+	}
+
+	apply(t, target, 7, Command{Type: Set, Key: "d", Value: "1"})
+	if index, term, err := target.store.Applied(); err != nil || index != 7 || term != 1 {
+		t.Fatalf("wrong applied entry: %d/%d, %v (expected 7/1)", index, term, err)
+	}
+	changes, err = target.store.Feed.Since(index)
+	if err != nil || changes.Index != 7 || len(changes.Events) != 1 {
+		t.Fatalf("wrong changes: %+v, %v (expected 1 at 7)", changes, err)
+	}
+}
+
+// Test_RestoreCorruptDatabase tests that a snapshot holding a database that
+// fails the integrity check is rejected, and leaves the store untouched.
+func Test_RestoreCorruptDatabase(t *testing.T) {
+	source := newTestFSM(t)
+	populate(t, source)
+	path := filepath.Join(t.TempDir(), "backup.db")
+	if err := source.store.Backup(path); err != nil {
+		t.Fatalf("failed to back up store: %v", err)
+	}
+	database, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read backup: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		database []byte
+		message  string
+	}{
+		{"not a database", []byte(strings.Repeat("garbage", 1000)), "not a database"},
+		{"damaged pages", append(append(append([]byte{}, database[:4096]...), make([]byte, 4096)...), database[8192:]...), "corrupted"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// the frames are valid, only the database in them is not
+			var buffer bytes.Buffer
+			writer, err := newSnapshotWriter(&buffer, snapshotHeader{Contents: SnapshotDatabase, Index: 6, Rows: 1})
+			if err != nil {
+				t.Fatalf("failed to write header: %v", err)
+			}
+			if err := writer.writeRaw(frameChunk, test.database); err != nil {
+				t.Fatalf("failed to write chunk: %v", err)
+			}
+			if err := writer.close(); err != nil {
+				t.Fatalf("failed to close snapshot: %v", err)
+			}
+
+			fsm := newTestFSM(t)
+			apply(t, fsm, 1, Command{Type: Set, Key: "a", Value: "untouched"})
+			if err := restore(fsm, buffer.Bytes()); err == nil || !strings.Contains(err.Error(), test.message) {
+				t.Fatalf("wrong error: %v (expected %q)", err, test.message)
+			}
+			if actual := contents(t, fsm.store); !reflect.DeepEqual(actual, map[string]string{"a": "untouched"}) {
+				t.Fatalf("store changed by failed restore: %v", actual)
+			}
+			if index, term, err := fsm.store.Applied(); err != nil || index != 1 || term != 1 {
+				t.Fatalf("wrong applied entry after failed restore: %d/%d, %v (expected 1/1)", index, term, err)
+			}
+			// the staging database is removed
+			if staged, _ := filepath.Glob(filepath.Join(fsm.store.DataDirectory, "restore-*")); len(staged) != 0 {
+				t.Fatalf("staging files left behind: %v", staged)
+			}
+		})
+	}
+}
@@ -1,13 +1,21 @@
 package kvstore
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/dihedron/brokerd/log"
+	"github.com/dihedron/brokerd/sqlite"
 	"github.com/hashicorp/raft"
 	"go.uber.org/zap"
 )
@@ -22,24 +30,74 @@ const (
 	Set
 	// Delete is the "Delete" command type.
 	Delete
+	// DeleteMatching is the command type to delete all the keys
+	// selected by a Filter.
+	DeleteMatching
+	// Transact is the command type to apply a Transaction.
+	Transact
+	// Rollback is the command type to restore a key to a revision
+	// in its history.
+	Rollback
+	// Expire is the command type to delete all the keys that have
+	// expired at the time of the command.
+	Expire
+	// RegisterNode is the command type to add a node to the registry, or
+	// update its information.
+	RegisterNode
+	// SetLeaderPreference is the command type to set the list of the nodes
+	// that should lead the cluster.
+	SetLeaderPreference
+	// SetPendingPromotions is the command type to set the list of the
+	// non-voters waiting to be promoted to voters.
+	SetPendingPromotions
 )
 
 // Command is the Finite State Machine command.
 type Command struct {
-	Type  CommandType `json:"type"`
-	Key   string      `json:"key"`
-	Value string      `json:"value,omitempty"`
+	Type        CommandType   `json:"type"`
+	Key         string        `json:"key"`
+	Value       string        `json:"value,omitempty"`
+	TTL         time.Duration `json:"ttl,omitempty"`
+	Filter      *Filter       `json:"filter,omitempty"`
+	Transaction *Transaction  `json:"transaction,omitempty"`
+	Revision    uint64        `json:"revision,omitempty"`
+	Timestamp   int64         `json:"timestamp,omitempty"`
+	Retention   *int          `json:"retention,omitempty"`
+	Node        *NodeInfo     `json:"node,omitempty"`
+	Preference  []string      `json:"preference,omitempty"`
+	Promotions  []string      `json:"promotions,omitempty"`
 }
 
 // ReplicatedStoreFSM is an SQLite-base Raft Finite State Machine.
 type ReplicatedStoreFSM struct {
-	store *LocalStore
+	// Mode is either SnapshotRows, the default, or SnapshotDatabase.
+	Mode string
+	// Compression is the compression applied to the snapshots; it
+	// defaults to CompressionNone.
+	Compression string
+
+	store   *LocalStore
+	applied uint64
 }
 
+// NewReplicatedStoreFSM creates a finite state machine that applies the
+// log entries to the given store, resuming from the latest entry it
+// recorded as applied.
 func NewReplicatedStoreFSM(store *LocalStore) *ReplicatedStoreFSM {
-	return &ReplicatedStoreFSM{
+	s := &ReplicatedStoreFSM{
 		store: store,
 	}
+	if index, term, err := store.applied(); err == nil {
+		log.L.Debug("resuming from applied log entry", zap.Uint64("index", index), zap.Uint64("term", term))
+		s.applied = index
+	}
+	return s
+}
+
+// AppliedIndex returns the index of the latest log entry applied to the
+// store, as recorded in the store itself; it is 0 if unknown.
+func (s *ReplicatedStoreFSM) AppliedIndex() uint64 {
+	return atomic.LoadUint64(&s.applied)
 }
 
 // Apply log is invoked once a log entry is committed.
@@ -47,41 +105,144 @@ func NewReplicatedStoreFSM(store *LocalStore) *ReplicatedStoreFSM {
 // ApplyFuture returned by Raft.Apply method if that
 // method was called on the same Raft node as the FSM.
 func (s *ReplicatedStoreFSM) Apply(l *raft.Log) interface{} {
+	// on restart Raft replays the entries following the latest snapshot,
+	// but those already recorded as applied are in the store already
+	if l.Index <= atomic.LoadUint64(&s.applied) {
+		log.L.Debug("skipping log entry already applied", zap.Uint64("index", l.Index))
+		return nil
+	}
+	defer atomic.StoreUint64(&s.applied, l.Index)
 	var command Command
 	if err := json.Unmarshal(l.Data, &command); err != nil {
 		log.L.Error("failed to marshal command", zap.Error(err))
+		s.skip(l)
 		return err
 	}
 	// NOTE: Get does not MUTATE the FSM, thus it needs not
 	// go though the FSM.Apply rigmarole; it can be served directly
 	// from the local store; this is handled in the RemoteStore.
+	// All the pairs modified by the command are stamped with the index
+	// of the log entry and the timestamp of the command, which are the
+	// same on all nodes.
+	// the index and term of the entry are recorded in the same transaction
+	// as its changes
+	result, err := s.store.mutate(l.Index, time.Unix(0, command.Timestamp), func(m *mutation) (interface{}, error) {
+		if err := m.setApplied(l.Index, l.Term); err != nil {
+			return nil, err
+		}
+		// the history is trimmed to the retention of the leader, so that it
+		// is the same on all nodes; older entries have no retention
+		if command.Retention != nil {
+			m.retention = *command.Retention
+		}
+		return s.execute(m, &command)
+	})
+	if err != nil {
+		s.skip(l)
+		return err
+	}
+	return result
+}
+
+// skip records the index and term of an entry that failed to apply, so
+// that it is not applied again after a restart.
+func (s *ReplicatedStoreFSM) skip(l *raft.Log) {
+	s.store.mutate(l.Index, time.Now(), func(m *mutation) (interface{}, error) {
+		return nil, m.setApplied(l.Index, l.Term)
+	})
+}
+
+// execute applies the command to the local store, in the context of
+// the given mutation.
+func (s *ReplicatedStoreFSM) execute(m *mutation, command *Command) (interface{}, error) {
 	switch command.Type {
 	case Set:
-		err := s.store.Set(command.Key, command.Value)
+		err := m.set(command.Key, command.Value, command.TTL)
 		if err != nil {
-			log.L.Error("error retrieving value from SQLite store", zap.String("key", command.Key), zap.Error(err))
-			return err
+			log.L.Error("error storing value into SQLite store", zap.String("key", command.Key), zap.Error(err))
+			return nil, err
 		}
 		log.L.Debug("value stored", zap.String("key", command.Key), zap.String("value", command.Value))
-		return nil
+		return nil, nil
 	case Delete:
-		err := s.store.Delete(command.Key)
+		err := m.delete(command.Key)
 		if err != nil {
-			log.L.Error("error retrieving value from SQLite store", zap.String("key", command.Key), zap.Error(err))
-			return err
+			log.L.Error("error deleting value from SQLite store", zap.String("key", command.Key), zap.Error(err))
+			return nil, err
 		}
 		log.L.Debug("value deleted", zap.String("key", command.Key))
-		return nil
+		return nil, nil
+	case DeleteMatching:
+		if command.Filter == nil {
+			err := fmt.Errorf("%w: no filter in command", ErrInvalidFilter)
+			log.L.Error("invalid bulk delete command", zap.Error(err))
+			return nil, err
+		}
+		count, err := m.deleteMatching(*command.Filter)
+		if err != nil {
+			log.L.Error("error deleting values from SQLite store", zap.Error(err))
+			return nil, err
+		}
+		log.L.Debug("values deleted", zap.Int("count", count))
+		return count, nil
+	case Transact:
+		if command.Transaction == nil {
+			err := fmt.Errorf("%w: no transaction in command", ErrInvalidTransaction)
+			log.L.Error("invalid transaction command", zap.Error(err))
+			return nil, err
+		}
+		result, err := m.transact(*command.Transaction)
+		if err != nil {
+			log.L.Error("error applying transaction to SQLite store", zap.Error(err))
+			return nil, err
+		}
+		log.L.Debug("transaction applied", zap.Bool("committed", result.Committed))
+		return result, nil
+	case Rollback:
+		if err := m.rollback(command.Key, command.Revision); err != nil {
+			log.L.Error("error rolling back value in SQLite store", zap.String("key", command.Key), zap.Uint64("revision", command.Revision), zap.Error(err))
+			return nil, err
+		}
+		log.L.Debug("value rolled back", zap.String("key", command.Key), zap.Uint64("revision", command.Revision))
+		return m.index, nil
+	case Expire:
+		count, err := m.expire()
+		if err != nil {
+			log.L.Error("error deleting expired values from SQLite store", zap.Error(err))
+			return nil, err
+		}
+		log.L.Debug("expired values deleted", zap.Int("count", count))
+		return count, nil
+	case RegisterNode:
+		if command.Node == nil {
+			err := fmt.Errorf("%w: no node information", ErrInvalidNode)
+			log.L.Error("failure applying log entry", zap.Error(err))
+			return nil, err
+		}
+		return nil, m.register(*command.Node)
+	case SetLeaderPreference:
+		if err := validatePreference(command.Preference); err != nil {
+			log.L.Error("failure applying log entry", zap.Error(err))
+			return nil, err
+		}
+		return nil, m.setLeaderPreference(command.Preference)
+	case SetPendingPromotions:
+		return nil, m.setPendingPromotions(command.Promotions)
 	default:
 		err := fmt.Errorf("unrecognized command op: %d", command.Type)
 		log.L.Error("failure applying log entry", zap.Error(err))
-		return err
+		return nil, err
 	}
 }
 
 // Snapshot returns a snapshot of the key-value store, to support
 // log compaction; the returned ReplicatedStoreFSM...
 func (s *ReplicatedStoreFSM) Snapshot() (raft.FSMSnapshot, error) {
+	if s.Mode == SnapshotDatabase {
+		return s.snapshotDatabase()
+	}
+	// the database must not be replaced until the snapshot is released
+	s.store.RLock()
 	// SQLite3 has a SERIALIZABLE isolation level by default;
 	// in order to allow concurrent Apply() to proceed we declare
 	// this transaction as ReadOnly.
@@ -91,64 +252,314 @@ func (s *ReplicatedStoreFSM) Snapshot() (raft.FSMSnapshot, error) {
 	})
 	if err != nil {
 		log.L.Error("error opening transaction", zap.Error(err))
+		s.store.RUnlock()
 		return nil, err
 	}
+	// the number of rows goes in the header, before the rows themselves
+	tables := map[string]uint64{}
+	var count uint64
+	for _, table := range snapshotTables {
+		var rows uint64
+		if err := tx.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&rows); err != nil {
+			log.L.Error("error counting rows", zap.String("table", table), zap.Error(err))
+			tx.Rollback()
+			s.store.RUnlock()
+			return nil, err
+		}
+		tables[table] = rows
+		count += rows
+	}
 	// run the query now and keep the cursor open
-	rows, err := tx.Query("SELECT key, value FROM pairs")
+	rows, err := tx.Query("SELECT key, value, modified_index, expires_at FROM pairs")
 	if err != nil {
 		log.L.Error("error running query", zap.Error(err))
 		tx.Rollback()
+		s.store.RUnlock()
 		return nil, err
 	}
 
 	return &SQLiteFSMSnapshot{
-		db:   s.store.DB,
-		tx:   tx,
-		rows: rows,
+		store:       s.store,
+		db:          s.store.DB,
+		tx:          tx,
+		rows:        rows,
+		index:       atomic.LoadUint64(&s.applied),
+		count:       count,
+		tables:      tables,
+		compression: s.Compression,
 	}, nil
 }
 
-// Restore restores the FSM to a previous state from a snapshot.
+// Restore restores the FSM to a previous state from a snapshot; the
+// snapshot is restored into a staging database, which replaces the store
+// only once fully restored and verified, so that a broken snapshot leaves
+// the store untouched and the error is reported to Raft.
 func (s *ReplicatedStoreFSM) Restore(data io.ReadCloser) error {
-	s.store.DB.Begin()
-	pairs := []pair{}
-	if err := json.NewDecoder(data).Decode(&pairs); err != nil {
-		log.L.Error("error unmarshaling JSON to snapshot contents", zap.Error(err))
-		return err
+	path, err := s.stage(data)
+	if path != "" {
+		defer removeDatabase(path)
 	}
-	tx, err := s.store.DB.BeginTx(context.Background(), &sql.TxOptions{
-		Isolation: sql.LevelDefault,
-		ReadOnly:  false,
-	})
 	if err != nil {
-		log.L.Error("error opening transaction", zap.Error(err))
 		return err
 	}
-	// the FSM state must be discarded prior to restoring
-	if _, err := tx.Exec("DELETE FROM pairs;"); err != nil {
-		log.L.Error("error truncating table")
-		tx.Rollback()
+	if err := s.store.Replace(path); err != nil {
+		return err
+	}
+	// the index in the snapshot may refer to the log of another cluster,
+	// so the entries applied are unknown until the next one
+	if err := s.store.resetApplied(); err != nil {
 		return err
 	}
-	stmt, err := tx.Prepare("INSERT INTO pairs (key,value) VALUES (?,?)")
+	atomic.StoreUint64(&s.applied, 0)
+	// the changes in the feed do not apply to the restored state
+	if index, err := s.store.index(); err == nil {
+		s.store.Feed.reset(index)
+	}
+	return nil
+}
+
+// VerifySnapshot checks that the snapshot can be restored, by restoring it
+// into a staging database which is then discarded.
+func (s *ReplicatedStoreFSM) VerifySnapshot(data io.Reader) error {
+	path, err := s.stage(data)
+	if path != "" {
+		removeDatabase(path)
+	}
+	return err
+}
+
+// stage restores the snapshot into a staging database next to the store,
+// and verifies it; it returns the path of the staging database, which the
+// caller must remove.
+func (s *ReplicatedStoreFSM) stage(data io.Reader) (string, error) {
+	file, err := ioutil.TempFile(s.store.DataDirectory, "restore-*.db")
 	if err != nil {
-		log.L.Error("error preparing insert statement", zap.Error(err))
-		tx.Rollback()
+		log.L.Error("error creating staging database", zap.Error(err))
+		return "", err
+	}
+	file.Close()
+	path := file.Name()
+	reader := bufio.NewReader(data)
+	if !isFramedSnapshot(reader) {
+		err := stageRows(path, func(tx *sql.Tx) (map[string]uint64, uint64, error) {
+			return restoreJSON(tx, reader)
+		})
+		return path, err
+	}
+	frames, err := newSnapshotReader(reader)
+	if err != nil {
+		log.L.Error("error reading snapshot header", zap.Error(err))
+		return path, err
+	}
+	defer frames.close()
+	log.L.Debug("restoring snapshot", zap.Int("version", frames.header.Version), zap.String("contents", frames.header.Contents), zap.Uint64("index", frames.header.Index), zap.Uint64("rows", frames.header.Rows), zap.String("compression", frames.header.Compression))
+	if frames.header.Contents == SnapshotDatabase {
+		return path, stageDatabase(path, frames)
+	}
+	err = stageRows(path, func(tx *sql.Tx) (map[string]uint64, uint64, error) {
+		return frames.header.Tables, frames.header.Rows, restoreFrames(tx, frames)
+	})
+	return path, err
+}
+
+// stageRows creates a database at the given path and runs restore in a
+// transaction on it; restore returns the number of rows the tables must
+// hold, by table if known and in total, which are verified before the
+// transaction is committed.
+func stageRows(path string, restore func(tx *sql.Tx) (map[string]uint64, uint64, error)) error {
+	staging, err := sqlite.New(sqlite.WithStoreDirectory(filepath.Dir(path)), sqlite.WithStoreFileName(filepath.Base(path)))
+	if err != nil {
+		log.L.Error("error opening staging database", zap.Error(err))
 		return err
 	}
-	defer stmt.Close()
+	err = func() error {
+		tx, err := staging.DB.Begin()
+		if err != nil {
+			log.L.Error("error opening transaction", zap.Error(err))
+			return err
+		}
+		defer tx.Rollback()
+		tables, rows, err := restore(tx)
+		if err != nil {
+			log.L.Error("error restoring snapshot", zap.Error(err))
+			return err
+		}
+		if err := verifyCounts(tx, tables, rows); err != nil {
+			log.L.Error("error verifying restored snapshot", zap.Error(err))
+			return err
+		}
+		log.L.Debug("restore complete, committing transaction")
+		return tx.Commit()
+	}()
+	if cerr := staging.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
 
-	for _, pair := range pairs {
-		if _, err = stmt.Exec(pair.Key, pair.Value); err != nil {
-			log.L.Error("error executing statement", zap.Error(err))
+// verifyCounts checks that the tables hold the given number of rows, by
+// table if known and in total.
+func verifyCounts(tx *sql.Tx, tables map[string]uint64, rows uint64) error {
+	var total uint64
+	for _, table := range snapshotTables {
+		var count uint64
+		if err := tx.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count); err != nil {
+			return err
+		}
+		if expected, ok := tables[table]; ok && count != expected {
+			return fmt.Errorf("%w: %d rows restored into %s, %d expected", ErrInvalidSnapshot, count, table, expected)
+		}
+		total += count
+	}
+	if total != rows {
+		return fmt.Errorf("%w: %d rows restored, %d expected", ErrInvalidSnapshot, total, rows)
+	}
+	return nil
+}
+
+// restoreFrames streams the rows in a snapshot in the framed format into
+// the tables, in batches.
+func restoreFrames(tx *sql.Tx, frames *snapshotReader) error {
+	pairs := &batch{tx: tx, insert: "INSERT INTO pairs (key,value,modified_index,expires_at) VALUES", columns: 4}
+	history := &batch{tx: tx, insert: "INSERT INTO history (key, revision, timestamp, operation, value, previous) VALUES", columns: 6}
+	m := &mutation{tx: tx}
+	for {
+		kind, payload, err := frames.next()
+		if err == io.EOF {
 			break
+		} else if err != nil {
+			return err
+		}
+		switch kind {
+		case framePair:
+			var p pair
+			if err := json.Unmarshal(payload, &p); err != nil {
+				return fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+			}
+			err = pairs.add(p.Key, p.Value, p.Index, p.ExpiresAt)
+		case frameRevision:
+			var revision Revision
+			if err := json.Unmarshal(payload, &revision); err != nil {
+				return fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+			}
+			err = history.add(revision.Key, revision.Index, revision.Timestamp.UnixNano(), revision.Operation, revision.Value, revision.Previous)
+		case frameNode:
+			var node NodeInfo
+			if err := json.Unmarshal(payload, &node); err != nil {
+				return fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+			}
+			err = m.register(node)
+		case frameSetting:
+			var st setting
+			if err := json.Unmarshal(payload, &st); err != nil {
+				return fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+			}
+			err = m.setSetting(st.Name, st.Value)
+		default:
+			return fmt.Errorf("%w: unknown frame kind %d", ErrInvalidSnapshot, kind)
+		}
+		if err != nil {
+			return err
 		}
 	}
-	if err != nil {
-		log.L.Error("error restoring snaphot", zap.Error(err))
-		tx.Rollback()
+	if err := pairs.flush(); err != nil {
+		return err
+	}
+	return history.flush()
+}
+
+// restoreJSON restores a snapshot taken before the framed format was
+// introduced into the tables, returning the number of rows restored into
+// each of them.
+func restoreJSON(tx *sql.Tx, data io.Reader) (map[string]uint64, uint64, error) {
+	var raw json.RawMessage
+	if err := json.NewDecoder(data).Decode(&raw); err != nil {
+		return nil, 0, fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+	}
+	// snapshots taken before history was introduced only contain
+	// the array of pairs
+	contents := snapshot{}
+	if trimmed := bytes.TrimSpace(raw); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(raw, &contents.Pairs); err != nil {
+			return nil, 0, fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+		}
+	} else if err := json.Unmarshal(raw, &contents); err != nil {
+		return nil, 0, fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+	}
+	pairs := &batch{tx: tx, insert: "INSERT INTO pairs (key,value,modified_index,expires_at) VALUES", columns: 4}
+	for _, p := range contents.Pairs {
+		if err := pairs.add(p.Key, p.Value, p.Index, p.ExpiresAt); err != nil {
+			return nil, 0, err
+		}
+	}
+	if err := pairs.flush(); err != nil {
+		return nil, 0, err
+	}
+	history := &batch{tx: tx, insert: "INSERT INTO history (key, revision, timestamp, operation, value, previous) VALUES", columns: 6}
+	for _, revision := range contents.History {
+		if err := history.add(revision.Key, revision.Index, revision.Timestamp.UnixNano(), revision.Operation, revision.Value, revision.Previous); err != nil {
+			return nil, 0, err
+		}
+	}
+	if err := history.flush(); err != nil {
+		return nil, 0, err
+	}
+	m := &mutation{tx: tx}
+	for _, node := range contents.Nodes {
+		if err := m.register(node); err != nil {
+			return nil, 0, err
+		}
+	}
+	for name, value := range contents.Settings {
+		if err := m.setSetting(name, value); err != nil {
+			return nil, 0, err
+		}
+	}
+	tables := map[string]uint64{
+		"pairs":    uint64(len(contents.Pairs)),
+		"history":  uint64(len(contents.History)),
+		"nodes":    uint64(len(contents.Nodes)),
+		"settings": uint64(len(contents.Settings)),
+	}
+	return tables, tables["pairs"] + tables["history"] + tables["nodes"] + tables["settings"], nil
+}
+
+// restoreBatchSize is the number of rows inserted by each statement when
+// restoring a snapshot.
+const restoreBatchSize = 256
+
+// batch accumulates the rows to insert into a table, inserting them with
+// a single statement once there are enough of them.
+type batch struct {
+	tx      *sql.Tx
+	insert  string
+	columns int
+	rows    int
+	values  []interface{}
+}
+
+// add adds a row to the batch, flushing it if full.
+func (b *batch) add(values ...interface{}) error {
+	b.values = append(b.values, values...)
+	b.rows++
+	if b.rows >= restoreBatchSize {
+		return b.flush()
+	}
+	return nil
+}
+
+// flush inserts the rows in the batch.
+func (b *batch) flush() error {
+	if b.rows == 0 {
+		return nil
+	}
+	row := "(" + strings.TrimSuffix(strings.Repeat("?,", b.columns), ",") + ")"
+	statement := b.insert + " " + strings.TrimSuffix(strings.Repeat(row+",", b.rows), ",")
+	if _, err := b.tx.Exec(statement, b.values...); err != nil {
+		log.L.Error("error inserting rows", zap.Int("rows", b.rows), zap.Error(err))
+		return err
 	}
-	log.L.Debug("restore complete, committing transaction")
-	tx.Commit()
+	b.rows = 0
+	b.values = b.values[:0]
 	return nil
 }
@@ -0,0 +1,366 @@
+package kvstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// testSink is a snapshot sink that keeps the snapshot in memory.
+type testSink struct {
+	bytes.Buffer
+	cancelled bool
+}
+
+func (s *testSink) ID() string    { return "test" }
+func (s *testSink) Close() error  { return nil }
+func (s *testSink) Cancel() error { s.cancelled = true; return nil }
+
+// newTestFSM creates a finite state machine on a new store.
+func newTestFSM(t *testing.T) *ReplicatedStoreFSM {
+	t.Helper()
+	return NewReplicatedStoreFSM(newTestStore(t))
+}
+
+// apply applies the command to the finite state machine as the log entry
+// with the given index, failing the test if it is not applied.
+func apply(t *testing.T, fsm *ReplicatedStoreFSM, index uint64, command Command) interface{} {
+	t.Helper()
+	return applyAt(t, fsm, index, time.Now(), command)
+}
+
+// applyAt applies the command as apply does, stamped with the given time
+// as if by the leader.
+func applyAt(t *testing.T, fsm *ReplicatedStoreFSM, index uint64, timestamp time.Time, command Command) interface{} {
+	t.Helper()
+	command.Timestamp = timestamp.UnixNano()
+	data, err := json.Marshal(command)
+	if err != nil {
+		t.Fatalf("failed to marshal command: %v", err)
+	}
+	result := fsm.Apply(&raft.Log{Index: index, Term: 1, Type: raft.LogCommand, Data: data})
+	if err, ok := result.(error); ok {
+		t.Fatalf("failed to apply command at index %d: %v", index, err)
+	}
+	return result
+}
+
+// takeSnapshot takes a snapshot of the finite state machine.
+func takeSnapshot(t *testing.T, fsm *ReplicatedStoreFSM) []byte {
+	t.Helper()
+	snapshot, err := fsm.Snapshot()
+	if err != nil {
+		t.Fatalf("failed to take snapshot: %v", err)
+	}
+	defer snapshot.Release()
+	sink := &testSink{}
+	if err := snapshot.Persist(sink); err != nil {
+		t.Fatalf("failed to persist snapshot: %v", err)
+	}
+	return sink.Bytes()
+}
+
+// restore restores the snapshot into the finite state machine.
+func restore(fsm *ReplicatedStoreFSM, data []byte) error {
+	return fsm.Restore(ioutil.NopCloser(bytes.NewReader(data)))
+}
+
+// state returns all the replicated state of a store.
+func state(t *testing.T, store *LocalStore) map[string]interface{} {
+	t.Helper()
+	history, err := store.History("a")
+	if err != nil {
+		t.Fatalf("failed to read history: %v", err)
+	}
+	nodes, err := store.Nodes()
+	if err != nil {
+		t.Fatalf("failed to read nodes: %v", err)
+	}
+	preference, err := store.LeaderPreference()
+	if err != nil {
+		t.Fatalf("failed to read leader preference: %v", err)
+	}
+	return map[string]interface{}{
+		"pairs":      contents(t, store),
+		"history":    history,
+		"nodes":      nodes,
+		"preference": preference,
+	}
+}
+
+// populate applies a few commands of each kind to the finite state machine.
+func populate(t *testing.T, fsm *ReplicatedStoreFSM) {
+	t.Helper()
+	apply(t, fsm, 1, Command{Type: Set, Key: "a", Value: "1"})
+	apply(t, fsm, 2, Command{Type: Set, Key: "a", Value: "2"})
+	apply(t, fsm, 3, Command{Type: Set, Key: "b", Value: "1"})
+	apply(t, fsm, 4, Command{Type: Transact, Transaction: &Transaction{Operations: []Operation{
+		{Type: Set, Key: "c", Value: "1"},
+		{Type: Delete, Key: "b"},
+	}}})
+	apply(t, fsm, 5, Command{Type: RegisterNode, Node: &NodeInfo{ID: "n1", RaftAddress: "127.0.0.1:19000", HTTPAddress: "127.0.0.1:18000"}})
+	apply(t, fsm, 6, Command{Type: SetLeaderPreference, Preference: []string{"n1"}})
+}
+
+// Test_SnapshotRestore tests that the state restored from a snapshot is
+// the same as that of the finite state machine the snapshot was taken of.
+func Test_SnapshotRestore(t *testing.T) {
+	tests := []struct {
+		mode        string
+		compression string
+	}{
+		{SnapshotRows, CompressionNone},
+		{SnapshotRows, CompressionGzip},
+		{SnapshotRows, CompressionZstd},
+		{SnapshotDatabase, CompressionNone},
+		{SnapshotDatabase, CompressionGzip},
+		{SnapshotDatabase, CompressionZstd},
+	}
+	for _, test := range tests {
+		t.Run(test.mode+" "+test.compression, func(t *testing.T) {
+			source := newTestFSM(t)
+			source.Mode = test.mode
+			source.Compression = test.compression
+			populate(t, source)
+			data := takeSnapshot(t, source)
+
+			target := newTestFSM(t)
+			apply(t, target, 1, Command{Type: Set, Key: "z", Value: "1"})
+			if err := restore(target, data); err != nil {
+				t.Fatalf("failed to restore snapshot: %v", err)
+			}
+			expected, actual := state(t, source.store), state(t, target.store)
+			if !reflect.DeepEqual(actual, expected) {
+				t.Fatalf("wrong state restored: %v (expected %v)", actual, expected)
+			}
+			// the entries following the snapshot are applied to the restored state
+			if target.AppliedIndex() != 0 {
+				t.Fatalf("wrong applied index after restore: %d (expected 0)", target.AppliedIndex())
+			}
+			apply(t, target, 7, Command{Type: Set, Key: "d", Value: "1"})
+			if value, err := target.store.Get("d", ConsistencyDefault); err != nil || value != "1" {
+				t.Fatalf("wrong value after restore: %q, %v", value, err)
+			}
+		})
+	}
+}
+
+// Test_RestoreJSON tests that snapshots taken before the framed format was
+// introduced can still be restored.
+func Test_RestoreJSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		expected map[string]string
+	}{
+		{"pairs only", `[{"key":"a","value":"1","index":1},{"key":"b","value":"2","index":2}]`, map[string]string{"a": "1", "b": "2"}},
+		{"with history", `{"pairs":[{"key":"a","value":"1","index":1}],"history":[{"key":"a","index":1,"timestamp":"2021-01-01T00:00:00Z","operation":"set","value":"1"}]}`, map[string]string{"a": "1"}},
+		{"empty", `{"pairs":[],"history":[]}`, map[string]string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fsm := newTestFSM(t)
+			if err := restore(fsm, []byte(test.data)); err != nil {
+				t.Fatalf("failed to restore snapshot: %v", err)
+			}
+			if actual := contents(t, fsm.store); !reflect.DeepEqual(actual, test.expected) {
+				t.Fatalf("wrong contents: %v (expected %v)", actual, test.expected)
+			}
+		})
+	}
+}
+
+// Test_RestoreInvalid tests that a snapshot that cannot be restored, or
+// whose restored rows do not match the expected counts, leaves the store
+// untouched.
+func Test_RestoreInvalid(t *testing.T) {
+	valid := func(t *testing.T) []byte {
+		source := newTestFSM(t)
+		populate(t, source)
+		return takeSnapshot(t, source)
+	}
+	// framed writes a snapshot with one pair and one setting, whose header
+	// announces the given number of rows by table
+	framed := func(tables map[string]uint64) func(t *testing.T) []byte {
+		return func(t *testing.T) []byte {
+			var buffer bytes.Buffer
+			writer, err := newSnapshotWriter(&buffer, snapshotHeader{Index: 1, Rows: 2, Tables: tables})
+			if err != nil {
+				t.Fatalf("failed to write header: %v", err)
+			}
+			writer.write(framePair, pair{Key: "x", Value: "1", Index: 1})
+			writer.write(frameSetting, setting{Name: "name", Value: "value"})
+			if err := writer.close(); err != nil {
+				t.Fatalf("failed to close snapshot: %v", err)
+			}
+			return buffer.Bytes()
+		}
+	}
+	tests := []struct {
+		name     string
+		snapshot func(t *testing.T) []byte
+		message  string
+	}{
+		{
+			name: "checksum mismatch",
+			snapshot: func(t *testing.T) []byte {
+				return bytes.Replace(valid(t), []byte(`"value":"2"`), []byte(`"value":"3"`), 1)
+			},
+			message: "checksum mismatch",
+		},
+		{
+			name: "truncated",
+			snapshot: func(t *testing.T) []byte {
+				data := valid(t)
+				return data[:len(data)/2]
+			},
+			message: "truncated",
+		},
+		{
+			name:     "table count mismatch",
+			snapshot: framed(map[string]uint64{"pairs": 2, "settings": 0}),
+			message:  "rows restored into pairs",
+		},
+		{
+			name: "duplicate rows",
+			snapshot: func(t *testing.T) []byte {
+				return []byte(`[{"key":"a","value":"1"},{"key":"a","value":"2"}]`)
+			},
+			message: "UNIQUE",
+		},
+		{
+			name: "not a snapshot",
+			snapshot: func(t *testing.T) []byte {
+				return []byte("garbage")
+			},
+			message: "invalid snapshot",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := test.snapshot(t)
+			fsm := newTestFSM(t)
+			apply(t, fsm, 1, Command{Type: Set, Key: "a", Value: "untouched"})
+			err := restore(fsm, data)
+			if err == nil || !strings.Contains(err.Error(), test.message) {
+				t.Fatalf("wrong error: %v (expected %q)", err, test.message)
+			}
+			if actual := contents(t, fsm.store); !reflect.DeepEqual(actual, map[string]string{"a": "untouched"}) {
+				t.Fatalf("store changed by failed restore: %v", actual)
+			}
+			if fsm.AppliedIndex() != 1 {
+				t.Fatalf("wrong applied index after failed restore: %d (expected 1)", fsm.AppliedIndex())
+			}
+			if err := fsm.VerifySnapshot(bytes.NewReader(data)); err == nil {
+				t.Fatal("invalid snapshot verified")
+			}
+		})
+	}
+}
+
+// Test_VerifySnapshot tests that verifying a valid snapshot leaves the
+// store untouched.
+func Test_VerifySnapshot(t *testing.T) {
+	source := newTestFSM(t)
+	populate(t, source)
+	data := takeSnapshot(t, source)
+	fsm := newTestFSM(t)
+	apply(t, fsm, 1, Command{Type: Set, Key: "a", Value: "untouched"})
+	if err := fsm.VerifySnapshot(bytes.NewReader(data)); err != nil {
+		t.Fatalf("failed to verify snapshot: %v", err)
+	}
+	if actual := contents(t, fsm.store); !reflect.DeepEqual(actual, map[string]string{"a": "untouched"}) {
+		t.Fatalf("store changed by verification: %v", actual)
+	}
+	if !errors.Is(restore(fsm, []byte("{")), ErrInvalidSnapshot) {
+		t.Fatal("truncated JSON snapshot not reported as invalid")
+	}
+}
+
+// stored returns the keys of all the pairs in the store, including those
+// that have expired but have not been deleted yet.
+func stored(t *testing.T, store *LocalStore) []string {
+	t.Helper()
+	rows, err := store.DB.Query("SELECT key FROM pairs ORDER BY key")
+	if err != nil {
+		t.Fatalf("failed to query pairs: %v", err)
+	}
+	defer rows.Close()
+	result := []string{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			t.Fatalf("failed to scan pair: %v", err)
+		}
+		result = append(result, key)
+	}
+	return result
+}
+
+// Test_ApplyExpire tests that the pairs deleted by an Expire command only
+// depend on the time it was stamped with, not on the local clock.
+func Test_ApplyExpire(t *testing.T) {
+	epoch := time.Date(2001, time.January, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		at       time.Time
+		count    int
+		expected []string
+	}{
+		{"none expired", epoch.Add(5 * time.Second), 0, []string{"a", "b", "c"}},
+		{"expiring now", epoch.Add(10 * time.Second), 1, []string{"b", "c"}},
+		{"all expired", epoch.Add(time.Hour), 2, []string{"c"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fsm := newTestFSM(t)
+			applyAt(t, fsm, 1, epoch, Command{Type: Set, Key: "a", Value: "1", TTL: 10 * time.Second})
+			applyAt(t, fsm, 2, epoch, Command{Type: Set, Key: "b", Value: "1", TTL: 20 * time.Second})
+			applyAt(t, fsm, 3, epoch, Command{Type: Set, Key: "c", Value: "1"})
+			count := applyAt(t, fsm, 4, test.at, Command{Type: Expire})
+			if count != test.count {
+				t.Fatalf("wrong count: %v (expected %d)", count, test.count)
+			}
+			if keys := stored(t, fsm.store); !reflect.DeepEqual(keys, test.expected) {
+				t.Fatalf("wrong keys: %v (expected %v)", keys, test.expected)
+			}
+		})
+	}
+}
+
+// Test_ReadExpired tests that the pairs that have expired are not returned
+// by reads, even before an Expire command deletes them, and that the time
+// others expire at is that of the command that set them, plus their TTL.
+func Test_ReadExpired(t *testing.T) {
+	now := time.Now().UTC()
+	fsm := newTestFSM(t)
+	applyAt(t, fsm, 1, now.Add(-time.Minute), Command{Type: Set, Key: "a", Value: "1", TTL: time.Second})
+	applyAt(t, fsm, 2, now, Command{Type: Set, Key: "b", Value: "1", TTL: time.Hour})
+
+	if keys := stored(t, fsm.store); !reflect.DeepEqual(keys, []string{"a", "b"}) {
+		t.Fatalf("wrong stored keys: %v (expected %v)", keys, []string{"a", "b"})
+	}
+	if _, err := fsm.store.Get("a", ConsistencyDefault); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("wrong error getting expired key: %v (expected %v)", err, ErrNotFound)
+	}
+	if _, err := fsm.store.Lookup("a", ConsistencyDefault); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("wrong error looking up expired key: %v (expected %v)", err, ErrNotFound)
+	}
+	if pairs := contents(t, fsm.store); !reflect.DeepEqual(pairs, map[string]string{"b": "1"}) {
+		t.Fatalf("wrong pairs: %v (expected %v)", pairs, map[string]string{"b": "1"})
+	}
+	pair, err := fsm.store.Lookup("b", ConsistencyDefault)
+	if err != nil {
+		t.Fatalf("failed to look up key: %v", err)
+	}
+	if expires := now.Add(time.Hour); !pair.ExpiresAt.Equal(expires) {
+		t.Fatalf("wrong expiry: %v (expected %v)", pair.ExpiresAt, expires)
+	}
+}
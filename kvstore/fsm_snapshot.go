@@ -2,7 +2,6 @@ package kvstore
 
 import (
 	"database/sql"
-	"encoding/json"
 
 	"github.com/dihedron/brokerd/log"
 	"github.com/hashicorp/raft"
@@ -12,20 +11,38 @@ import (
 // SQLiteFSMSnapshot is a transient object, capable of generating
 // a snaphot of the SQLite DB contents at the moment it was created.
 type SQLiteFSMSnapshot struct {
-	db   *sql.DB
-	tx   *sql.Tx
-	rows *sql.Rows
+	store       *LocalStore
+	db          *sql.DB
+	tx          *sql.Tx
+	rows        *sql.Rows
+	index       uint64
+	count       uint64
+	tables      map[string]uint64
+	compression string
 }
 
 type pair struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
+	Key       string `json:"key"`
+	Value     string `json:"value"`
+	Index     uint64 `json:"index,omitempty"`
+	ExpiresAt *int64 `json:"expires_at,omitempty"`
 }
 
-// Persist writes the SQLiteFSMSnapshot contents to the Raft-provided
-// sink.
+// snapshot is the contents of the snapshots taken before the framed
+// format was introduced, as a single JSON document: the key/value pairs,
+// the history of their revisions, the node registry and the cluster-wide
+// settings.
+type snapshot struct {
+	Pairs    []pair            `json:"pairs"`
+	History  []Revision        `json:"history"`
+	Nodes    []NodeInfo        `json:"nodes,omitempty"`
+	Settings map[string]string `json:"settings,omitempty"`
+}
+
+// Persist streams the SQLiteFSMSnapshot contents to the Raft-provided
+// sink, one row at a time, in the framed format.
 func (s *SQLiteFSMSnapshot) Persist(sink raft.SnapshotSink) error {
-	log.L.Debug("persisting snapshot...")
+	log.L.Debug("persisting snapshot...", zap.Uint64("index", s.index), zap.Uint64("rows", s.count), zap.String("compression", s.compression))
 
 	// run the transaction inside a nested function, so
 	// if anything goes wrong we can capture the error and
@@ -34,33 +51,97 @@ func (s *SQLiteFSMSnapshot) Persist(sink raft.SnapshotSink) error {
 	// or return an error so the transaction is rolled back
 	// and the sink can be closed.
 	err := func() error {
-		pairs := []pair{}
-		// loop over the rows and scan them one by one, adding them
-		// to the slice; then marshal the slice to JSON and write it
-		// out to the sink.
+		writer, err := newSnapshotWriter(sink, snapshotHeader{Index: s.index, Rows: s.count, Tables: s.tables, Compression: s.compression})
+		if err != nil {
+			log.L.Error("error writing snapshot header", zap.Error(err))
+			return err
+		}
+		// loop over the rows and scan them one by one, writing
+		// each to the sink as soon as it is read.
 		defer s.rows.Close()
 		for s.rows.Next() {
-			var key string
-			var value string
-			if err := s.rows.Scan(&key, &value); err != nil {
+			var p pair
+			if err := s.rows.Scan(&p.Key, &p.Value, &p.Index, &p.ExpiresAt); err != nil {
 				log.L.Error("error reading value from database", zap.Error(err))
 				return err
 			}
-			pairs = append(pairs, pair{Key: key, Value: value})
-			log.L.Debug("adding pair to snapshot", zap.String("key", key), zap.String("value", value))
+			if err := writer.write(framePair, p); err != nil {
+				log.L.Error("error writing pair to snapshot", zap.String("key", p.Key), zap.Error(err))
+				return err
+			}
 		}
 		if err := s.rows.Err(); err != nil {
 			log.L.Error("error reading rows", zap.Error(err))
 			return err
 		}
-		// encode data as JSON
-		data, err := json.MarshalIndent(pairs, "", "  ")
+		// then the history of all keys
+		rows, err := s.tx.Query("SELECT key, revision, timestamp, operation, value, previous FROM history")
 		if err != nil {
-			log.L.Error("error marshalling snapshot to JSON", zap.Error(err))
+			log.L.Error("error running query", zap.Error(err))
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			revision, err := scanRevision(rows)
+			if err != nil {
+				log.L.Error("error reading revision from database", zap.Error(err))
+				return err
+			}
+			if err := writer.write(frameRevision, revision); err != nil {
+				log.L.Error("error writing revision to snapshot", zap.String("key", revision.Key), zap.Error(err))
+				return err
+			}
+		}
+		if err := rows.Err(); err != nil {
+			log.L.Error("error reading rows", zap.Error(err))
+			return err
+		}
+		// then the node registry
+		nrows, err := s.tx.Query("SELECT id, raft_address, http_address, grpc_address, tags FROM nodes")
+		if err != nil {
+			log.L.Error("error running query", zap.Error(err))
+			return err
+		}
+		defer nrows.Close()
+		for nrows.Next() {
+			node, err := scanNode(nrows)
+			if err != nil {
+				log.L.Error("error reading node from database", zap.Error(err))
+				return err
+			}
+			if err := writer.write(frameNode, node); err != nil {
+				log.L.Error("error writing node to snapshot", zap.String("id", node.ID), zap.Error(err))
+				return err
+			}
+		}
+		if err := nrows.Err(); err != nil {
+			log.L.Error("error reading rows", zap.Error(err))
+			return err
+		}
+		// and the settings
+		srows, err := s.tx.Query("SELECT name, value FROM settings")
+		if err != nil {
+			log.L.Error("error running query", zap.Error(err))
+			return err
+		}
+		defer srows.Close()
+		for srows.Next() {
+			var st setting
+			if err := srows.Scan(&st.Name, &st.Value); err != nil {
+				log.L.Error("error reading setting from database", zap.Error(err))
+				return err
+			}
+			if err := writer.write(frameSetting, st); err != nil {
+				log.L.Error("error writing setting to snapshot", zap.String("name", st.Name), zap.Error(err))
+				return err
+			}
+		}
+		if err := srows.Err(); err != nil {
+			log.L.Error("error reading rows", zap.Error(err))
 			return err
 		}
-		// write data to sink
-		if _, err := sink.Write(data); err != nil {
+		// write the trailer with the checksum and flush
+		if err := writer.close(); err != nil {
 			log.L.Error("error writing snapshot to sink", zap.Error(err))
 			return err
 		}
@@ -81,4 +162,5 @@ func (s *SQLiteFSMSnapshot) Persist(sink raft.SnapshotSink) error {
 // so any resources and locks can be removed.
 func (s *SQLiteFSMSnapshot) Release() {
 	log.L.Debug("releasing snapshot")
+	s.store.RUnlock()
 }
@@ -0,0 +1,126 @@
+package kvstore
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/dihedron/brokerd/log"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultHistoryRetention is the default number of revisions kept
+	// for each key.
+	DefaultHistoryRetention = 10
+)
+
+var (
+	// ErrRevisionNotFound is the error returned when the requested
+	// revision of a key is not in its history.
+	ErrRevisionNotFound error = fmt.Errorf("revision not found")
+)
+
+// Operation names, as recorded in the history.
+const (
+	opSet    = "set"
+	opDelete = "delete"
+)
+
+// Revision is an entry in the history of a key, recording a change to
+// its value.
+type Revision struct {
+	// Key is the key that was changed.
+	Key string `json:"key"`
+	// Index is the index of the Raft log entry that applied the change.
+	Index uint64 `json:"index"`
+	// Timestamp is the time at which the change was submitted, according
+	// to the clock of the leader.
+	Timestamp time.Time `json:"timestamp"`
+	// Operation is either "set" or "delete".
+	Operation string `json:"operation"`
+	// Value is the value of the key after the change, if it was set.
+	Value *string `json:"value,omitempty"`
+	// Previous is the value of the key before the change, if it existed.
+	Previous *string `json:"previous,omitempty"`
+}
+
+// record adds a revision to the history of the given key and an event to
+// the changes of the mutation, then purges the oldest revisions exceeding
+// the retention; if the key was already changed within the same mutation,
+// the existing revision is updated so that it keeps the value preceding the
+// mutation as its previous value.
+func (m *mutation) record(key string, operation string, value *string, previous *Pair) error {
+	m.events = append(m.events, Event{Index: m.index, Key: key, Operation: operation, Value: value})
+	if m.retention <= 0 {
+		return nil
+	}
+	var prev *string
+	if previous != nil {
+		prev = &previous.Value
+	}
+	_, err := m.tx.Exec(`INSERT INTO history (key, revision, timestamp, operation, value, previous) VALUES (?,?,?,?,?,?)
+		ON CONFLICT(key, revision) DO UPDATE SET operation=excluded.operation, value=excluded.value`,
+		key, m.index, m.timestamp.UnixNano(), operation, value, prev)
+	if err != nil {
+		log.L.Error("error recording revision", zap.String("key", key), zap.Uint64("revision", m.index), zap.Error(err))
+		return err
+	}
+	_, err = m.tx.Exec(`DELETE FROM history WHERE key=? AND revision NOT IN
+		(SELECT revision FROM history WHERE key=? ORDER BY revision DESC LIMIT ?)`, key, key, m.retention)
+	if err != nil {
+		log.L.Error("error purging history", zap.String("key", key), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// revision retrieves the given revision from the history of the key.
+func (m *mutation) revision(key string, index uint64) (*Revision, error) {
+	row := m.tx.QueryRow("SELECT key, revision, timestamp, operation, value, previous FROM history WHERE key=? AND revision=?", key, index)
+	revision, err := scanRevision(row)
+	if err == sql.ErrNoRows {
+		log.L.Debug("revision not found", zap.String("key", key), zap.Uint64("revision", index))
+		return nil, ErrRevisionNotFound
+	} else if err != nil {
+		log.L.Error("error reading revision", zap.String("key", key), zap.Uint64("revision", index), zap.Error(err))
+		return nil, err
+	}
+	return revision, nil
+}
+
+// rollback restores the key to the state it had right after the given
+// revision, by setting its value again or deleting it.
+func (m *mutation) rollback(key string, index uint64) error {
+	revision, err := m.revision(key, index)
+	if err != nil {
+		return err
+	}
+	if revision.Operation == opDelete {
+		return m.delete(key)
+	}
+	return m.set(key, *revision.Value, 0)
+}
+
+// scanner is implemented by both sql.Row and sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanRevision reads a revision from a row of the history table.
+func scanRevision(row scanner) (*Revision, error) {
+	revision := &Revision{}
+	var timestamp int64
+	var value, previous sql.NullString
+	if err := row.Scan(&revision.Key, &revision.Index, &timestamp, &revision.Operation, &value, &previous); err != nil {
+		return nil, err
+	}
+	revision.Timestamp = time.Unix(0, timestamp).UTC()
+	if value.Valid {
+		revision.Value = &value.String
+	}
+	if previous.Valid {
+		revision.Previous = &previous.String
+	}
+	return revision, nil
+}
@@ -0,0 +1,41 @@
+package kvstore
+
+import (
+	"testing"
+)
+
+// Test_HistoryRetention tests that the history of a key is trimmed to the
+// retention stamped into the commands, whatever that of the local store.
+func Test_HistoryRetention(t *testing.T) {
+	retention := func(value int) *int { return &value }
+	tests := []struct {
+		name     string
+		local    int
+		stamped  *int
+		expected int
+	}{
+		{"local retention", 3, nil, 3},
+		{"stamped retention lower", 10, retention(2), 2},
+		{"stamped retention higher", 1, retention(4), 4},
+		{"no history", 10, retention(0), 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fsm := newTestFSM(t)
+			fsm.store.HistoryRetention = test.local
+			for index := uint64(1); index <= 5; index++ {
+				apply(t, fsm, index, Command{Type: Set, Key: "a", Value: "value", Retention: test.stamped})
+			}
+			history, err := fsm.store.History("a")
+			if err != nil {
+				t.Fatalf("failed to read history: %v", err)
+			}
+			if len(history) != test.expected {
+				t.Fatalf("wrong number of revisions: %d (expected %d)", len(history), test.expected)
+			}
+			if len(history) > 0 && history[0].Index != 5 {
+				t.Fatalf("wrong latest revision: %d (expected 5)", history[0].Index)
+			}
+		})
+	}
+}
@@ -1,11 +1,87 @@
 package kvstore
 
+import (
+	"time"
+)
+
+// Pair is a key/value pair, along with the index of its latest
+// modification and its expiry time, which is zero if the pair never
+// expires.
+type Pair struct {
+	Key       string    `json:"key"`
+	Value     string    `json:"value"`
+	Index     uint64    `json:"index"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Filter identifies a subset of the keys in the store; all criteria
+// that are specified must be satisfied for a key to be selected. Keys
+// are compared byte-wise, in lexical order.
+type Filter struct {
+	// Prefix selects the keys starting with the given string.
+	Prefix string `json:"prefix,omitempty"`
+	// Start is the (inclusive) lower bound of the range of keys.
+	Start string `json:"start,omitempty"`
+	// End is the (exclusive) upper bound of the range of keys.
+	End string `json:"end,omitempty"`
+	// Pattern is a regular expression that keys must match.
+	Pattern string `json:"pattern,omitempty"`
+}
+
 // KVStore is the common interface to all key/value stores.
 type KVStore interface {
-	// Get retrieves a value from the store, given its key.
-	Get(key string) (string, error)
+	// Get retrieves a value from the store, given its key, with the
+	// requested level of consistency.
+	Get(key string, level Consistency) (string, error)
+	// Lookup retrieves a key/value pair from the store, along with the
+	// index of its latest modification, which can be used as a version
+	// in guards.
+	Lookup(key string, level Consistency) (*Pair, error)
 	// Set sets a value into the store, creating it if non existing.
 	Set(key string, value string) error
+	// SetWithTTL sets a value into the store, creating it if non existing;
+	// the key/value pair expires once the given time to live has elapsed.
+	SetWithTTL(key string, value string, ttl time.Duration) error
 	// Delete removes a key/value pair from the store.
 	Delete(key string) error
+	// DeleteMatching removes all the key/value pairs selected by the given
+	// filter, as a single atomic operation; it returns the number of pairs
+	// that were removed.
+	DeleteMatching(filter Filter) (int, error)
+	// Transact applies all the operations in the transaction atomically,
+	// provided that all its guards hold; the result reports whether the
+	// transaction was committed and the outcome of each guard.
+	Transact(transaction Transaction) (*TransactionResult, error)
+	// History returns the recorded revisions of the given key, from the
+	// most recent to the oldest.
+	History(key string) ([]Revision, error)
+	// Rollback restores the given key to the state recorded in the given
+	// revision of its history, returning the index of the new revision.
+	Rollback(key string, revision uint64) (uint64, error)
+	// List returns, in lexical order of their keys, up to limit pairs
+	// selected by the given filter (no limit if less than or equal to 0);
+	// if a cursor is provided, only keys strictly following it are
+	// returned. The returned cursor can be passed to the following call
+	// to retrieve the next page; it is empty when there are no more pairs.
+	// The pairs are read with the requested level of consistency.
+	List(filter Filter, cursor string, limit int, level Consistency) ([]Pair, string, error)
+	// Changes returns the changes applied to the store after the given
+	// index, along with the index of the latest change and a channel that
+	// is closed when further changes are applied; if the changes are no
+	// longer available, it returns ErrCompacted.
+	Changes(index uint64) (*ChangeSet, error)
+	// RegisterNode adds a node to the registry, or updates its information
+	// if already registered.
+	RegisterNode(node NodeInfo) error
+	// Nodes returns all the nodes in the registry.
+	Nodes() ([]NodeInfo, error)
+	// LeaderPreference returns the IDs of the nodes that should lead the
+	// cluster, in order of preference, or nil if never set.
+	LeaderPreference() ([]string, error)
+	// SetLeaderPreference sets the IDs of the nodes that should lead the
+	// cluster, in order of preference.
+	SetLeaderPreference(ids []string) error
+	// Applied returns the index and term of the latest Raft log entry
+	// applied to the store, or 0 if unknown or not replicated.
+	Applied() (uint64, uint64, error)
 }
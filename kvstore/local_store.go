@@ -3,16 +3,31 @@ package kvstore
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"time"
 
 	"github.com/dihedron/brokerd/log"
 	"github.com/dihedron/brokerd/sqlite"
 	"go.uber.org/zap"
 )
 
+var (
+	// ErrNotFound is the error returned when the requested key does not
+	// exist in the store.
+	ErrNotFound error = fmt.Errorf("key not found")
+)
+
 // LocalStore is the non-replicated, local-only SQLite-based implementation
 // of the KVStore interface.
 type LocalStore struct {
-	sqlite.Store
+	*sqlite.Store
+	// HistoryRetention is the number of revisions kept in the history of
+	// each key; if 0, no history is kept. When the store is replicated, that
+	// of the leader applies to all nodes.
+	HistoryRetention int
+	// Feed holds the most recent changes applied to the store.
+	Feed *ChangeFeed
 }
 
 // NewLocalStore creates a new SQLite-based, non-replicated implementation
@@ -23,13 +38,23 @@ func NewLocalStore(options ...sqlite.Option) (*LocalStore, error) {
 		log.L.Error("error allocating base SQLite store", zap.Error(err))
 		return nil, err
 	}
-	return &LocalStore{
-		*store,
-	}, nil
+	s := &LocalStore{
+		Store:            store,
+		HistoryRetention: DefaultHistoryRetention,
+	}
+	index, err := s.index()
+	if err != nil {
+		return nil, err
+	}
+	s.Feed = NewChangeFeed(index)
+	return s, nil
 }
 
-// Get returns the value for the given key.
-func (s *LocalStore) Get(key string) (string, error) {
+// Get returns the value for the given key; since the store is not
+// replicated, all levels of consistency are equivalent.
+func (s *LocalStore) Get(key string, level Consistency) (string, error) {
+	s.RLock()
+	defer s.RUnlock()
 	tx, err := s.DB.BeginTx(context.Background(), &sql.TxOptions{
 		Isolation: sql.LevelDefault,
 		ReadOnly:  true,
@@ -40,9 +65,13 @@ func (s *LocalStore) Get(key string) (string, error) {
 		return "", err
 	}
 	value := ""
-	if err := tx.QueryRow("SELECT value FROM pairs WHERE key=?", key).Scan(&value); err != nil {
-		log.L.Error("error querying row", zap.String("key", key), zap.Error(err))
+	if err := tx.QueryRow("SELECT value FROM pairs WHERE key=? AND (expires_at IS NULL OR expires_at > ?)", key, time.Now().UnixNano()).Scan(&value); err != nil {
 		tx.Rollback()
+		if errors.Is(err, sql.ErrNoRows) {
+			log.L.Debug("key not found", zap.String("key", key))
+			return "", ErrNotFound
+		}
+		log.L.Error("error querying row", zap.String("key", key), zap.Error(err))
 		return "", err
 	}
 	tx.Commit()
@@ -50,43 +79,301 @@ func (s *LocalStore) Get(key string) (string, error) {
 	return value, nil
 }
 
+// Lookup returns the pair for the given key, along with the index of
+// its latest modification.
+func (s *LocalStore) Lookup(key string, level Consistency) (*Pair, error) {
+	s.RLock()
+	defer s.RUnlock()
+	tx, err := s.DB.BeginTx(context.Background(), &sql.TxOptions{
+		Isolation: sql.LevelDefault,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		log.L.Error("error opening read-only transaction", zap.Error(err))
+		return nil, err
+	}
+	defer tx.Rollback()
+	pair, err := (&mutation{tx: tx, timestamp: time.Now()}).lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	if pair == nil {
+		log.L.Debug("key not found", zap.String("key", key))
+		return nil, ErrNotFound
+	}
+	log.L.Debug("returning pair", zap.String("key", key), zap.String("value", pair.Value), zap.Uint64("index", pair.Index))
+	return pair, nil
+}
+
 // Set sets a value under the given key; if existing, it is updated,
 // otherwise a new key/value pair is created.
 func (s *LocalStore) Set(key string, value string) error {
+	_, err := s.mutate(0, time.Now(), func(m *mutation) (interface{}, error) {
+		return nil, m.set(key, value, 0)
+	})
+	return err
+}
+
+// SetWithTTL sets a value under the given key, as Set does; the pair
+// expires once the given time to live has elapsed.
+func (s *LocalStore) SetWithTTL(key string, value string, ttl time.Duration) error {
+	_, err := s.mutate(0, time.Now(), func(m *mutation) (interface{}, error) {
+		return nil, m.set(key, value, ttl)
+	})
+	return err
+}
+
+// Delete removes the key/value pair from the store.
+func (s *LocalStore) Delete(key string) error {
+	_, err := s.mutate(0, time.Now(), func(m *mutation) (interface{}, error) {
+		return nil, m.delete(key)
+	})
+	return err
+}
+
+// Transact applies the transaction operations atomically, provided that
+// all its guards are satisfied; the guards are evaluated and the operations
+// are applied inside a single SQLite transaction, so that no other change
+// can be interleaved. If any guard fails, the store is left untouched and
+// the returned result reports which guards did not hold.
+func (s *LocalStore) Transact(transaction Transaction) (*TransactionResult, error) {
+	result, err := s.mutate(0, time.Now(), func(m *mutation) (interface{}, error) {
+		return m.transact(transaction)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.(*TransactionResult), nil
+}
+
+// DeleteMatching removes all the key/value pairs selected by the given
+// filter in a single transaction, so that either all of them or none is
+// removed; it returns the number of removed pairs.
+func (s *LocalStore) DeleteMatching(filter Filter) (int, error) {
+	count, err := s.mutate(0, time.Now(), func(m *mutation) (interface{}, error) {
+		return m.deleteMatching(filter)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count.(int), nil
+}
+
+// History returns the recorded revisions of the given key, from the
+// most recent to the oldest; the history of a key is available even
+// after the key has been deleted.
+func (s *LocalStore) History(key string) ([]Revision, error) {
+	s.RLock()
+	defer s.RUnlock()
 	tx, err := s.DB.BeginTx(context.Background(), &sql.TxOptions{
 		Isolation: sql.LevelDefault,
-		ReadOnly:  false,
+		ReadOnly:  true,
 	})
 	if err != nil {
-		log.L.Error("error opening transaction", zap.Error(err))
-		return err
+		log.L.Error("error opening read-only transaction", zap.Error(err))
+		return nil, err
 	}
-	_, err = s.DB.Exec("INSERT OR REPLACE INTO pairs (key,value) VALUES (?,?)", key, value)
+	defer tx.Rollback()
+	rows, err := tx.Query("SELECT key, revision, timestamp, operation, value, previous FROM history WHERE key=? ORDER BY revision DESC", key)
 	if err != nil {
-		log.L.Error("error inserting value into database", zap.String("key", key), zap.String("value", value), zap.Error(err))
-		return err
+		log.L.Error("error querying history", zap.String("key", key), zap.Error(err))
+		return nil, err
 	}
-	tx.Commit()
-	log.L.Debug("value stored into database", zap.String("key", key), zap.String("value", value))
-	return nil
+	defer rows.Close()
+	revisions := []Revision{}
+	for rows.Next() {
+		revision, err := scanRevision(rows)
+		if err != nil {
+			log.L.Error("error reading revision", zap.String("key", key), zap.Error(err))
+			return nil, err
+		}
+		revisions = append(revisions, *revision)
+	}
+	if err := rows.Err(); err != nil {
+		log.L.Error("error iterating over rows", zap.Error(err))
+		return nil, err
+	}
+	log.L.Debug("returning history", zap.String("key", key), zap.Int("revisions", len(revisions)))
+	return revisions, nil
 }
 
-// Delete removes the key/value pair from the store.
-func (s *LocalStore) Delete(key string) error {
+// Rollback restores the key to the state recorded in the given revision
+// of its history; the rollback is itself recorded as a new revision,
+// whose index is returned.
+func (s *LocalStore) Rollback(key string, revision uint64) (uint64, error) {
+	index, err := s.mutate(0, time.Now(), func(m *mutation) (interface{}, error) {
+		return m.index, m.rollback(key, revision)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return index.(uint64), nil
+}
+
+// Expire removes all the pairs that have expired; expired pairs are
+// never returned, but they are only removed from the database when
+// this method is called.
+func (s *LocalStore) Expire() (int, error) {
+	count, err := s.mutate(0, time.Now(), func(m *mutation) (interface{}, error) {
+		return m.expire()
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count.(int), nil
+}
+
+// hasExpired checks whether there are any pairs that have expired at
+// the given time and that have not been removed yet.
+func (s *LocalStore) hasExpired(now time.Time) (bool, error) {
+	s.RLock()
+	defer s.RUnlock()
+	var count int
+	if err := s.DB.QueryRow("SELECT COUNT(*) FROM pairs WHERE expires_at <= ?", now.UnixNano()).Scan(&count); err != nil {
+		log.L.Error("error counting expired pairs", zap.Error(err))
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// Changes returns the changes applied to the store after the given index;
+// it returns ErrCompacted if the changes are no longer available.
+func (s *LocalStore) Changes(index uint64) (*ChangeSet, error) {
+	return s.Feed.Since(index)
+}
+
+// index returns the index of the latest change applied to the store, as
+// recorded in the pairs and in their history; the caller must either hold
+// the database lock or be the only one that can replace the database.
+func (s *LocalStore) index() (uint64, error) {
+	return latestIndex(s.DB)
+}
+
+// querier is implemented by both databases and transactions.
+type querier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// latestIndex returns the index of the latest change recorded in the pairs
+// and in their history.
+func latestIndex(q querier) (uint64, error) {
+	var index uint64
+	if err := q.QueryRow(`SELECT MAX(
+		(SELECT COALESCE(MAX(modified_index), 0) FROM pairs),
+		(SELECT COALESCE(MAX(revision), 0) FROM history))`).Scan(&index); err != nil {
+		log.L.Error("error computing latest modification index", zap.Error(err))
+		return 0, err
+	}
+	return index, nil
+}
+
+// mutate runs fn inside a read-write transaction, which is committed only
+// if fn succeeds; the modified pairs are stamped with the given index or,
+// if it is 0, with the index following that of the latest modification
+// in the store, as is the case when the store is not replicated. Once
+// committed, the changes are published to the change feed.
+func (s *LocalStore) mutate(index uint64, timestamp time.Time, fn func(m *mutation) (interface{}, error)) (interface{}, error) {
+	s.RLock()
+	defer s.RUnlock()
 	tx, err := s.DB.BeginTx(context.Background(), &sql.TxOptions{
 		Isolation: sql.LevelDefault,
 		ReadOnly:  false,
 	})
 	if err != nil {
 		log.L.Error("error opening transaction", zap.Error(err))
-		return err
+		return nil, err
+	}
+	defer tx.Rollback()
+	if index == 0 {
+		latest, err := latestIndex(tx)
+		if err != nil {
+			return nil, err
+		}
+		// deletions leave no trace in the database when no history is
+		// kept, but the feed still knows of them
+		if last := s.Feed.latest(); last > latest {
+			latest = last
+		}
+		index = latest + 1
 	}
-	_, err = s.DB.Exec("DELETE FROM pairs where key=?", key)
+	m := &mutation{
+		tx:        tx,
+		index:     index,
+		timestamp: timestamp,
+		retention: s.HistoryRetention,
+	}
+	result, err := fn(m)
 	if err != nil {
-		log.L.Error("error deleting pair", zap.String("key", key), zap.Error(err))
-		return err
+		return nil, err
 	}
-	tx.Commit()
-	log.L.Debug("value deleted from database", zap.String("key", key))
-	return nil
+	if err := tx.Commit(); err != nil {
+		log.L.Error("error committing transaction", zap.Error(err))
+		return nil, err
+	}
+	if len(m.events) > 0 {
+		s.Feed.publish(index, m.events)
+	}
+	return result, nil
+}
+
+// List returns the pairs selected by the filter, in lexical order of
+// their keys, starting after the given cursor (if any); at most limit
+// pairs are returned, unless limit is less than or equal to 0. The
+// returned cursor is the key of the last pair in the page, if there are
+// more pairs to be retrieved, or the empty string.
+func (s *LocalStore) List(filter Filter, cursor string, limit int, level Consistency) ([]Pair, string, error) {
+	s.RLock()
+	defer s.RUnlock()
+	re, err := filter.matcher()
+	if err != nil {
+		log.L.Error("error compiling filter pattern", zap.String("pattern", filter.Pattern), zap.Error(err))
+		return nil, "", err
+	}
+	tx, err := s.DB.BeginTx(context.Background(), &sql.TxOptions{
+		Isolation: sql.LevelDefault,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		log.L.Error("error opening read-only transaction", zap.Error(err))
+		return nil, "", err
+	}
+	defer tx.Rollback()
+
+	where, args := filter.clause(cursor, time.Now())
+	rows, err := tx.Query("SELECT key, value, modified_index, expires_at FROM pairs"+where+" ORDER BY key", args...)
+	if err != nil {
+		log.L.Error("error querying rows", zap.Error(err))
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	pairs := []Pair{}
+	// read one pair more than requested, to know whether there
+	// is a following page
+	for (limit <= 0 || len(pairs) <= limit) && rows.Next() {
+		var pair Pair
+		var expiresAt sql.NullInt64
+		if err := rows.Scan(&pair.Key, &pair.Value, &pair.Index, &expiresAt); err != nil {
+			log.L.Error("error reading row", zap.Error(err))
+			return nil, "", err
+		}
+		if expiresAt.Valid {
+			pair.ExpiresAt = time.Unix(0, expiresAt.Int64).UTC()
+		}
+		if re != nil && !re.MatchString(pair.Key) {
+			continue
+		}
+		pairs = append(pairs, pair)
+	}
+	if err := rows.Err(); err != nil {
+		log.L.Error("error iterating over rows", zap.Error(err))
+		return nil, "", err
+	}
+	next := ""
+	if limit > 0 && len(pairs) > limit {
+		pairs = pairs[:limit]
+		next = pairs[limit-1].Key
+	}
+	log.L.Debug("returning pairs", zap.Int("count", len(pairs)), zap.String("next", next))
+	return pairs, next, nil
 }
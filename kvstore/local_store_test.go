@@ -0,0 +1,223 @@
+package kvstore
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dihedron/brokerd/sqlite"
+)
+
+// newTestStore creates a LocalStore in a temporary directory, which is
+// removed along with the store at the end of the test.
+func newTestStore(t *testing.T) *LocalStore {
+	t.Helper()
+	store, err := NewLocalStore(sqlite.WithStoreDirectory(t.TempDir()))
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// keys returns the keys of the given pairs.
+func keys(pairs []Pair) []string {
+	result := []string{}
+	for _, pair := range pairs {
+		result = append(result, pair.Key)
+	}
+	return result
+}
+
+// Test_List tests that the filters select the expected keys, in order.
+func Test_List(t *testing.T) {
+	store := newTestStore(t)
+	for _, key := range []string{"b.x", "a", "a.c", "ab", "a.b", "c", "b"} {
+		if err := store.Set(key, "value of "+key); err != nil {
+			t.Fatalf("failed to set key %s: %v", key, err)
+		}
+	}
+	if err := store.SetWithTTL("a.expired", "value", time.Millisecond); err != nil {
+		t.Fatalf("failed to set key with TTL: %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	tests := []struct {
+		name     string
+		filter   Filter
+		expected []string
+	}{
+		{"no filter", Filter{}, []string{"a", "a.b", "a.c", "ab", "b", "b.x", "c"}},
+		{"prefix", Filter{Prefix: "a."}, []string{"a.b", "a.c"}},
+		{"range", Filter{Start: "a.c", End: "b.x"}, []string{"a.c", "ab", "b"}},
+		{"open range", Filter{Start: "b"}, []string{"b", "b.x", "c"}},
+		{"pattern", Filter{Pattern: `^[a-z]$`}, []string{"a", "b", "c"}},
+		{"prefix and pattern", Filter{Prefix: "a", Pattern: `b`}, []string{"a.b", "ab"}},
+		{"prefix and range", Filter{Prefix: "a", End: "a.c"}, []string{"a", "a.b"}},
+		{"no match", Filter{Prefix: "d"}, []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pairs, next, err := store.List(test.filter, "", 0, ConsistencyDefault)
+			if err != nil {
+				t.Fatalf("failed to list pairs: %v", err)
+			}
+			if next != "" {
+				t.Fatalf("unexpected cursor %q with no limit", next)
+			}
+			if actual := keys(pairs); !reflect.DeepEqual(actual, test.expected) {
+				t.Fatalf("wrong keys listed: %v (expected %v)", actual, test.expected)
+			}
+		})
+	}
+}
+
+// Test_ListPages tests that paging through the keys with a cursor returns
+// each of them exactly once.
+func Test_ListPages(t *testing.T) {
+	store := newTestStore(t)
+	for _, key := range []string{"k1", "k2", "k3", "k4", "k5"} {
+		if err := store.Set(key, "value"); err != nil {
+			t.Fatalf("failed to set key %s: %v", key, err)
+		}
+	}
+	tests := []struct {
+		name     string
+		limit    int
+		expected [][]string
+	}{
+		{"exact pages", 5, [][]string{{"k1", "k2", "k3", "k4", "k5"}}},
+		{"partial last page", 2, [][]string{{"k1", "k2"}, {"k3", "k4"}, {"k5"}}},
+		{"single pairs", 1, [][]string{{"k1"}, {"k2"}, {"k3"}, {"k4"}, {"k5"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pages := [][]string{}
+			cursor := ""
+			for {
+				pairs, next, err := store.List(Filter{}, cursor, test.limit, ConsistencyDefault)
+				if err != nil {
+					t.Fatalf("failed to list pairs: %v", err)
+				}
+				pages = append(pages, keys(pairs))
+				if next == "" {
+					break
+				}
+				cursor = next
+			}
+			if !reflect.DeepEqual(pages, test.expected) {
+				t.Fatalf("wrong pages: %v (expected %v)", pages, test.expected)
+			}
+		})
+	}
+}
+
+// Test_ListInvalidPattern tests that a pattern that does not compile is
+// reported as an invalid filter.
+func Test_ListInvalidPattern(t *testing.T) {
+	store := newTestStore(t)
+	if _, _, err := store.List(Filter{Pattern: "("}, "", 0, ConsistencyDefault); !errors.Is(err, ErrInvalidFilter) {
+		t.Fatalf("wrong error for invalid pattern: %v (expected %v)", err, ErrInvalidFilter)
+	}
+}
+
+// Test_MutateIndex tests that each change to a store that is not
+// replicated gets an index never used before, even after the latest
+// modified pairs have been deleted, so that entity tags are not reused.
+func Test_MutateIndex(t *testing.T) {
+	tests := []struct {
+		name      string
+		retention int
+	}{
+		{"with history", DefaultHistoryRetention},
+		{"without history", 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := newTestStore(t)
+			store.HistoryRetention = test.retention
+			seen := map[uint64]string{}
+			check := func(key string) {
+				pair, err := store.Lookup(key, ConsistencyDefault)
+				if err != nil {
+					t.Fatalf("failed to look up key %s: %v", key, err)
+				}
+				if previous, ok := seen[pair.Index]; ok {
+					t.Fatalf("index %d of key %s already used for key %s", pair.Index, key, previous)
+				}
+				seen[pair.Index] = key
+			}
+			store.Set("a", "1")
+			check("a")
+			store.Set("b", "1")
+			check("b")
+			store.Delete("b")
+			store.Set("c", "1")
+			check("c")
+			if _, err := store.DeleteMatching(Filter{Prefix: "c"}); err != nil {
+				t.Fatalf("failed to delete keys: %v", err)
+			}
+			store.Set("d", "1")
+			check("d")
+		})
+	}
+}
+
+// Test_DeleteMatching tests that the pairs selected by the filter are all
+// deleted, and recorded as such in their history, and that no pair is
+// deleted if the filter is invalid.
+func Test_DeleteMatching(t *testing.T) {
+	tests := []struct {
+		name     string
+		filter   Filter
+		count    int
+		expected []string
+		err      error
+	}{
+		{"no filter", Filter{}, 6, []string{}, nil},
+		{"prefix", Filter{Prefix: "a."}, 2, []string{"a", "ab", "b", "b.x"}, nil},
+		{"range", Filter{Start: "a.c", End: "b.x"}, 3, []string{"a", "a.b", "b.x"}, nil},
+		{"pattern", Filter{Pattern: `^[a-z]$`}, 2, []string{"a.b", "a.c", "ab", "b.x"}, nil},
+		{"prefix and pattern", Filter{Prefix: "a", Pattern: `b`}, 2, []string{"a", "a.c", "b", "b.x"}, nil},
+		{"no match", Filter{Prefix: "d"}, 0, []string{"a", "a.b", "a.c", "ab", "b", "b.x"}, nil},
+		{"invalid pattern", Filter{Prefix: "a", Pattern: "("}, 0, []string{"a", "a.b", "a.c", "ab", "b", "b.x"}, ErrInvalidFilter},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := newTestStore(t)
+			for _, key := range []string{"a", "a.b", "a.c", "ab", "b", "b.x"} {
+				if err := store.Set(key, "value of "+key); err != nil {
+					t.Fatalf("failed to set key %s: %v", key, err)
+				}
+			}
+			count, err := store.DeleteMatching(test.filter)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("wrong error: %v (expected %v)", err, test.err)
+			}
+			if count != test.count {
+				t.Fatalf("wrong count: %d (expected %d)", count, test.count)
+			}
+			pairs, _, err := store.List(Filter{}, "", 0, ConsistencyDefault)
+			if err != nil {
+				t.Fatalf("failed to list pairs: %v", err)
+			}
+			if actual := keys(pairs); !reflect.DeepEqual(actual, test.expected) {
+				t.Fatalf("wrong keys left: %v (expected %v)", actual, test.expected)
+			}
+			deleted := 0
+			for _, key := range []string{"a", "a.b", "a.c", "ab", "b", "b.x"} {
+				history, err := store.History(key)
+				if err != nil {
+					t.Fatalf("failed to read history of %s: %v", key, err)
+				}
+				if history[0].Operation == opDelete {
+					deleted++
+				}
+			}
+			if deleted != test.count {
+				t.Fatalf("wrong deletions in history: %d (expected %d)", deleted, test.count)
+			}
+		})
+	}
+}
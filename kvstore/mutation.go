@@ -0,0 +1,213 @@
+package kvstore
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/dihedron/brokerd/log"
+	"go.uber.org/zap"
+)
+
+// mutation is the context in which a change to the store is applied:
+// all reads and writes happen inside the same SQLite transaction, and
+// all modified pairs are stamped with the same modification index, which
+// is the index of the Raft log entry being applied when the store is
+// replicated, and recorded in the history with the same timestamp; the
+// changes are collected as events, to be published once the mutation is
+// committed.
+type mutation struct {
+	tx        *sql.Tx
+	index     uint64
+	timestamp time.Time
+	retention int
+	events    []Event
+}
+
+// lookup reads the pair with the given key; it returns nil if the key
+// does not exist or has expired at the time of the mutation.
+func (m *mutation) lookup(key string) (*Pair, error) {
+	pair := &Pair{Key: key}
+	var expiresAt sql.NullInt64
+	row := m.tx.QueryRow("SELECT value, modified_index, expires_at FROM pairs WHERE key=? AND (expires_at IS NULL OR expires_at > ?)", key, m.timestamp.UnixNano())
+	if err := row.Scan(&pair.Value, &pair.Index, &expiresAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		log.L.Error("error querying row", zap.String("key", key), zap.Error(err))
+		return nil, err
+	}
+	if expiresAt.Valid {
+		pair.ExpiresAt = time.Unix(0, expiresAt.Int64).UTC()
+	}
+	return pair, nil
+}
+
+// set sets the value of the given key; if ttl is greater than 0, the
+// pair expires once ttl has elapsed since the time of the mutation,
+// otherwise it never expires.
+func (m *mutation) set(key string, value string, ttl time.Duration) error {
+	previous, err := m.lookup(key)
+	if err != nil {
+		return err
+	}
+	if err := m.record(key, opSet, &value, previous); err != nil {
+		return err
+	}
+	var expiresAt sql.NullInt64
+	if ttl > 0 {
+		expiresAt = sql.NullInt64{Int64: m.timestamp.Add(ttl).UnixNano(), Valid: true}
+	}
+	if _, err := m.tx.Exec("INSERT OR REPLACE INTO pairs (key,value,modified_index,expires_at) VALUES (?,?,?,?)", key, value, m.index, expiresAt); err != nil {
+		log.L.Error("error inserting value into database", zap.String("key", key), zap.String("value", value), zap.Error(err))
+		return err
+	}
+	log.L.Debug("value stored into database", zap.String("key", key), zap.String("value", value), zap.Uint64("index", m.index))
+	return nil
+}
+
+// delete removes the given key.
+func (m *mutation) delete(key string) error {
+	previous, err := m.lookup(key)
+	if err != nil {
+		return err
+	}
+	if previous == nil {
+		log.L.Debug("no value to delete", zap.String("key", key))
+		return nil
+	}
+	if err := m.record(key, opDelete, nil, previous); err != nil {
+		return err
+	}
+	if _, err := m.tx.Exec("DELETE FROM pairs where key=?", key); err != nil {
+		log.L.Error("error deleting pair", zap.String("key", key), zap.Error(err))
+		return err
+	}
+	log.L.Debug("value deleted from database", zap.String("key", key))
+	return nil
+}
+
+// deleteMatching removes all the pairs selected by the given filter; it
+// returns the number of removed pairs.
+func (m *mutation) deleteMatching(filter Filter) (int, error) {
+	re, err := filter.matcher()
+	if err != nil {
+		log.L.Error("error compiling filter pattern", zap.String("pattern", filter.Pattern), zap.Error(err))
+		return 0, err
+	}
+	where, args := filter.clause("", m.timestamp)
+
+	// collect the keys matching the filter first, then delete them
+	// one by one inside the same transaction, so that each deletion
+	// is recorded in the history
+	keys := []string{}
+	rows, err := m.tx.Query("SELECT key FROM pairs"+where, args...)
+	if err != nil {
+		log.L.Error("error querying rows", zap.Error(err))
+		return 0, err
+	}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			log.L.Error("error reading row", zap.Error(err))
+			rows.Close()
+			return 0, err
+		}
+		if re == nil || re.MatchString(key) {
+			keys = append(keys, key)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		log.L.Error("error iterating over rows", zap.Error(err))
+		return 0, err
+	}
+	for _, key := range keys {
+		if err := m.delete(key); err != nil {
+			return 0, err
+		}
+	}
+	log.L.Debug("pairs deleted from database", zap.Int("count", len(keys)))
+	return len(keys), nil
+}
+
+// transact evaluates all the transaction guards and, if they all hold,
+// applies its operations; otherwise nothing is modified and the result
+// reports which guards did not hold.
+func (m *mutation) transact(transaction Transaction) (*TransactionResult, error) {
+	if err := transaction.validate(); err != nil {
+		log.L.Error("invalid transaction", zap.Error(err))
+		return nil, err
+	}
+	result := &TransactionResult{
+		Committed: true,
+		Guards:    make([]GuardResult, 0, len(transaction.Guards)),
+	}
+	for _, guard := range transaction.Guards {
+		pair, err := m.lookup(guard.Key)
+		if err != nil {
+			return nil, err
+		}
+		passed := guard.holds(pair)
+		result.Guards = append(result.Guards, GuardResult{
+			Guard:  guard,
+			Passed: passed,
+		})
+		result.Committed = result.Committed && passed
+	}
+	if !result.Committed {
+		log.L.Debug("transaction rejected by guards")
+		return result, nil
+	}
+	for _, operation := range transaction.Operations {
+		var err error
+		switch operation.Type {
+		case Set:
+			err = m.set(operation.Key, operation.Value, operation.TTL)
+		case Delete:
+			err = m.delete(operation.Key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	result.Index = m.index
+	log.L.Debug("transaction committed", zap.Int("operations", len(transaction.Operations)), zap.Uint64("index", m.index))
+	return result, nil
+}
+
+// expire removes all the pairs that have expired at the time of the
+// mutation; it returns the number of removed pairs.
+func (m *mutation) expire() (int, error) {
+	expired := []Pair{}
+	rows, err := m.tx.Query("SELECT key, value, modified_index FROM pairs WHERE expires_at <= ?", m.timestamp.UnixNano())
+	if err != nil {
+		log.L.Error("error querying expired rows", zap.Error(err))
+		return 0, err
+	}
+	for rows.Next() {
+		var pair Pair
+		if err := rows.Scan(&pair.Key, &pair.Value, &pair.Index); err != nil {
+			log.L.Error("error reading row", zap.Error(err))
+			rows.Close()
+			return 0, err
+		}
+		expired = append(expired, pair)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		log.L.Error("error iterating over rows", zap.Error(err))
+		return 0, err
+	}
+	for i := range expired {
+		if err := m.record(expired[i].Key, opDelete, nil, &expired[i]); err != nil {
+			return 0, err
+		}
+		if _, err := m.tx.Exec("DELETE FROM pairs where key=?", expired[i].Key); err != nil {
+			log.L.Error("error deleting expired pair", zap.String("key", expired[i].Key), zap.Error(err))
+			return 0, err
+		}
+		log.L.Debug("expired value deleted from database", zap.String("key", expired[i].Key))
+	}
+	return len(expired), nil
+}
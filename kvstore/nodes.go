@@ -0,0 +1,171 @@
+package kvstore
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dihedron/brokerd/log"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrNodeNotFound is the error returned when the requested node is
+	// not in the registry.
+	ErrNodeNotFound error = fmt.Errorf("node not found")
+	// ErrInvalidNode is the error returned when the information about a
+	// node is not valid, e.g. because it has no ID.
+	ErrInvalidNode error = fmt.Errorf("invalid node")
+)
+
+// NodeInfo is the information about a node in the cluster, as recorded
+// in the node registry.
+type NodeInfo struct {
+	// ID is the unique ID of the node in the Raft cluster.
+	ID string `json:"id"`
+	// RaftAddress is the address of the Raft transport of the node.
+	RaftAddress string `json:"raft_address"`
+	// HTTPAddress is the address the HTTP API of the node is served on.
+	HTTPAddress string `json:"http_address,omitempty"`
+	// GRPCAddress is the address the gRPC API of the node is served on.
+	GRPCAddress string `json:"grpc_address,omitempty"`
+	// Tags are arbitrary labels attached to the node (e.g. its zone).
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// URL returns the base URL of the HTTP API of the node, or the empty
+// string if it is not known.
+func (n *NodeInfo) URL() string {
+	if n == nil || n.HTTPAddress == "" {
+		return ""
+	}
+	return "http://" + n.HTTPAddress
+}
+
+// validate checks that the node has at least an ID and a Raft address.
+func (n NodeInfo) validate() error {
+	if n.ID == "" {
+		return fmt.Errorf("%w: node with no ID", ErrInvalidNode)
+	}
+	if n.RaftAddress == "" {
+		return fmt.Errorf("%w: node with no Raft address", ErrInvalidNode)
+	}
+	return nil
+}
+
+// NotLeaderError is the error returned when an operation that is only
+// permitted on the leader is attempted on a follower; it carries the URL
+// of the HTTP API of the leader, if known, so that clients can retry the
+// operation there.
+type NotLeaderError struct {
+	// Leader is the URL of the HTTP API of the current leader, or the empty
+	// string if there is no leader or its API address is not known.
+	Leader string
+}
+
+// Error returns the error message.
+func (e *NotLeaderError) Error() string {
+	if e.Leader == "" {
+		return ErrNotLeader.Error()
+	}
+	return fmt.Sprintf("%s, leader is at %s", ErrNotLeader.Error(), e.Leader)
+}
+
+// Is makes NotLeaderError match ErrNotLeader in errors.Is.
+func (e *NotLeaderError) Is(target error) bool {
+	return target == ErrNotLeader
+}
+
+// register adds the node to the registry, or updates it if already
+// registered.
+func (m *mutation) register(node NodeInfo) error {
+	tags, err := json.Marshal(node.Tags)
+	if err != nil {
+		log.L.Error("error marshalling node tags", zap.String("id", node.ID), zap.Error(err))
+		return err
+	}
+	_, err = m.tx.Exec(`INSERT INTO nodes (id, raft_address, http_address, grpc_address, tags) VALUES (?,?,?,?,?)
+		ON CONFLICT(id) DO UPDATE SET raft_address=excluded.raft_address, http_address=excluded.http_address,
+		grpc_address=excluded.grpc_address, tags=excluded.tags`,
+		node.ID, node.RaftAddress, node.HTTPAddress, node.GRPCAddress, string(tags))
+	if err != nil {
+		log.L.Error("error registering node", zap.String("id", node.ID), zap.Error(err))
+		return err
+	}
+	log.L.Debug("node registered", zap.String("id", node.ID), zap.String("raft address", node.RaftAddress), zap.String("http address", node.HTTPAddress))
+	return nil
+}
+
+// Nodes returns all the nodes in the registry, in order of their IDs.
+func (s *LocalStore) Nodes() ([]NodeInfo, error) {
+	s.RLock()
+	defer s.RUnlock()
+	rows, err := s.DB.Query("SELECT id, raft_address, http_address, grpc_address, tags FROM nodes ORDER BY id")
+	if err != nil {
+		log.L.Error("error querying node registry", zap.Error(err))
+		return nil, err
+	}
+	defer rows.Close()
+	nodes := []NodeInfo{}
+	for rows.Next() {
+		node, err := scanNode(rows)
+		if err != nil {
+			log.L.Error("error reading node", zap.Error(err))
+			return nil, err
+		}
+		nodes = append(nodes, *node)
+	}
+	if err := rows.Err(); err != nil {
+		log.L.Error("error iterating over rows", zap.Error(err))
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// NodeByRaftAddress returns the node in the registry with the given Raft
+// address.
+func (s *LocalStore) NodeByRaftAddress(address string) (*NodeInfo, error) {
+	s.RLock()
+	defer s.RUnlock()
+	row := s.DB.QueryRow("SELECT id, raft_address, http_address, grpc_address, tags FROM nodes WHERE raft_address=?", address)
+	node, err := scanNode(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		log.L.Debug("node not found", zap.String("raft address", address))
+		return nil, ErrNodeNotFound
+	} else if err != nil {
+		log.L.Error("error reading node", zap.String("raft address", address), zap.Error(err))
+		return nil, err
+	}
+	return node, nil
+}
+
+// RegisterNode adds the node to the registry, or updates it if already
+// registered.
+func (s *LocalStore) RegisterNode(node NodeInfo) error {
+	if err := node.validate(); err != nil {
+		return err
+	}
+	_, err := s.mutate(0, time.Now(), func(m *mutation) (interface{}, error) {
+		return nil, m.register(node)
+	})
+	return err
+}
+
+// scanNode reads a node from a row of the nodes table.
+func scanNode(row scanner) (*NodeInfo, error) {
+	node := &NodeInfo{}
+	var http, grpc, tags sql.NullString
+	if err := row.Scan(&node.ID, &node.RaftAddress, &http, &grpc, &tags); err != nil {
+		return nil, err
+	}
+	node.HTTPAddress = http.String
+	node.GRPCAddress = grpc.String
+	if tags.Valid && tags.String != "" {
+		if err := json.Unmarshal([]byte(tags.String), &node.Tags); err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
+}
@@ -0,0 +1,150 @@
+package kvstore
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// Test_RegisterNode tests that nodes are added to the registry, updated
+// when registered again, and rejected if invalid.
+func Test_RegisterNode(t *testing.T) {
+	tests := []struct {
+		name     string
+		nodes    []NodeInfo
+		expected []NodeInfo
+		err      error
+	}{
+		{
+			name: "new nodes",
+			nodes: []NodeInfo{
+				{ID: "b", RaftAddress: "b:7000", HTTPAddress: "b:8080"},
+				{ID: "a", RaftAddress: "a:7000", Tags: map[string]string{"zone": "1"}},
+			},
+			expected: []NodeInfo{
+				{ID: "a", RaftAddress: "a:7000", Tags: map[string]string{"zone": "1"}},
+				{ID: "b", RaftAddress: "b:7000", HTTPAddress: "b:8080"},
+			},
+		},
+		{
+			name: "updated node",
+			nodes: []NodeInfo{
+				{ID: "a", RaftAddress: "a:7000", HTTPAddress: "a:8080", Tags: map[string]string{"zone": "1"}},
+				{ID: "a", RaftAddress: "a:7001", GRPCAddress: "a:9090"},
+			},
+			expected: []NodeInfo{
+				{ID: "a", RaftAddress: "a:7001", GRPCAddress: "a:9090"},
+			},
+		},
+		{
+			name:     "no ID",
+			nodes:    []NodeInfo{{RaftAddress: "a:7000"}},
+			expected: []NodeInfo{},
+			err:      ErrInvalidNode,
+		},
+		{
+			name:     "no Raft address",
+			nodes:    []NodeInfo{{ID: "a", HTTPAddress: "a:8080"}},
+			expected: []NodeInfo{},
+			err:      ErrInvalidNode,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := newTestStore(t)
+			var err error
+			for _, node := range test.nodes {
+				if err = store.RegisterNode(node); err != nil {
+					break
+				}
+			}
+			if !errors.Is(err, test.err) {
+				t.Fatalf("wrong error: %v (expected %v)", err, test.err)
+			}
+			nodes, err := store.Nodes()
+			if err != nil {
+				t.Fatalf("failed to read nodes: %v", err)
+			}
+			if !reflect.DeepEqual(nodes, test.expected) {
+				t.Fatalf("wrong nodes: %+v (expected %+v)", nodes, test.expected)
+			}
+		})
+	}
+}
+
+// Test_NodeByRaftAddress tests that nodes are looked up by their current
+// Raft address.
+func Test_NodeByRaftAddress(t *testing.T) {
+	store := newTestStore(t)
+	for _, node := range []NodeInfo{
+		{ID: "a", RaftAddress: "a:7000", HTTPAddress: "a:8080"},
+		{ID: "b", RaftAddress: "b:7000", HTTPAddress: "b:8080"},
+		{ID: "b", RaftAddress: "b:7001", HTTPAddress: "b:8081"},
+	} {
+		if err := store.RegisterNode(node); err != nil {
+			t.Fatalf("failed to register node: %v", err)
+		}
+	}
+	tests := []struct {
+		address  string
+		expected *NodeInfo
+		err      error
+	}{
+		{"a:7000", &NodeInfo{ID: "a", RaftAddress: "a:7000", HTTPAddress: "a:8080"}, nil},
+		{"b:7001", &NodeInfo{ID: "b", RaftAddress: "b:7001", HTTPAddress: "b:8081"}, nil},
+		{"b:7000", nil, ErrNodeNotFound},
+		{"c:7000", nil, ErrNodeNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.address, func(t *testing.T) {
+			node, err := store.NodeByRaftAddress(test.address)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("wrong error: %v (expected %v)", err, test.err)
+			}
+			if !reflect.DeepEqual(node, test.expected) {
+				t.Fatalf("wrong node: %+v (expected %+v)", node, test.expected)
+			}
+		})
+	}
+}
+
+// Test_NotLeaderError tests that the error returned by followers carries
+// the URL of the leader, as found in the registry, and matches ErrNotLeader.
+func Test_NotLeaderError(t *testing.T) {
+	stores := newTestCluster(t, 2, false)
+	err := stores[1].Set("a", "1")
+	var notLeader *NotLeaderError
+	if !errors.As(err, &notLeader) || !errors.Is(err, ErrNotLeader) {
+		t.Fatalf("wrong error: %v (expected %v)", err, ErrNotLeader)
+	}
+	if notLeader.Leader != "http://node0:8080" {
+		t.Fatalf("wrong leader: %q (expected %q)", notLeader.Leader, "http://node0:8080")
+	}
+	if message := err.Error(); message != ErrNotLeader.Error()+", leader is at http://node0:8080" {
+		t.Fatalf("wrong message: %q", message)
+	}
+
+	// the leader moves its API, and the followers learn it from the registry
+	if err := stores[0].RegisterNode(NodeInfo{ID: "node0", RaftAddress: "node0", HTTPAddress: "node0:8081"}); err != nil {
+		t.Fatalf("failed to register node: %v", err)
+	}
+	waitFor(t, func() bool {
+		node, err := stores[1].store.NodeByRaftAddress("node0")
+		return err == nil && node.HTTPAddress == "node0:8081"
+	})
+	if err := stores[1].Set("a", "1"); !errors.As(err, &notLeader) || notLeader.Leader != "http://node0:8081" {
+		t.Fatalf("wrong error after update: %v (expected leader at %q)", err, "http://node0:8081")
+	}
+
+	// without an HTTP address, the leader is not known
+	if err := stores[0].RegisterNode(NodeInfo{ID: "node0", RaftAddress: "node0"}); err != nil {
+		t.Fatalf("failed to register node: %v", err)
+	}
+	waitFor(t, func() bool {
+		node, err := stores[1].store.NodeByRaftAddress("node0")
+		return err == nil && node.HTTPAddress == ""
+	})
+	if err := stores[1].Set("a", "1"); !errors.As(err, &notLeader) || notLeader.Leader != "" || err.Error() != ErrNotLeader.Error() {
+		t.Fatalf("wrong error without leader address: %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+package kvstore
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dihedron/brokerd/log"
+	"go.uber.org/zap"
+)
+
+// leaderPreferenceSetting is the name of the setting holding the leader
+// preference list.
+const leaderPreferenceSetting = "leader_preference"
+
+var (
+	// ErrInvalidPreference is the error returned when a leader preference
+	// list is not valid, e.g. because it contains an empty or duplicate ID.
+	ErrInvalidPreference error = fmt.Errorf("invalid leader preference")
+)
+
+// validatePreference checks that the leader preference list contains
+// no empty or duplicate node IDs.
+func validatePreference(ids []string) error {
+	seen := map[string]bool{}
+	for _, id := range ids {
+		if id == "" {
+			return fmt.Errorf("%w: empty node ID", ErrInvalidPreference)
+		}
+		if seen[id] {
+			return fmt.Errorf("%w: duplicate node ID %s", ErrInvalidPreference, id)
+		}
+		seen[id] = true
+	}
+	return nil
+}
+
+// setSetting stores the value of a cluster-wide setting.
+func (m *mutation) setSetting(name string, value string) error {
+	_, err := m.tx.Exec("INSERT INTO settings (name, value) VALUES (?,?) ON CONFLICT(name) DO UPDATE SET value=excluded.value", name, value)
+	if err != nil {
+		log.L.Error("error storing setting", zap.String("name", name), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// setNodeList stores a cluster-wide setting holding a list of node IDs.
+func (m *mutation) setNodeList(name string, ids []string) error {
+	if ids == nil {
+		ids = []string{}
+	}
+	value, err := json.Marshal(ids)
+	if err != nil {
+		log.L.Error("error marshalling node list", zap.String("name", name), zap.Error(err))
+		return err
+	}
+	return m.setSetting(name, string(value))
+}
+
+// setLeaderPreference stores the leader preference list.
+func (m *mutation) setLeaderPreference(ids []string) error {
+	if err := m.setNodeList(leaderPreferenceSetting, ids); err != nil {
+		return err
+	}
+	log.L.Debug("leader preference set", zap.Strings("nodes", ids))
+	return nil
+}
+
+// nodeList reads a cluster-wide setting holding a list of node IDs; it
+// returns nil if the setting has never been set.
+func (s *LocalStore) nodeList(name string) ([]string, error) {
+	s.RLock()
+	defer s.RUnlock()
+	var value string
+	err := s.DB.QueryRow("SELECT value FROM settings WHERE name=?", name).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		log.L.Error("error reading node list", zap.String("name", name), zap.Error(err))
+		return nil, err
+	}
+	ids := []string{}
+	if err := json.Unmarshal([]byte(value), &ids); err != nil {
+		log.L.Error("error parsing node list", zap.String("name", name), zap.Error(err))
+		return nil, err
+	}
+	return ids, nil
+}
+
+// LeaderPreference returns the IDs of the nodes that should lead the
+// cluster, in order of preference; it returns nil if the preference has
+// never been set.
+func (s *LocalStore) LeaderPreference() ([]string, error) {
+	return s.nodeList(leaderPreferenceSetting)
+}
+
+// SetLeaderPreference sets the IDs of the nodes that should lead the
+// cluster, in order of preference.
+func (s *LocalStore) SetLeaderPreference(ids []string) error {
+	if err := validatePreference(ids); err != nil {
+		return err
+	}
+	_, err := s.mutate(0, time.Now(), func(m *mutation) (interface{}, error) {
+		return nil, m.setLeaderPreference(ids)
+	})
+	return err
+}
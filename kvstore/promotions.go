@@ -0,0 +1,41 @@
+package kvstore
+
+import (
+	"time"
+
+	"github.com/dihedron/brokerd/log"
+	"go.uber.org/zap"
+)
+
+// pendingPromotionsSetting is the name of the setting holding the IDs of
+// the non-voters waiting to be promoted by the autopilot.
+const pendingPromotionsSetting = "pending_promotions"
+
+// setPendingPromotions stores the IDs of the non-voters waiting to be
+// promoted.
+func (m *mutation) setPendingPromotions(ids []string) error {
+	if err := m.setNodeList(pendingPromotionsSetting, ids); err != nil {
+		return err
+	}
+	log.L.Debug("pending promotions set", zap.Strings("nodes", ids))
+	return nil
+}
+
+// PendingPromotions returns the IDs of the non-voters that joined the
+// cluster and are waiting to be promoted to voters.
+func (s *LocalStore) PendingPromotions() ([]string, error) {
+	ids, err := s.nodeList(pendingPromotionsSetting)
+	if ids == nil && err == nil {
+		ids = []string{}
+	}
+	return ids, err
+}
+
+// SetPendingPromotions sets the IDs of the non-voters waiting to be
+// promoted to voters.
+func (s *LocalStore) SetPendingPromotions(ids []string) error {
+	_, err := s.mutate(0, time.Now(), func(m *mutation) (interface{}, error) {
+		return nil, m.setPendingPromotions(ids)
+	})
+	return err
+}
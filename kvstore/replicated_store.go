@@ -3,6 +3,7 @@ package kvstore
 import (
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/dihedron/brokerd/cluster"
 	"github.com/dihedron/brokerd/log"
@@ -23,6 +24,7 @@ type ReplicatedStore struct {
 	store              *LocalStore
 	cluster            *cluster.Cluster
 	allowGetOnFollower bool
+	stop               chan struct{}
 }
 
 // NewReplicatedStore allocates a new ReplicatedStore which will
@@ -35,63 +37,399 @@ func NewReplicatedStore(allowGetOnFollower bool, store *LocalStore, cluster *clu
 		store:              store,
 		cluster:            cluster,
 		allowGetOnFollower: allowGetOnFollower,
+		stop:               make(chan struct{}),
 	}
 }
 
 // Get retrieves the value corresponding to the given key; since the
 // Get command is non-mutating, it needs not go through the Apply()
-// rigmarole; it can be served directly from the LocalStore; if the
-// cluster allows it, the values can be served by the followers, which
-// can speed things up but there is a non-null probability that the
-// follower will serve stale data, when the log has not been
-// acknowledged yet, ot it has been acknowledged but not applied yet
-// to the local store.
-func (s *ReplicatedStore) Get(key string) (string, error) {
-	if s.cluster.Raft.State() == raft.Leader || s.allowGetOnFollower {
-		log.L.Debug("returning local value")
-		return s.store.Get(key)
+// rigmarole; it can be served directly from the LocalStore, once the
+// requested level of consistency has been ensured. If the cluster allows
+// it, by default values can be served by the followers, which can speed
+// things up but there is a non-null probability that the follower will
+// serve stale data, when the log has not been acknowledged yet, ot it has
+// been acknowledged but not applied yet to the local store.
+func (s *ReplicatedStore) Get(key string, level Consistency) (string, error) {
+	if err := s.ensure(level); err != nil {
+		return "", err
 	}
-	log.L.Error("invalid state", zap.Bool("leader", s.cluster.Raft.State() == raft.Leader), zap.Bool("allowed on follower", s.allowGetOnFollower), zap.Error(ErrNotLeader))
-	return "", ErrNotLeader
+	log.L.Debug("returning local value")
+	return s.store.Get(key, level)
+}
+
+// Lookup retrieves the pair corresponding to the given key, along with
+// the index of its latest modification; like Get, it is served by the
+// LocalStore.
+func (s *ReplicatedStore) Lookup(key string, level Consistency) (*Pair, error) {
+	if err := s.ensure(level); err != nil {
+		return nil, err
+	}
+	log.L.Debug("returning local pair")
+	return s.store.Lookup(key, level)
+}
+
+// History returns the recorded revisions of the given key; like Get,
+// it is served by the LocalStore, with the default consistency.
+func (s *ReplicatedStore) History(key string) ([]Revision, error) {
+	if err := s.ensure(ConsistencyDefault); err != nil {
+		return nil, err
+	}
+	log.L.Debug("returning local history")
+	return s.store.History(key)
+}
+
+// List returns a page of the pairs selected by the given filter, in
+// lexical order of their keys; as with Get, it is served by the
+// LocalStore and may return stale data unless strong consistency is
+// requested.
+func (s *ReplicatedStore) List(filter Filter, cursor string, limit int, level Consistency) ([]Pair, string, error) {
+	if err := s.ensure(level); err != nil {
+		return nil, "", err
+	}
+	log.L.Debug("returning local values")
+	return s.store.List(filter, cursor, limit, level)
+}
+
+// ensure checks that the local store can be read with the given level of
+// consistency; for strong consistency, it confirms the leadership with a
+// quorum of the cluster, then waits for all the committed log entries to
+// be applied to the local store.
+func (s *ReplicatedStore) ensure(level Consistency) error {
+	if level == ConsistencyDefault {
+		level = ConsistencyWeak
+		if s.allowGetOnFollower {
+			level = ConsistencyNone
+		}
+	}
+	switch level {
+	case ConsistencyNone:
+		return nil
+	case ConsistencyWeak:
+		if s.cluster.Raft.State() != raft.Leader {
+			log.L.Error("read operation not on Raft cluster leader", zap.Error(ErrNotLeader))
+			return s.notLeader()
+		}
+		return nil
+	case ConsistencyStrong:
+		if err := s.cluster.Raft.VerifyLeader().Error(); err != nil {
+			log.L.Error("leadership could not be verified", zap.Error(err))
+			return s.notLeader()
+		}
+		timeout := s.cluster.RaftTimeout
+		if timeout == 0 {
+			timeout = cluster.DefaultRaftTimeout
+		}
+		if err := s.cluster.Raft.Barrier(timeout).Error(); err != nil {
+			log.L.Error("error waiting for log entries to be applied", zap.Error(err))
+			if err == raft.ErrNotLeader || err == raft.ErrLeadershipLost {
+				return s.notLeader()
+			}
+			return err
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: %d", ErrInvalidConsistency, level)
 }
 
 // Set sets the value for the given key.
 func (s *ReplicatedStore) Set(key, value string) error {
 	if s.cluster.Raft.State() != raft.Leader {
 		log.L.Error("mutating (set) operation not on Raft cluster leader", zap.Error(ErrNotLeader))
-		return ErrNotLeader
+		return s.notLeader()
 	}
-	// marshal command and send it over to the FSM via Raft
-	b, err := json.Marshal(&Command{
+	// send the command over to the FSM via Raft
+	_, err := s.apply(&Command{
 		Type:  Set,
 		Key:   key,
 		Value: value,
 	})
-	if err != nil {
-		log.L.Error("error marshalling to JSON", zap.Error(err))
-		return err
-	}
+	return err
+}
 
-	f := s.cluster.Raft.Apply(b, s.cluster.RaftTimeout)
-	return f.Error()
+// SetWithTTL sets the value for the given key, which expires once the
+// given time to live has elapsed.
+func (s *ReplicatedStore) SetWithTTL(key, value string, ttl time.Duration) error {
+	if s.cluster.Raft.State() != raft.Leader {
+		log.L.Error("mutating (set) operation not on Raft cluster leader", zap.Error(ErrNotLeader))
+		return s.notLeader()
+	}
+	// send the command over to the FSM via Raft
+	_, err := s.apply(&Command{
+		Type:  Set,
+		Key:   key,
+		Value: value,
+		TTL:   ttl,
+	})
+	return err
 }
 
 // Delete deletes the given key.
 func (s *ReplicatedStore) Delete(key string) error {
 	if s.cluster.Raft.State() != raft.Leader {
 		log.L.Error("mutating operation not on Raft cluster leader", zap.Error(ErrNotLeader))
-		return ErrNotLeader
+		return s.notLeader()
 	}
-	// marshal command and send it over to the FSM via Raft
-	b, err := json.Marshal(&Command{
+	// send the command over to the FSM via Raft
+	_, err := s.apply(&Command{
 		Type: Delete,
 		Key:  key,
 	})
+	return err
+}
+
+// apply submits the command to the Raft log and waits for it to be
+// applied to the FSM; it returns both the errors coming from Raft (e.g.
+// leadership lost while committing) and those reported by the FSM while
+// applying the command to the local store. The command is stamped with
+// the leader's clock and history retention, so that all nodes record the
+// same time for it and keep the same revisions.
+func (s *ReplicatedStore) apply(command *Command) (interface{}, error) {
+	command.Timestamp = time.Now().UnixNano()
+	retention := s.store.HistoryRetention
+	command.Retention = &retention
+	b, err := json.Marshal(command)
 	if err != nil {
 		log.L.Error("error marshalling to JSON", zap.Error(err))
+		return nil, err
+	}
+	f := s.cluster.Raft.Apply(b, s.cluster.RaftTimeout)
+	if err := f.Error(); err != nil {
+		log.L.Error("error applying command to Raft log", zap.Error(err))
+		if err == raft.ErrNotLeader || err == raft.ErrLeadershipLost {
+			return nil, s.notLeader()
+		}
+		return nil, err
+	}
+	response := f.Response()
+	if err, ok := response.(error); ok {
+		log.L.Error("error applying command to FSM", zap.Error(err))
+		return nil, err
+	}
+	return response, nil
+}
+
+// DeleteMatching deletes all the keys selected by the given filter, as
+// a single Raft log entry; it returns the number of deleted keys.
+func (s *ReplicatedStore) DeleteMatching(filter Filter) (int, error) {
+	if s.cluster.Raft.State() != raft.Leader {
+		log.L.Error("mutating operation not on Raft cluster leader", zap.Error(ErrNotLeader))
+		return 0, s.notLeader()
+	}
+	// make sure the filter is valid before submitting it to the cluster
+	if _, err := filter.matcher(); err != nil {
+		log.L.Error("invalid filter", zap.String("pattern", filter.Pattern), zap.Error(err))
+		return 0, err
+	}
+	// send the command over to the FSM via Raft
+	response, err := s.apply(&Command{
+		Type:   DeleteMatching,
+		Filter: &filter,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return response.(int), nil
+}
+
+// Transact submits the transaction to the cluster as a single Raft log
+// entry; its guards are evaluated by the FSM on each node, against the
+// same state, so all nodes agree on whether it is committed.
+func (s *ReplicatedStore) Transact(transaction Transaction) (*TransactionResult, error) {
+	if s.cluster.Raft.State() != raft.Leader {
+		log.L.Error("mutating operation not on Raft cluster leader", zap.Error(ErrNotLeader))
+		return nil, s.notLeader()
+	}
+	// make sure the transaction is valid before submitting it to the cluster
+	if err := transaction.validate(); err != nil {
+		log.L.Error("invalid transaction", zap.Error(err))
+		return nil, err
+	}
+	// send the command over to the FSM via Raft
+	response, err := s.apply(&Command{
+		Type:        Transact,
+		Transaction: &transaction,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return response.(*TransactionResult), nil
+}
+
+// Rollback restores the key to the given revision in its history, by
+// replicating the restore through the Raft log; it returns the index of
+// the new revision.
+func (s *ReplicatedStore) Rollback(key string, revision uint64) (uint64, error) {
+	if s.cluster.Raft.State() != raft.Leader {
+		log.L.Error("mutating operation not on Raft cluster leader", zap.Error(ErrNotLeader))
+		return 0, s.notLeader()
+	}
+	// send the command over to the FSM via Raft
+	response, err := s.apply(&Command{
+		Type:     Rollback,
+		Key:      key,
+		Revision: revision,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return response.(uint64), nil
+}
+
+// Expire deletes all the keys that have expired; since nodes' clocks
+// cannot be trusted to agree, the time at which keys are considered
+// expired is that of the leader, as recorded in the Raft log entry.
+func (s *ReplicatedStore) Expire() (int, error) {
+	if s.cluster.Raft.State() != raft.Leader {
+		log.L.Error("mutating operation not on Raft cluster leader", zap.Error(ErrNotLeader))
+		return 0, s.notLeader()
+	}
+	// send the command over to the FSM via Raft
+	response, err := s.apply(&Command{
+		Type: Expire,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return response.(int), nil
+}
+
+// StartExpiration starts the background loop that, at the given interval,
+// deletes the expired keys when this node is the leader; in the meantime,
+// expired keys are hidden on all nodes. The loop runs until Close is
+// called.
+func (s *ReplicatedStore) StartExpiration(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				log.L.Debug("expiration loop stopped")
+				return
+			case <-ticker.C:
+				if s.cluster.Raft.State() != raft.Leader {
+					continue
+				}
+				// avoid filling the log with no-op entries
+				if found, err := s.store.hasExpired(time.Now()); err != nil || !found {
+					continue
+				}
+				if count, err := s.Expire(); err != nil {
+					log.L.Error("error expiring keys", zap.Error(err))
+				} else {
+					log.L.Debug("keys expired", zap.Int("count", count))
+				}
+			}
+		}
+	}()
+}
+
+// Close stops the background activities of the ReplicatedStore.
+func (s *ReplicatedStore) Close() {
+	close(s.stop)
+}
+
+// Changes returns the changes applied to the store after the given index;
+// since all changes are applied through the FSM, they are available on
+// all nodes.
+func (s *ReplicatedStore) Changes(index uint64) (*ChangeSet, error) {
+	return s.store.Changes(index)
+}
+
+// RegisterNode adds the node to the replicated registry, or updates its
+// information if already registered.
+func (s *ReplicatedStore) RegisterNode(node NodeInfo) error {
+	if err := node.validate(); err != nil {
 		return err
 	}
+	if s.cluster.Raft.State() != raft.Leader {
+		log.L.Error("mutating operation not on Raft cluster leader", zap.Error(ErrNotLeader))
+		return s.notLeader()
+	}
+	// send the command over to the FSM via Raft
+	_, err := s.apply(&Command{
+		Type: RegisterNode,
+		Node: &node,
+	})
+	return err
+}
 
-	f := s.cluster.Raft.Apply(b, s.cluster.RaftTimeout)
-	return f.Error()
+// Nodes returns the nodes in the registry; the registry is served by the
+// LocalStore on any node.
+func (s *ReplicatedStore) Nodes() ([]NodeInfo, error) {
+	return s.store.Nodes()
+}
+
+// LeaderPreference returns the IDs of the nodes that should lead the
+// cluster, in order of preference, as served by the LocalStore on any
+// node; it returns nil if the preference has never been set.
+func (s *ReplicatedStore) LeaderPreference() ([]string, error) {
+	return s.store.LeaderPreference()
+}
+
+// Applied returns the index and term of the latest Raft log entry applied
+// to the LocalStore on this node.
+func (s *ReplicatedStore) Applied() (uint64, uint64, error) {
+	return s.store.Applied()
+}
+
+// SetLeaderPreference sets the IDs of the nodes that should lead the
+// cluster, in order of preference, on all nodes.
+func (s *ReplicatedStore) SetLeaderPreference(ids []string) error {
+	if err := validatePreference(ids); err != nil {
+		return err
+	}
+	if s.cluster.Raft.State() != raft.Leader {
+		log.L.Error("mutating operation not on Raft cluster leader", zap.Error(ErrNotLeader))
+		return s.notLeader()
+	}
+	if ids == nil {
+		ids = []string{}
+	}
+	_, err := s.apply(&Command{
+		Type:       SetLeaderPreference,
+		Preference: ids,
+	})
+	return err
+}
+
+// PendingPromotions returns the IDs of the non-voters waiting to be
+// promoted to voters, as served by the LocalStore on any node.
+func (s *ReplicatedStore) PendingPromotions() ([]string, error) {
+	return s.store.PendingPromotions()
+}
+
+// SetPendingPromotions sets the IDs of the non-voters waiting to be
+// promoted to voters, on all nodes, so that a new leader can promote them.
+func (s *ReplicatedStore) SetPendingPromotions(ids []string) error {
+	if s.cluster.Raft.State() != raft.Leader {
+		log.L.Error("mutating operation not on Raft cluster leader", zap.Error(ErrNotLeader))
+		return s.notLeader()
+	}
+	_, err := s.apply(&Command{
+		Type:       SetPendingPromotions,
+		Promotions: ids,
+	})
+	return err
+}
+
+// Leader returns the information about the current leader, as recorded in
+// the registry; it returns ErrNodeNotFound if there is no leader or it has
+// not registered yet.
+func (s *ReplicatedStore) Leader() (*NodeInfo, error) {
+	address := string(s.cluster.Raft.Leader())
+	if address == "" {
+		return nil, ErrNodeNotFound
+	}
+	return s.store.NodeByRaftAddress(address)
+}
+
+// notLeader returns the error reporting that this node is not the leader,
+// along with the URL of the leader API, if known.
+func (s *ReplicatedStore) notLeader() error {
+	leader, err := s.Leader()
+	if err != nil {
+		return &NotLeaderError{}
+	}
+	return &NotLeaderError{Leader: leader.URL()}
 }
@@ -0,0 +1,134 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/dihedron/brokerd/cluster"
+	"github.com/hashicorp/raft"
+)
+
+// newTestCluster creates a cluster of in-memory Raft nodes, each on its
+// own store, where the first node is the leader and all the nodes are
+// registered with their HTTP address; it returns the replicated stores,
+// in the order of the nodes.
+func newTestCluster(t *testing.T, nodes int, allowGetOnFollower bool) []*ReplicatedStore {
+	t.Helper()
+	stores := []*ReplicatedStore{}
+	transports := []*raft.InmemTransport{}
+	for i := 0; i < nodes; i++ {
+		id := fmt.Sprintf("node%d", i)
+		address, transport := raft.NewInmemTransport(raft.ServerAddress(id))
+		for _, other := range transports {
+			transport.Connect(other.LocalAddr(), other)
+			other.Connect(address, transport)
+		}
+		transports = append(transports, transport)
+
+		config := raft.DefaultConfig()
+		config.LocalID = raft.ServerID(id)
+		config.HeartbeatTimeout = 50 * time.Millisecond
+		config.ElectionTimeout = 50 * time.Millisecond
+		config.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.CommitTimeout = 5 * time.Millisecond
+		config.LogOutput = ioutil.Discard
+		store := newTestStore(t)
+		r, err := raft.NewRaft(config, NewReplicatedStoreFSM(store), raft.NewInmemStore(), raft.NewInmemStore(), raft.NewInmemSnapshotStore(), transport)
+		if err != nil {
+			t.Fatalf("failed to create Raft node %s: %v", id, err)
+		}
+		t.Cleanup(func() { r.Shutdown().Error() })
+		stores = append(stores, NewReplicatedStore(allowGetOnFollower, store, &cluster.Cluster{NodeID: id, Raft: r}))
+	}
+
+	leader := stores[0].cluster.Raft
+	configuration := raft.Configuration{Servers: []raft.Server{{ID: "node0", Address: "node0"}}}
+	if err := leader.BootstrapCluster(configuration).Error(); err != nil {
+		t.Fatalf("failed to bootstrap cluster: %v", err)
+	}
+	waitFor(t, func() bool { return leader.State() == raft.Leader })
+	for i := 1; i < nodes; i++ {
+		id := fmt.Sprintf("node%d", i)
+		if err := leader.AddVoter(raft.ServerID(id), raft.ServerAddress(id), 0, 0).Error(); err != nil {
+			t.Fatalf("failed to add voter %s: %v", id, err)
+		}
+	}
+	for i := range stores {
+		for j := range stores {
+			id := fmt.Sprintf("node%d", j)
+			node := NodeInfo{ID: id, RaftAddress: id, HTTPAddress: id + ":8080"}
+			if err := stores[i].store.RegisterNode(node); err != nil {
+				t.Fatalf("failed to register node %s: %v", id, err)
+			}
+		}
+	}
+	for _, store := range stores[1:] {
+		r := store.cluster.Raft
+		waitFor(t, func() bool { return r.Leader() == "node0" })
+	}
+	return stores
+}
+
+// waitFor waits for the condition to hold, failing the test if it does
+// not within a few seconds.
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if condition() {
+			return
+		}
+	}
+	t.Fatalf("condition not met in time")
+}
+
+func Test_ReplicatedStoreEnsure(t *testing.T) {
+	stores := newTestCluster(t, 2, false)
+	permissive := newTestCluster(t, 2, true)
+	tests := []struct {
+		name   string
+		store  *ReplicatedStore
+		level  Consistency
+		leader string
+		err    error
+	}{
+		{name: "none on leader", store: stores[0], level: ConsistencyNone},
+		{name: "none on follower", store: stores[1], level: ConsistencyNone},
+		{name: "weak on leader", store: stores[0], level: ConsistencyWeak},
+		{name: "weak on follower", store: stores[1], level: ConsistencyWeak, leader: "http://node0:8080", err: ErrNotLeader},
+		{name: "strong on leader", store: stores[0], level: ConsistencyStrong},
+		{name: "strong on follower", store: stores[1], level: ConsistencyStrong, leader: "http://node0:8080", err: ErrNotLeader},
+		{name: "default on follower", store: stores[1], level: ConsistencyDefault, leader: "http://node0:8080", err: ErrNotLeader},
+		{name: "default on permissive follower", store: permissive[1], level: ConsistencyDefault},
+		{name: "invalid", store: stores[0], level: Consistency(42), err: ErrInvalidConsistency},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.store.ensure(test.level)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("wrong error: %v (expected %v)", err, test.err)
+			}
+			var notLeader *NotLeaderError
+			if errors.As(err, &notLeader) && notLeader.Leader != test.leader {
+				t.Fatalf("wrong leader: %q (expected %q)", notLeader.Leader, test.leader)
+			}
+		})
+	}
+}
+
+func Test_ReplicatedStoreStrongRead(t *testing.T) {
+	stores := newTestCluster(t, 2, true)
+	if err := stores[0].Set("key", "value"); err != nil {
+		t.Fatalf("failed to set key: %v", err)
+	}
+	// the cluster has no Raft timeout, so the barrier uses the default one
+	value, err := stores[0].Get("key", ConsistencyStrong)
+	if err != nil {
+		t.Fatalf("failed to get key: %v", err)
+	}
+	if value != "value" {
+		t.Fatalf("wrong value: %q (expected %q)", value, "value")
+	}
+}
@@ -0,0 +1,372 @@
+package kvstore
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// SnapshotFormatVersion is the version of the format snapshots are
+// written in.
+const SnapshotFormatVersion = 1
+
+const (
+	// SnapshotRows snapshots the contents of the tables, one row at a
+	// time.
+	SnapshotRows = "rows"
+	// SnapshotDatabase snapshots a copy of the whole database file, so that
+	// the snapshots cover all the tables.
+	SnapshotDatabase = "database"
+)
+
+const (
+	// CompressionNone writes snapshots uncompressed.
+	CompressionNone = "none"
+	// CompressionGzip compresses snapshots with gzip.
+	CompressionGzip = "gzip"
+	// CompressionZstd compresses snapshots with zstd.
+	CompressionZstd = "zstd"
+)
+
+// ErrInvalidSnapshot is the error returned when a snapshot cannot be
+// decoded, is truncated or does not match its checksum.
+var ErrInvalidSnapshot error = fmt.Errorf("invalid snapshot")
+
+// snapshotMagic opens the snapshots in the framed format; older snapshots
+// are a single JSON document, starting with '{' or '['.
+var snapshotMagic = []byte("BRKDSNAP")
+
+// the kinds of frames in a snapshot; the end frame carries the trailer.
+const (
+	frameEnd byte = iota
+	framePair
+	frameRevision
+	frameNode
+	frameSetting
+	frameChunk
+)
+
+// snapshotTables are the tables whose rows are written to snapshots.
+var snapshotTables = []string{"pairs", "history", "nodes", "settings"}
+
+// chunkSize is the size of the chunks of the database file written to
+// snapshots in database mode.
+const chunkSize = 1 << 20
+
+// maxFrameSize is the maximum size of the payload of a frame, so that a
+// corrupted length cannot cause huge allocations.
+const maxFrameSize = 64 << 20
+
+// snapshotHeader describes the snapshot; it follows the magic, as a JSON
+// document prefixed by its length, and is never compressed.
+type snapshotHeader struct {
+	// Version is the version of the format.
+	Version int `json:"version"`
+	// Contents is either SnapshotRows or SnapshotDatabase; if empty, it is
+	// SnapshotRows.
+	Contents string `json:"contents,omitempty"`
+	// Index is the index of the latest Raft log entry applied to the store
+	// when the snapshot was taken.
+	Index uint64 `json:"index"`
+	// Rows is the number of rows (pairs, revisions, nodes and settings) in
+	// the snapshot, or of chunks of the database file.
+	Rows uint64 `json:"rows"`
+	// Tables is the number of rows of each table in the snapshot.
+	Tables map[string]uint64 `json:"tables,omitempty"`
+	// Compression is the compression applied to the frames.
+	Compression string `json:"compression"`
+	// Checksum is the algorithm of the checksum in the trailer.
+	Checksum string `json:"checksum"`
+}
+
+// snapshotTrailer is the payload of the end frame; as it is written once
+// all the rows have been streamed, it carries their checksum.
+type snapshotTrailer struct {
+	// Rows is the number of rows written.
+	Rows uint64 `json:"rows"`
+	// Checksum is the hex-encoded SHA-256 of all the frames preceding the
+	// end frame, uncompressed.
+	Checksum string `json:"checksum"`
+}
+
+// setting is a cluster-wide setting, as written to snapshots.
+type setting struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// snapshotWriter encodes a snapshot as a stream of frames, each made of
+// its kind, the length of its payload as a varint and the payload itself.
+type snapshotWriter struct {
+	out        *bufio.Writer
+	body       io.Writer
+	compressor io.WriteCloser
+	hash       hash.Hash
+	rows       uint64
+}
+
+// newSnapshotWriter writes the magic and the header to w, and returns a
+// writer for the frames.
+func newSnapshotWriter(w io.Writer, header snapshotHeader) (*snapshotWriter, error) {
+	header.Version = SnapshotFormatVersion
+	header.Checksum = "sha256"
+	if header.Compression == "" {
+		header.Compression = CompressionNone
+	}
+	s := &snapshotWriter{
+		out:  bufio.NewWriter(w),
+		hash: sha256.New(),
+	}
+	switch header.Compression {
+	case CompressionNone:
+		s.body = s.out
+	case CompressionGzip:
+		s.compressor = gzip.NewWriter(s.out)
+		s.body = s.compressor
+	case CompressionZstd:
+		encoder, err := zstd.NewWriter(s.out)
+		if err != nil {
+			return nil, err
+		}
+		s.compressor = encoder
+		s.body = s.compressor
+	default:
+		return nil, fmt.Errorf("unsupported snapshot compression: %q", header.Compression)
+	}
+	data, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.out.Write(snapshotMagic); err != nil {
+		return nil, err
+	}
+	if err := writeFrame(s.out, nil, 0, data, false); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// write appends a row of the given kind to the snapshot.
+func (s *snapshotWriter) write(kind byte, row interface{}) error {
+	data, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	return s.writeRaw(kind, data)
+}
+
+// writeRaw appends a frame of the given kind to the snapshot, with the
+// data as its payload.
+func (s *snapshotWriter) writeRaw(kind byte, data []byte) error {
+	if err := writeFrame(s.body, s.hash, kind, data, true); err != nil {
+		return err
+	}
+	s.rows++
+	return nil
+}
+
+// close writes the end frame and flushes the snapshot.
+func (s *snapshotWriter) close() error {
+	data, err := json.Marshal(snapshotTrailer{Rows: s.rows, Checksum: hex.EncodeToString(s.hash.Sum(nil))})
+	if err != nil {
+		return err
+	}
+	if err := writeFrame(s.body, nil, frameEnd, data, true); err != nil {
+		return err
+	}
+	if s.compressor != nil {
+		if err := s.compressor.Close(); err != nil {
+			return err
+		}
+	}
+	return s.out.Flush()
+}
+
+// writeFrame writes the payload prefixed by its length and, if requested,
+// by its kind, adding all of it to the hash if any.
+func writeFrame(w io.Writer, h hash.Hash, kind byte, payload []byte, typed bool) error {
+	var prefix [1 + binary.MaxVarintLen64]byte
+	n := 0
+	if typed {
+		prefix[0] = kind
+		n++
+	}
+	n += binary.PutUvarint(prefix[n:], uint64(len(payload)))
+	if h != nil {
+		h.Write(prefix[:n])
+		h.Write(payload)
+	}
+	if _, err := w.Write(prefix[:n]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// isFramedSnapshot returns whether the snapshot is in the framed format,
+// without consuming any of it.
+func isFramedSnapshot(r *bufio.Reader) bool {
+	magic, err := r.Peek(len(snapshotMagic))
+	return err == nil && bytes.Equal(magic, snapshotMagic)
+}
+
+// snapshotReader decodes a snapshot in the framed format.
+type snapshotReader struct {
+	header  snapshotHeader
+	body    *bufio.Reader
+	hash    hash.Hash
+	rows    uint64
+	release func()
+}
+
+// newSnapshotReader reads the magic and the header from r, and returns a
+// reader for the frames.
+func newSnapshotReader(r *bufio.Reader) (*snapshotReader, error) {
+	if !isFramedSnapshot(r) {
+		return nil, fmt.Errorf("%w: unknown format", ErrInvalidSnapshot)
+	}
+	r.Discard(len(snapshotMagic))
+	data, err := readPayload(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: error reading header: %v", ErrInvalidSnapshot, err)
+	}
+	s := &snapshotReader{hash: sha256.New()}
+	if err := json.Unmarshal(data, &s.header); err != nil {
+		return nil, fmt.Errorf("%w: error decoding header: %v", ErrInvalidSnapshot, err)
+	}
+	if s.header.Version != SnapshotFormatVersion {
+		return nil, fmt.Errorf("%w: unsupported format version %d", ErrInvalidSnapshot, s.header.Version)
+	}
+	if s.header.Contents == "" {
+		s.header.Contents = SnapshotRows
+	}
+	if s.header.Contents != SnapshotRows && s.header.Contents != SnapshotDatabase {
+		return nil, fmt.Errorf("%w: unsupported contents %q", ErrInvalidSnapshot, s.header.Contents)
+	}
+	if s.header.Checksum != "sha256" {
+		return nil, fmt.Errorf("%w: unsupported checksum %q", ErrInvalidSnapshot, s.header.Checksum)
+	}
+	switch s.header.Compression {
+	case CompressionNone:
+		s.body = r
+	case CompressionGzip:
+		decompressor, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+		}
+		s.body = bufio.NewReader(decompressor)
+	case CompressionZstd:
+		decompressor, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+		}
+		s.body = bufio.NewReader(decompressor)
+		s.release = decompressor.Close
+	default:
+		return nil, fmt.Errorf("%w: unsupported compression %q", ErrInvalidSnapshot, s.header.Compression)
+	}
+	return s, nil
+}
+
+// next returns the kind and the payload of the next row in the snapshot;
+// once the end frame is reached, it verifies the number of rows, the
+// checksum and the end of the compressed stream, and returns io.EOF if
+// they are all right.
+func (s *snapshotReader) next() (byte, []byte, error) {
+	kind, err := s.body.ReadByte()
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: truncated: %v", ErrInvalidSnapshot, err)
+	}
+	var prefix [1 + binary.MaxVarintLen64]byte
+	prefix[0] = kind
+	length, err := binary.ReadUvarint(s.body)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: truncated: %v", ErrInvalidSnapshot, err)
+	}
+	n := 1 + binary.PutUvarint(prefix[1:], length)
+	payload, err := readBytes(s.body, length)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: truncated: %v", ErrInvalidSnapshot, err)
+	}
+	if kind == frameEnd {
+		if err := s.verify(payload); err != io.EOF {
+			return 0, nil, err
+		}
+		return 0, nil, s.complete()
+	}
+	if (kind == frameChunk) != (s.header.Contents == SnapshotDatabase) || kind > frameChunk {
+		return 0, nil, fmt.Errorf("%w: unexpected frame kind %d", ErrInvalidSnapshot, kind)
+	}
+	s.hash.Write(prefix[:n])
+	s.hash.Write(payload)
+	s.rows++
+	return kind, payload, nil
+}
+
+// verify checks the trailer against the rows read.
+func (s *snapshotReader) verify(payload []byte) error {
+	var trailer snapshotTrailer
+	if err := json.Unmarshal(payload, &trailer); err != nil {
+		return fmt.Errorf("%w: error decoding trailer: %v", ErrInvalidSnapshot, err)
+	}
+	if checksum := hex.EncodeToString(s.hash.Sum(nil)); !strings.EqualFold(checksum, trailer.Checksum) {
+		return fmt.Errorf("%w: checksum mismatch (expected %s, got %s)", ErrInvalidSnapshot, trailer.Checksum, checksum)
+	}
+	if s.rows != trailer.Rows || s.rows != s.header.Rows {
+		return fmt.Errorf("%w: row count mismatch (expected %d, got %d)", ErrInvalidSnapshot, s.header.Rows, s.rows)
+	}
+	return io.EOF
+}
+
+// complete checks that the compressed stream, if any, ends right after the
+// end frame, so that the checksum of the compression is verified too.
+func (s *snapshotReader) complete() error {
+	if s.header.Compression == CompressionNone {
+		return io.EOF
+	}
+	if _, err := s.body.ReadByte(); err == nil {
+		return fmt.Errorf("%w: unexpected data after the end frame", ErrInvalidSnapshot)
+	} else if err != io.EOF {
+		return fmt.Errorf("%w: truncated: %v", ErrInvalidSnapshot, err)
+	}
+	return io.EOF
+}
+
+// close releases the resources held by the decompressor, if any.
+func (s *snapshotReader) close() {
+	if s.release != nil {
+		s.release()
+	}
+}
+
+// readPayload reads a payload prefixed by its length.
+func readPayload(r *bufio.Reader) ([]byte, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	return readBytes(r, length)
+}
+
+// readBytes reads exactly length bytes.
+func readBytes(r io.Reader, length uint64) ([]byte, error) {
+	if length > maxFrameSize {
+		return nil, errors.New("frame too large")
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
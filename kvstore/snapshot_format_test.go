@@ -0,0 +1,177 @@
+package kvstore
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// writeTestSnapshot writes a snapshot with two rows in the framed format;
+// the header announces the given number of rows.
+func writeTestSnapshot(t *testing.T, compression string, rows uint64) []byte {
+	t.Helper()
+	var buffer bytes.Buffer
+	writer, err := newSnapshotWriter(&buffer, snapshotHeader{Index: 7, Rows: rows, Compression: compression})
+	if err != nil {
+		t.Fatalf("failed to write header: %v", err)
+	}
+	if err := writer.write(framePair, pair{Key: "key", Value: "value-1", Index: 3}); err != nil {
+		t.Fatalf("failed to write pair: %v", err)
+	}
+	if err := writer.write(frameSetting, setting{Name: "name", Value: "value-2"}); err != nil {
+		t.Fatalf("failed to write setting: %v", err)
+	}
+	if err := writer.close(); err != nil {
+		t.Fatalf("failed to close snapshot: %v", err)
+	}
+	return buffer.Bytes()
+}
+
+// readTestSnapshot reads all the frames in the snapshot, returning their
+// kinds.
+func readTestSnapshot(data []byte) ([]byte, error) {
+	reader, err := newSnapshotReader(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return nil, err
+	}
+	kinds := []byte{}
+	for {
+		kind, _, err := reader.next()
+		if err == io.EOF {
+			return kinds, nil
+		} else if err != nil {
+			return kinds, err
+		}
+		kinds = append(kinds, kind)
+	}
+}
+
+// Test_SnapshotFormat tests that snapshots in the framed format are read
+// back as written, and that damaged snapshots are detected.
+func Test_SnapshotFormat(t *testing.T) {
+	tests := []struct {
+		name        string
+		compression string
+		rows        uint64
+		damage      func(data []byte) []byte
+		message     string
+	}{
+		{
+			name:        "uncompressed",
+			compression: CompressionNone,
+			rows:        2,
+		},
+		{
+			name:        "gzip",
+			compression: CompressionGzip,
+			rows:        2,
+		},
+		{
+			name:        "zstd",
+			compression: CompressionZstd,
+			rows:        2,
+		},
+		{
+			name:        "default compression",
+			compression: "",
+			rows:        2,
+		},
+		{
+			name:        "checksum mismatch",
+			compression: CompressionNone,
+			rows:        2,
+			damage: func(data []byte) []byte {
+				return bytes.Replace(data, []byte("value-1"), []byte("value-X"), 1)
+			},
+			message: "checksum mismatch",
+		},
+		{
+			name:        "truncated",
+			compression: CompressionNone,
+			rows:        2,
+			damage: func(data []byte) []byte {
+				return data[:len(data)-10]
+			},
+			message: "truncated",
+		},
+		{
+			name:        "truncated gzip",
+			compression: CompressionGzip,
+			rows:        2,
+			damage: func(data []byte) []byte {
+				return data[:len(data)-10]
+			},
+			message: "truncated",
+		},
+		{
+			name:        "truncated zstd",
+			compression: CompressionZstd,
+			rows:        2,
+			damage: func(data []byte) []byte {
+				return data[:len(data)-4]
+			},
+			message: "truncated",
+		},
+		{
+			name:        "row count mismatch",
+			compression: CompressionGzip,
+			rows:        3,
+			message:     "row count mismatch",
+		},
+		{
+			name:        "unknown format",
+			compression: CompressionNone,
+			rows:        2,
+			damage: func(data []byte) []byte {
+				return append([]byte("XX"), data[2:]...)
+			},
+			message: "unknown format",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := writeTestSnapshot(t, test.compression, test.rows)
+			if test.damage != nil {
+				data = test.damage(data)
+			}
+			kinds, err := readTestSnapshot(data)
+			if test.message == "" {
+				if err != nil {
+					t.Fatalf("failed to read snapshot: %v", err)
+				}
+				if !bytes.Equal(kinds, []byte{framePair, frameSetting}) {
+					t.Fatalf("wrong frames: %v", kinds)
+				}
+				return
+			}
+			if !errors.Is(err, ErrInvalidSnapshot) || !strings.Contains(err.Error(), test.message) {
+				t.Fatalf("wrong error: %v (expected %q)", err, test.message)
+			}
+		})
+	}
+}
+
+// Test_SnapshotCompression tests that only the supported compressions are
+// accepted when writing snapshots.
+func Test_SnapshotCompression(t *testing.T) {
+	tests := []struct {
+		compression string
+		supported   bool
+	}{
+		{CompressionNone, true},
+		{CompressionGzip, true},
+		{CompressionZstd, true},
+		{"lz4", false},
+	}
+	for _, test := range tests {
+		t.Run(test.compression, func(t *testing.T) {
+			_, err := newSnapshotWriter(&bytes.Buffer{}, snapshotHeader{Compression: test.compression})
+			if supported := err == nil; supported != test.supported {
+				t.Fatalf("wrong support for compression %s: %v", test.compression, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package kvstore
+
+import (
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrInvalidTransaction is the error returned when a transaction
+	// contains invalid guards or operations.
+	ErrInvalidTransaction error = fmt.Errorf("invalid transaction")
+)
+
+// GuardType represents the type of condition checked by a Guard.
+type GuardType int8
+
+const (
+	// Exists is the guard requiring that the key exists.
+	Exists GuardType = iota
+	// Absent is the guard requiring that the key does not exist.
+	Absent
+	// Equals is the guard requiring that the key exists and holds
+	// the given value.
+	Equals
+	// IndexEquals is the guard requiring that the key exists and was
+	// last modified at the given index.
+	IndexEquals
+	// IndexNotEquals is the guard requiring that the key either does not
+	// exist or was not last modified at the given index.
+	IndexNotEquals
+)
+
+// Guard is a condition on the state of a key that must hold for a
+// Transaction to be applied.
+type Guard struct {
+	Type  GuardType `json:"type"`
+	Key   string    `json:"key"`
+	Value string    `json:"value,omitempty"`
+	Index uint64    `json:"index,omitempty"`
+}
+
+// holds checks whether the guard is satisfied by the given pair, which
+// is nil if the key does not exist.
+func (g Guard) holds(pair *Pair) bool {
+	switch g.Type {
+	case Exists:
+		return pair != nil
+	case Absent:
+		return pair == nil
+	case Equals:
+		return pair != nil && pair.Value == g.Value
+	case IndexEquals:
+		return pair != nil && pair.Index == g.Index
+	case IndexNotEquals:
+		return pair == nil || pair.Index != g.Index
+	}
+	return false
+}
+
+// Operation is a single mutation (either Set or Delete) in a Transaction;
+// if TTL is greater than 0, the pair set by the operation expires once it
+// has elapsed.
+type Operation struct {
+	Type  CommandType   `json:"type"`
+	Key   string        `json:"key"`
+	Value string        `json:"value,omitempty"`
+	TTL   time.Duration `json:"ttl,omitempty"`
+}
+
+// Transaction is a list of operations that are applied all together,
+// provided that all its guards hold, or not at all.
+type Transaction struct {
+	Guards     []Guard     `json:"guards,omitempty"`
+	Operations []Operation `json:"operations"`
+}
+
+// validate checks that the transaction only contains known guards and
+// operations.
+func (t Transaction) validate() error {
+	for _, guard := range t.Guards {
+		if guard.Key == "" {
+			return fmt.Errorf("%w: guard with no key", ErrInvalidTransaction)
+		}
+		if guard.Type < Exists || guard.Type > IndexNotEquals {
+			return fmt.Errorf("%w: unrecognized guard type: %d", ErrInvalidTransaction, guard.Type)
+		}
+	}
+	for _, operation := range t.Operations {
+		if operation.Key == "" {
+			return fmt.Errorf("%w: operation with no key", ErrInvalidTransaction)
+		}
+		if operation.Type != Set && operation.Type != Delete {
+			return fmt.Errorf("%w: unrecognized operation type: %d", ErrInvalidTransaction, operation.Type)
+		}
+		if operation.TTL < 0 {
+			return fmt.Errorf("%w: negative time to live", ErrInvalidTransaction)
+		}
+	}
+	return nil
+}
+
+// GuardResult reports whether a Guard held when the Transaction was
+// evaluated.
+type GuardResult struct {
+	Guard
+	Passed bool `json:"passed"`
+}
+
+// TransactionResult is the outcome of a Transaction: if any of the guards
+// did not hold, the transaction is not committed; otherwise Index is the
+// modification index of the keys it modified.
+type TransactionResult struct {
+	Committed bool          `json:"committed"`
+	Index     uint64        `json:"index,omitempty"`
+	Guards    []GuardResult `json:"guards,omitempty"`
+}
@@ -0,0 +1,211 @@
+package kvstore
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// contents returns all the pairs in the store, as a map of their values.
+func contents(t *testing.T, store *LocalStore) map[string]string {
+	t.Helper()
+	pairs, _, err := store.List(Filter{}, "", 0, ConsistencyDefault)
+	if err != nil {
+		t.Fatalf("failed to list pairs: %v", err)
+	}
+	result := map[string]string{}
+	for _, pair := range pairs {
+		result[pair.Key] = pair.Value
+	}
+	return result
+}
+
+// Test_Transact tests that transactions are applied all together if their
+// guards hold, and not at all otherwise.
+func Test_Transact(t *testing.T) {
+	tests := []struct {
+		name        string
+		transaction Transaction
+		committed   bool
+		passed      []bool
+		expected    map[string]string
+		err         error
+	}{
+		{
+			name: "no guards",
+			transaction: Transaction{Operations: []Operation{
+				{Type: Set, Key: "c", Value: "3"},
+				{Type: Delete, Key: "a"},
+			}},
+			committed: true,
+			passed:    []bool{},
+			expected:  map[string]string{"b": "2", "c": "3"},
+		},
+		{
+			name: "guards holding",
+			transaction: Transaction{
+				Guards: []Guard{
+					{Type: Exists, Key: "a"},
+					{Type: Absent, Key: "c"},
+					{Type: Equals, Key: "b", Value: "2"},
+				},
+				Operations: []Operation{
+					{Type: Set, Key: "a", Value: "10"},
+					{Type: Set, Key: "c", Value: "30"},
+				},
+			},
+			committed: true,
+			passed:    []bool{true, true, true},
+			expected:  map[string]string{"a": "10", "b": "2", "c": "30"},
+		},
+		{
+			name: "guard failing",
+			transaction: Transaction{
+				Guards: []Guard{
+					{Type: Exists, Key: "a"},
+					{Type: Equals, Key: "b", Value: "3"},
+				},
+				Operations: []Operation{
+					{Type: Set, Key: "a", Value: "10"},
+					{Type: Delete, Key: "b"},
+				},
+			},
+			committed: false,
+			passed:    []bool{true, false},
+			expected:  map[string]string{"a": "1", "b": "2"},
+		},
+		{
+			name: "absent key exists",
+			transaction: Transaction{
+				Guards:     []Guard{{Type: Absent, Key: "a"}},
+				Operations: []Operation{{Type: Set, Key: "a", Value: "10"}},
+			},
+			committed: false,
+			passed:    []bool{false},
+			expected:  map[string]string{"a": "1", "b": "2"},
+		},
+		{
+			name: "guard with no key",
+			transaction: Transaction{
+				Guards:     []Guard{{Type: Exists}},
+				Operations: []Operation{{Type: Set, Key: "a", Value: "10"}},
+			},
+			err:      ErrInvalidTransaction,
+			expected: map[string]string{"a": "1", "b": "2"},
+		},
+		{
+			name: "unknown operation",
+			transaction: Transaction{Operations: []Operation{
+				{Type: Set, Key: "c", Value: "3"},
+				{Type: Get, Key: "a"},
+			}},
+			err:      ErrInvalidTransaction,
+			expected: map[string]string{"a": "1", "b": "2"},
+		},
+		{
+			name: "negative time to live",
+			transaction: Transaction{Operations: []Operation{
+				{Type: Set, Key: "c", Value: "3", TTL: -1},
+			}},
+			err:      ErrInvalidTransaction,
+			expected: map[string]string{"a": "1", "b": "2"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := newTestStore(t)
+			store.Set("a", "1")
+			store.Set("b", "2")
+			result, err := store.Transact(test.transaction)
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Fatalf("wrong error: %v (expected %v)", err, test.err)
+				}
+			} else if err != nil {
+				t.Fatalf("failed to apply transaction: %v", err)
+			} else {
+				if result.Committed != test.committed {
+					t.Fatalf("wrong outcome: committed %t (expected %t)", result.Committed, test.committed)
+				}
+				passed := []bool{}
+				for _, guard := range result.Guards {
+					passed = append(passed, guard.Passed)
+				}
+				if !reflect.DeepEqual(passed, test.passed) {
+					t.Fatalf("wrong guard results: %v (expected %v)", passed, test.passed)
+				}
+			}
+			if actual := contents(t, store); !reflect.DeepEqual(actual, test.expected) {
+				t.Fatalf("wrong contents: %v (expected %v)", actual, test.expected)
+			}
+		})
+	}
+}
+
+// Test_TransactIndex tests that all the pairs modified by a transaction
+// are stamped with the same index, which is reported in the result.
+func Test_TransactIndex(t *testing.T) {
+	store := newTestStore(t)
+	result, err := store.Transact(Transaction{Operations: []Operation{
+		{Type: Set, Key: "a", Value: "1"},
+		{Type: Set, Key: "b", Value: "2"},
+	}})
+	if err != nil {
+		t.Fatalf("failed to apply transaction: %v", err)
+	}
+	for _, key := range []string{"a", "b"} {
+		pair, err := store.Lookup(key, ConsistencyDefault)
+		if err != nil {
+			t.Fatalf("failed to look up key %s: %v", key, err)
+		}
+		if pair.Index != result.Index {
+			t.Fatalf("wrong index for key %s: %d (expected %d)", key, pair.Index, result.Index)
+		}
+	}
+}
+
+// Test_CompareAndSwap tests that the index guards, on which the ETag
+// preconditions rely, only let through the updates based on the latest
+// modification of a key.
+func Test_CompareAndSwap(t *testing.T) {
+	tests := []struct {
+		name      string
+		guard     func(current uint64) Guard
+		committed bool
+	}{
+		{"matching index", func(current uint64) Guard { return Guard{Type: IndexEquals, Key: "a", Index: current} }, true},
+		{"stale index", func(current uint64) Guard { return Guard{Type: IndexEquals, Key: "a", Index: current - 1} }, false},
+		{"index on missing key", func(current uint64) Guard { return Guard{Type: IndexEquals, Key: "x", Index: current} }, false},
+		{"not matching index", func(current uint64) Guard { return Guard{Type: IndexNotEquals, Key: "a", Index: current - 1} }, true},
+		{"not matching current index", func(current uint64) Guard { return Guard{Type: IndexNotEquals, Key: "a", Index: current} }, false},
+		{"not matching on missing key", func(current uint64) Guard { return Guard{Type: IndexNotEquals, Key: "x", Index: current} }, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := newTestStore(t)
+			store.Set("a", "1")
+			store.Set("a", "2")
+			pair, err := store.Lookup("a", ConsistencyDefault)
+			if err != nil {
+				t.Fatalf("failed to look up key: %v", err)
+			}
+			result, err := store.Transact(Transaction{
+				Guards:     []Guard{test.guard(pair.Index)},
+				Operations: []Operation{{Type: Set, Key: "a", Value: "3"}},
+			})
+			if err != nil {
+				t.Fatalf("failed to apply transaction: %v", err)
+			}
+			if result.Committed != test.committed {
+				t.Fatalf("wrong outcome: committed %t (expected %t)", result.Committed, test.committed)
+			}
+			expected := "2"
+			if test.committed {
+				expected = "3"
+			}
+			if value, _ := store.Get("a", ConsistencyDefault); value != expected {
+				t.Fatalf("wrong value: %q (expected %q)", value, expected)
+			}
+		})
+	}
+}
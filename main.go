@@ -3,16 +3,23 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/dihedron/brokerd/cluster"
 	"github.com/dihedron/brokerd/kvstore"
 	"github.com/dihedron/brokerd/log"
 	"github.com/dihedron/brokerd/sqlite"
 	"github.com/dihedron/brokerd/web"
+	"github.com/dihedron/brokerd/web/openapi"
+	"github.com/hashicorp/raft"
 	"github.com/jessevdk/go-flags"
 	"go.uber.org/zap"
 )
@@ -25,11 +32,30 @@ const (
 
 // Options are the application startup options.
 type Options struct {
-	NodeID      string `short:"i" long:"id" description:"The unique ID of the node." required:"yes"`
-	HTTPAddress string `short:"h" long:"http" description:"Address to listen on for HTTP connections." default:"127.0.0.1:11000"`
-	RaftAddress string `short:"r" long:"raft" description:"Address to listen on for Raft RPC." default:"127.0.0.1:12000"`
-	JoinAddress string `short:"j" long:"join" description:"Address of the Raft leader." optional:"yes"`
-	RaftDir     string `short:"d" long:"dir" description:"Directory to store the Raft state in." required:"yes"`
+	NodeID      string        `short:"i" long:"id" description:"The unique ID of the node." required:"yes"`
+	HTTPAddress string        `short:"h" long:"http" description:"Address to listen on for HTTP connections." default:"127.0.0.1:11000"`
+	RaftAddress string        `short:"r" long:"raft" description:"Address to listen on for Raft RPC." default:"127.0.0.1:12000"`
+	Join        []string      `short:"j" long:"join" description:"HTTP address of a node of the cluster to join; can be repeated."`
+	Bootstrap   []string      `short:"b" long:"bootstrap" description:"Node to bootstrap a new cluster with, as <id>=<raft address>; can be repeated."`
+	BootFile    string        `long:"bootstrap-file" description:"JSON file with the nodes to bootstrap a new cluster with."`
+	RaftDir     string        `short:"d" long:"dir" description:"Directory to store the Raft state in." required:"yes"`
+	Retention   int           `long:"history-retention" description:"Number of revisions to keep for each key; that of the leader applies to all nodes." default:"10"`
+	Expiration  time.Duration `long:"expiration-interval" description:"Interval at which the leader deletes expired keys." default:"1s"`
+	WatchBuffer int           `long:"watch-buffer" description:"Number of recent changes kept for watching clients to resume from; 0 to keep none." default:"1000"`
+	Forwarding  string        `long:"forwarding" description:"How followers handle requests that must be served by the leader." choice:"none" choice:"proxy" choice:"redirect" default:"proxy"`
+	Peers       []string      `short:"p" long:"peer" description:"Raft and HTTP addresses of a peer node, as <raft address>=<http address>; can be repeated."`
+	Tags        []string      `short:"t" long:"tag" description:"Tag to attach to the node in the registry, as <key>=<value>; can be repeated."`
+	Autopilot   bool          `long:"autopilot" description:"Remove dead servers and promote joining servers once caught up, when leader."`
+	DeadServer  time.Duration `long:"dead-server-threshold" description:"Time a server must have been unhealthy before the autopilot removes it; 0 to never remove." default:"5m"`
+	MaxLag      uint64        `long:"max-lag" description:"Maximum number of log entries a server can be behind the leader to be healthy." default:"250"`
+	Stabilize   time.Duration `long:"stabilization-time" description:"Time a joining server must have been healthy before the autopilot promotes it to voter." default:"10s"`
+	Preference  []string      `long:"leader-preference" description:"ID of a node that should lead the cluster, in order of preference, unless changed through the API; can be repeated."`
+	Hysteresis  time.Duration `long:"preference-hysteresis" description:"Time a preferred node must have been healthy before the leadership is handed over to it." default:"30s"`
+	Events      int           `long:"event-history" description:"Number of cluster events kept in the local history." default:"1000"`
+	Leave       bool          `long:"leave-on-terminate" description:"Remove the node from the cluster configuration when terminated."`
+	Timeout     time.Duration `long:"shutdown-timeout" description:"Maximum time allowed for the orderly shutdown of the node." default:"30s"`
+	Snapshots   string        `long:"snapshot-mode" description:"Whether snapshots hold the rows of the tables or a copy of the whole database." choice:"rows" choice:"database" default:"rows"`
+	Compression string        `long:"snapshot-compression" description:"Compression applied to the snapshots." choice:"none" choice:"gzip" choice:"zstd" default:"gzip"`
 }
 
 func main() {
@@ -42,23 +68,37 @@ func main() {
 		log.L.Error("failure parsing command line", zap.Error(err))
 		os.Exit(1)
 	}
+	if options.WatchBuffer < 0 {
+		log.L.Error("invalid watch buffer, it must not be negative", zap.Int("size", options.WatchBuffer))
+		os.Exit(1)
+	}
 
 	log.L.Info("raft state directory", zap.String("path", options.RaftDir))
 	os.MkdirAll(options.RaftDir, 0o700)
 
 	lstore, err := kvstore.NewLocalStore(sqlite.WithStoreDirectory(options.RaftDir))
 	if err != nil {
-		log.L.Error("error ")
+		log.L.Error("error creating local store", zap.Error(err))
+		os.Exit(1)
 	}
+	lstore.HistoryRetention = options.Retention
+	lstore.Feed.Capacity = options.WatchBuffer
 
 	fsm := kvstore.NewReplicatedStoreFSM(lstore)
+	fsm.Mode = options.Snapshots
+	fsm.Compression = options.Compression
 	cluster, err := cluster.New(
 		options.NodeID,
 		fsm,
 		cluster.WithRaftBindAddress(options.RaftAddress),
 		cluster.WithRaftDirectory(options.RaftDir),
+		cluster.WithEventHistory(options.Events),
 		// TODO: check for more options
 	)
+	if err != nil {
+		log.L.Error("error creating cluster", zap.Error(err))
+		os.Exit(1)
+	}
 	// leaderCh := cluster.Raft.LeaderCh()
 	// rabbitCh:
 	// httdCh:
@@ -85,15 +125,22 @@ func main() {
 
 	// }
 
-	if options.JoinAddress == "" {
-		cluster.Bootstrap()
-	} else {
-		// join can only be performed on the leader, NEVER on the follower!
-		// so perform a cURL to the leader and ask it to be admitted.
-		// API REST
-		// POST https://<indirizzo del leader>/api/v1/join?me:192.  -> redirect al leader
+	if len(options.Join) == 0 {
+		nodes, err := bootstrapNodes(options)
+		if err != nil {
+			log.L.Error("invalid bootstrap nodes", zap.Error(err))
+			os.Exit(1)
+		}
+		if err := cluster.Bootstrap(nodes...); err != nil {
+			log.L.Error("error bootstrapping cluster", zap.Error(err))
+			os.Exit(1)
+		}
+	} else if len(options.Bootstrap) > 0 || options.BootFile != "" {
+		log.L.Error("bootstrap nodes cannot be specified when joining a cluster")
+		os.Exit(1)
 	}
 	rstore := kvstore.NewReplicatedStore(true, lstore, cluster)
+	rstore.StartExpiration(options.Expiration)
 
 	// r := cluster.New(
 	// 	options.NodeID, , options ...Option
@@ -105,7 +152,7 @@ func main() {
 	// 	store.WithRaftDirectory(options.RaftDir),
 	// 	store.WithRaftBindAddress(options.RaftAddress),
 	// )
-	// if err := s.Open(options.JoinAddress == "", options.NodeID); err != nil {
+	// if err := s.Open(len(options.Join) == 0, options.NodeID); err != nil {
 	// 	log.L.Error("failed to open store", zap.Error(err))
 	// }
 
@@ -115,7 +162,28 @@ func main() {
 	// 	os.Exit(1)
 	// }
 
-	ws, err := web.New(options.HTTPAddress, rstore, cluster)
+	peers, err := parsePeers(options)
+	if err != nil {
+		log.L.Error("invalid peer addresses", zap.Error(err))
+		os.Exit(1)
+	}
+	resolve := func(raftAddress string) (string, error) {
+		// nodes in the registry take precedence over static peers
+		if node, err := lstore.NodeByRaftAddress(raftAddress); err == nil && node.HTTPAddress != "" {
+			return node.HTTPAddress, nil
+		}
+		if address, ok := peers[raftAddress]; ok {
+			return address, nil
+		}
+		return "", fmt.Errorf("unknown peer: %s", raftAddress)
+	}
+	ws, err := web.New(
+		options.HTTPAddress,
+		rstore,
+		cluster,
+		web.WithForwarding(web.Forwarding(options.Forwarding)),
+		web.WithLeaderResolver(resolve),
+	)
 	if err != nil {
 		log.L.Error("failed to create web service", zap.Error(err))
 		os.Exit(1)
@@ -123,33 +191,328 @@ func main() {
 
 	go ws.Start()
 
-	// // If join was specified, make the join request.
-	// if options.JoinAddress != "" {
-	// 	if err := join(options.JoinAddress, options.RaftAddress, options.NodeID); err != nil {
-	// 		log.L.Error("failed to join node", zap.String("join address", options.JoinAddress), zap.Error(err))
-	// 	}
-	// }
+	if options.Autopilot {
+		cluster.StartAutopilot(probe(resolve), autopilotOptions(options, rstore)...)
+	}
+	cluster.StartRebalancer(
+		func() ([]string, error) {
+			// the preference set through the API takes precedence
+			ids, err := lstore.LeaderPreference()
+			if err != nil || ids != nil {
+				return ids, err
+			}
+			return options.Preference, nil
+		},
+		probe(resolve),
+		rebalancerOptions(options)...,
+	)
+
+	tags, err := parseTags(options)
+	if err != nil {
+		log.L.Error("invalid node tags", zap.Error(err))
+		os.Exit(1)
+	}
+	go announce(rstore, kvstore.NodeInfo{
+		ID:          options.NodeID,
+		RaftAddress: options.RaftAddress,
+		HTTPAddress: options.HTTPAddress,
+		Tags:        tags,
+	})
+
+	// if join was specified, ask the cluster to admit this node, unless
+	// it is already a member
+	if len(options.Join) > 0 {
+		if cluster.HasExistingState() {
+			log.L.Info("node has existing Raft state, not joining", zap.Strings("seeds", options.Join))
+		} else {
+			go func() {
+				if err := join(options.Join, options.RaftAddress, options.NodeID); err != nil {
+					log.L.Error("failed to join node", zap.Strings("seeds", options.Join), zap.Error(err))
+					os.Exit(1)
+				}
+			}()
+		}
+	}
 
 	log.L.Info("application started successfully")
 
 	terminate := make(chan os.Signal, 1)
-	signal.Notify(terminate, os.Interrupt)
-	<-terminate
-	log.L.Info("application exiting")
+	signal.Notify(terminate, os.Interrupt, syscall.SIGTERM)
+	s := <-terminate
+	log.L.Info("application exiting", zap.String("signal", s.String()))
+
+	// shut down in an orderly fashion, unless it takes too long
+	done := make(chan struct{})
+	go func() {
+		shutdown(ws, cluster, rstore, lstore, resolve, options.Leave)
+		close(done)
+	}()
+	select {
+	case <-done:
+		log.L.Info("application shut down")
+	case <-time.After(options.Timeout):
+		log.L.Error("timeout shutting down application", zap.Duration("timeout", options.Timeout))
+		os.Exit(1)
+	}
 }
 
-func join(joinAddr, raftAddr, nodeID string) error {
-	b, err := json.Marshal(map[string]string{"addr": raftAddr, "id": nodeID})
+// shutdown stops accepting API requests, hands the leadership over to
+// another node if this node is the leader and, if requested, removes the
+// node from the cluster configuration; then it stops Raft and closes the
+// store. Errors are logged and do not stop the sequence.
+func shutdown(ws *web.Server, c *cluster.Cluster, rstore *kvstore.ReplicatedStore, lstore *kvstore.LocalStore, resolve web.LeaderResolver, leave bool) {
+	ws.Stop()
+	var leader raft.ServerAddress
+	if c.Raft.State() == raft.Leader {
+		if server, err := c.TransferLeadership(""); err == nil {
+			leader = server.Address
+		}
+	} else {
+		leader = c.Raft.Leader()
+	}
+	if leave {
+		if err := leaveCluster(c, leader, resolve); err != nil {
+			log.L.Error("failed to leave cluster", zap.Error(err))
+		}
+	}
+	rstore.Close()
+	c.Shutdown()
+	lstore.Close()
+}
+
+// leaveCluster asks the leader to remove this node from the cluster
+// configuration; the leader refuses if the removal would leave the
+// cluster without a quorum.
+func leaveCluster(c *cluster.Cluster, leader raft.ServerAddress, resolve web.LeaderResolver) error {
+	if leader == "" || leader == c.Transport.LocalAddr() {
+		return fmt.Errorf("no other node is leading the cluster")
+	}
+	address, err := resolve(string(leader))
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodDelete, "http://"+address+"/api/v1/cluster/nodes/"+url.PathEscape(c.NodeID), nil)
 	if err != nil {
-		log.L.Error("failure marshalling join request nody to JSON", zap.Error(err))
 		return err
 	}
-	resp, err := http.Post(fmt.Sprintf("http://%s/join", joinAddr), "application-type/json", bytes.NewReader(b))
+	client := &http.Client{Timeout: 5 * time.Second}
+	response, err := client.Do(request)
 	if err != nil {
-		log.L.Error("failure sending join request", zap.String("join address", joinAddr), zap.Error(err))
 		return err
 	}
-	defer resp.Body.Close()
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusNoContent {
+		reason := openapi.Error{}
+		if err := json.NewDecoder(response.Body).Decode(&reason); err != nil || reason.Message == "" {
+			reason.Message = response.Status
+		}
+		return fmt.Errorf("removal refused by leader at %s: %s", address, reason.Message)
+	}
+	log.L.Info("node left cluster", zap.String("leader", address))
+	return nil
+}
+
+// errJoinRejected is the error returned when a node of the cluster
+// explicitly refuses to admit this node.
+var errJoinRejected = fmt.Errorf("join request rejected")
 
+// join asks the cluster to admit this node as a voter, trying the given
+// seed nodes in turn and retrying with an increasing delay until one of
+// them accepts; requests reaching a follower are forwarded or redirected
+// to the leader. It gives up if a node rejects the request as invalid.
+func join(seeds []string, raftAddr, nodeID string) error {
+	b, err := json.Marshal(openapi.Node{Id: nodeID, Address: raftAddr, Suffrage: "voter"})
+	if err != nil {
+		log.L.Error("failure marshalling join request body to JSON", zap.Error(err))
+		return err
+	}
+	delay := time.Second
+	for {
+		for _, seed := range seeds {
+			err := sendJoin(seed, b)
+			if err == nil {
+				log.L.Info("node joined cluster", zap.String("seed", seed))
+				return nil
+			}
+			if errors.Is(err, errJoinRejected) {
+				return err
+			}
+			log.L.Warn("join request failed", zap.String("seed", seed), zap.Error(err))
+		}
+		log.L.Debug("no seed accepted the join request, retrying", zap.Duration("delay", delay))
+		time.Sleep(delay)
+		if delay < 30*time.Second {
+			delay *= 2
+		}
+	}
+}
+
+// sendJoin sends the join request to the seed node at the given address;
+// the HTTP client follows the redirects to the leader.
+func sendJoin(seed string, body []byte) error {
+	response, err := http.Post("http://"+seed+"/api/v1/cluster/nodes", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusOK {
+		return nil
+	}
+	// report the reason, as provided by the node
+	reason := openapi.Error{}
+	if err := json.NewDecoder(response.Body).Decode(&reason); err != nil || reason.Message == "" {
+		reason.Message = response.Status
+	}
+	switch response.StatusCode {
+	case http.StatusBadRequest, http.StatusNotFound, http.StatusConflict:
+		return fmt.Errorf("%w by %s: %s", errJoinRejected, seed, reason.Message)
+	}
+	return fmt.Errorf("join request not accepted by %s: %s", seed, reason.Message)
+}
+
+// bootstrapNodes returns the nodes to bootstrap a new cluster with, as
+// specified on the command line and in the bootstrap file; if none is
+// specified, the cluster is bootstrapped with this node only. Each node
+// must have its own ID and address.
+func bootstrapNodes(options Options) ([]cluster.Node, error) {
+	nodes := []cluster.Node{}
+	if options.BootFile != "" {
+		var err error
+		if nodes, err = cluster.LoadNodes(options.BootFile); err != nil {
+			return nil, err
+		}
+	}
+	for _, node := range options.Bootstrap {
+		pair := strings.SplitN(node, "=", 2)
+		if len(pair) != 2 || pair[0] == "" || pair[1] == "" {
+			return nil, fmt.Errorf("invalid bootstrap node specification: %q", node)
+		}
+		nodes = append(nodes, cluster.Node{ID: pair[0], Address: pair[1]})
+	}
+	ids, addresses := map[string]bool{}, map[string]bool{}
+	for _, node := range nodes {
+		if ids[node.ID] {
+			return nil, fmt.Errorf("duplicate bootstrap node ID: %q", node.ID)
+		}
+		if addresses[node.Address] {
+			return nil, fmt.Errorf("duplicate bootstrap node address: %q", node.Address)
+		}
+		ids[node.ID], addresses[node.Address] = true, true
+	}
+	return nodes, nil
+}
+
+// autopilotOptions returns the options of the autopilot, as specified on
+// the command line; pending promotions are kept in the given store.
+func autopilotOptions(options Options, store cluster.PromotionStore) []cluster.AutopilotOption {
+	return []cluster.AutopilotOption{
+		cluster.WithPromotionStore(store),
+		cluster.WithDeadServerThreshold(options.DeadServer),
+		cluster.WithMaxLag(options.MaxLag),
+		cluster.WithStabilizationTime(options.Stabilize),
+	}
+}
+
+// rebalancerOptions returns the options of the leader rebalancer, as
+// specified on the command line.
+func rebalancerOptions(options Options) []cluster.RebalancerOption {
+	return []cluster.RebalancerOption{
+		cluster.WithHysteresis(options.Hysteresis),
+	}
+}
+
+// probe returns the function the autopilot uses to ask the servers for
+// their state, through their APIs.
+func probe(resolve web.LeaderResolver) cluster.StateFunc {
+	return func(server raft.Server) (*cluster.NodeState, error) {
+		address, err := resolve(string(server.Address))
+		if err != nil {
+			return nil, err
+		}
+		return openapi.FetchNodeState(address)
+	}
+}
+
+// parsePeers maps the Raft addresses of the peers (including this node)
+// onto the addresses of their HTTP APIs.
+func parsePeers(options Options) (map[string]string, error) {
+	peers := map[string]string{
+		options.RaftAddress: options.HTTPAddress,
+	}
+	for _, peer := range options.Peers {
+		addresses := strings.SplitN(peer, "=", 2)
+		if len(addresses) != 2 || addresses[0] == "" || addresses[1] == "" {
+			return nil, fmt.Errorf("invalid peer specification: %q", peer)
+		}
+		peers[addresses[0]] = addresses[1]
+	}
+	return peers, nil
+}
+
+// parseTags parses the tags to attach to this node in the registry.
+func parseTags(options Options) (map[string]string, error) {
+	tags := map[string]string{}
+	for _, tag := range options.Tags {
+		pair := strings.SplitN(tag, "=", 2)
+		if len(pair) != 2 || pair[0] == "" {
+			return nil, fmt.Errorf("invalid tag specification: %q", tag)
+		}
+		tags[pair[0]] = pair[1]
+	}
+	return tags, nil
+}
+
+// announce registers this node in the replicated registry, retrying with
+// an increasing delay until it succeeds; since only the leader can write
+// to the registry, followers send their registration to the leader, once
+// the leader has registered itself.
+func announce(store *kvstore.ReplicatedStore, node kvstore.NodeInfo) {
+	delay := time.Second
+	for {
+		err := store.RegisterNode(node)
+		var notLeader *kvstore.NotLeaderError
+		if errors.As(err, &notLeader) && notLeader.Leader != "" {
+			err = register(notLeader.Leader, node)
+		}
+		if err == nil {
+			log.L.Info("node registered", zap.String("id", node.ID), zap.String("http address", node.HTTPAddress))
+			return
+		}
+		log.L.Debug("node not registered yet, retrying", zap.Duration("delay", delay), zap.Error(err))
+		time.Sleep(delay)
+		if delay < 30*time.Second {
+			delay *= 2
+		}
+	}
+}
+
+// register sends the registration of the node to the API of the leader
+// at the given URL.
+func register(leader string, node kvstore.NodeInfo) error {
+	b, err := json.Marshal(openapi.NodeRegistration{
+		Id:          node.ID,
+		RaftAddress: node.RaftAddress,
+		HttpAddress: node.HTTPAddress,
+		GrpcAddress: node.GRPCAddress,
+		Tags:        node.Tags,
+	})
+	if err != nil {
+		log.L.Error("failure marshalling node registration to JSON", zap.Error(err))
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPut, leader+"/api/v1/cluster/registry/"+url.PathEscape(node.ID), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		log.L.Error("failure sending node registration", zap.String("leader", leader), zap.Error(err))
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("node registration rejected by leader at %s: %s", leader, response.Status)
+	}
 	return nil
 }
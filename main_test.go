@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dihedron/brokerd/cluster"
+)
+
+// Test_BootstrapNodes tests that the nodes to bootstrap a cluster with are
+// read from the command line and the bootstrap file, and that each must
+// have its own non-empty ID and address.
+func Test_BootstrapNodes(t *testing.T) {
+	tests := []struct {
+		name      string
+		bootstrap []string
+		file      string
+		expected  []cluster.Node
+		message   string
+	}{
+		{
+			name:     "none",
+			expected: []cluster.Node{},
+		},
+		{
+			name:      "command line",
+			bootstrap: []string{"a=127.0.0.1:7000", "b=127.0.0.1:7001"},
+			expected:  []cluster.Node{{ID: "a", Address: "127.0.0.1:7000"}, {ID: "b", Address: "127.0.0.1:7001"}},
+		},
+		{
+			name:      "file and command line",
+			file:      `[{"id":"a","address":"127.0.0.1:7000"}]`,
+			bootstrap: []string{"b=127.0.0.1:7001"},
+			expected:  []cluster.Node{{ID: "a", Address: "127.0.0.1:7000"}, {ID: "b", Address: "127.0.0.1:7001"}},
+		},
+		{
+			name:      "no separator",
+			bootstrap: []string{"a"},
+			message:   "invalid bootstrap node",
+		},
+		{
+			name:      "empty ID",
+			bootstrap: []string{"=127.0.0.1:7000"},
+			message:   "invalid bootstrap node",
+		},
+		{
+			name:      "empty address",
+			bootstrap: []string{"a="},
+			message:   "invalid bootstrap node",
+		},
+		{
+			name:    "empty ID in file",
+			file:    `[{"id":"","address":"127.0.0.1:7000"}]`,
+			message: "id and address are required",
+		},
+		{
+			name:    "empty address in file",
+			file:    `[{"id":"a"}]`,
+			message: "id and address are required",
+		},
+		{
+			name:      "duplicate ID",
+			bootstrap: []string{"a=127.0.0.1:7000", "a=127.0.0.1:7001"},
+			message:   "duplicate bootstrap node ID",
+		},
+		{
+			name:      "duplicate address",
+			bootstrap: []string{"a=127.0.0.1:7000", "b=127.0.0.1:7000"},
+			message:   "duplicate bootstrap node address",
+		},
+		{
+			name:      "duplicate across file and command line",
+			file:      `[{"id":"a","address":"127.0.0.1:7000"}]`,
+			bootstrap: []string{"a=127.0.0.1:7001"},
+			message:   "duplicate bootstrap node ID",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options := Options{Bootstrap: test.bootstrap}
+			if test.file != "" {
+				options.BootFile = filepath.Join(t.TempDir(), "nodes.json")
+				if err := ioutil.WriteFile(options.BootFile, []byte(test.file), 0o600); err != nil {
+					t.Fatalf("failed to write bootstrap file: %v", err)
+				}
+			}
+			nodes, err := bootstrapNodes(options)
+			if test.message != "" {
+				if err == nil || !strings.Contains(err.Error(), test.message) {
+					t.Fatalf("wrong error: %v (expected %q)", err, test.message)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to read bootstrap nodes: %v", err)
+			}
+			if !reflect.DeepEqual(nodes, test.expected) {
+				t.Fatalf("wrong nodes: %v (expected %v)", nodes, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,2 @@
+-- track the index of the Raft log entry that last modified each pair
+ALTER TABLE pairs ADD COLUMN modified_index INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,12 @@
+-- keep track of the changes to each key, so previous values can be
+-- inspected and restored; the revision is the index of the Raft log
+-- entry that applied the change
+CREATE TABLE IF NOT EXISTS history (
+	key         TEXT NOT NULL,
+	revision    INTEGER NOT NULL,
+	timestamp   INTEGER NOT NULL,
+	operation   TEXT NOT NULL,
+	value       TEXT,
+	previous    TEXT,
+	PRIMARY KEY (key, revision)
+);
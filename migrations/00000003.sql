@@ -0,0 +1,5 @@
+-- the time (in nanoseconds since the epoch) after which a pair is
+-- expired; pairs with no expiry never expire
+ALTER TABLE pairs ADD COLUMN expires_at INTEGER;
+
+CREATE INDEX IF NOT EXISTS pairs_expires_at ON pairs(expires_at);
@@ -0,0 +1,12 @@
+-- the registry of the nodes in the cluster, mapping their Raft address
+-- onto the addresses of the APIs they serve; tags are stored as a JSON
+-- object
+CREATE TABLE IF NOT EXISTS nodes (
+	id              TEXT NOT NULL PRIMARY KEY,
+	raft_address    TEXT NOT NULL,
+	http_address    TEXT,
+	grpc_address    TEXT,
+	tags            TEXT
+);
+
+CREATE INDEX IF NOT EXISTS nodes_raft_address ON nodes(raft_address);
@@ -0,0 +1,6 @@
+-- cluster-wide settings, replicated along with the store; values are
+-- stored as JSON
+CREATE TABLE IF NOT EXISTS settings (
+	name            TEXT NOT NULL PRIMARY KEY,
+	value           TEXT NOT NULL
+);
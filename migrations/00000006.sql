@@ -0,0 +1,8 @@
+-- the index and term of the latest Raft log entry applied to the store,
+-- recorded in the same transaction as its changes; the table holds at
+-- most one row
+CREATE TABLE IF NOT EXISTS applied (
+	id              INTEGER NOT NULL PRIMARY KEY CHECK (id = 0),
+	log_index       INTEGER NOT NULL,
+	log_term        INTEGER NOT NULL
+);
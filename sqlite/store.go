@@ -6,6 +6,7 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"github.com/dihedron/brokerd/log"
 	"github.com/dihedron/brokerd/migrations"
@@ -26,6 +27,9 @@ type Store struct {
 	DataDirectory string
 	// DataFileName is the name of the SQLite3 data file.
 	DataFileName string
+	// lock is held for reading while the database is in use, and for
+	// writing while it is replaced.
+	lock sync.RWMutex
 }
 
 // New creates and initialises a new SQLite-based store.
@@ -56,6 +60,86 @@ func New(options ...Option) (*Store, error) {
 	return store, nil
 }
 
+// Close closes the underlying database.
+func (s *Store) Close() error {
+	if err := s.DB.Close(); err != nil {
+		log.L.Error("error closing database", zap.Error(err))
+		return err
+	}
+	log.L.Debug("database closed")
+	return nil
+}
+
+// RLock locks the database for use, so that it is not replaced until
+// RUnlock is called; DB must only be used while the lock is held, unless
+// from the only goroutine that can replace the database.
+func (s *Store) RLock() {
+	s.lock.RLock()
+}
+
+// RUnlock releases the lock acquired with RLock.
+func (s *Store) RUnlock() {
+	s.lock.RUnlock()
+}
+
+// Backup writes a consistent copy of the whole database to the file at the
+// given path, which must either not exist or be empty.
+func (s *Store) Backup(path string) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if _, err := s.DB.Exec("VACUUM INTO ?", path); err != nil {
+		log.L.Error("error backing up database", zap.String("path", path), zap.Error(err))
+		return err
+	}
+	log.L.Debug("database backed up", zap.String("path", path))
+	return nil
+}
+
+// Replace replaces the database with the one in the file at the given path,
+// e.g. a copy made with Backup: once the database is no longer in use, it
+// is closed, the file is atomically renamed over the data file, and the
+// database is reopened, applying any missing migrations.
+func (s *Store) Replace(path string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	dsn := filepath.Join(s.DataDirectory, s.DataFileName)
+	if err := s.DB.Close(); err != nil {
+		log.L.Error("error closing database", zap.Error(err))
+		return err
+	}
+	// the WAL of the closed database must not be applied to the new one
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if err := os.Remove(dsn + suffix); err != nil && !os.IsNotExist(err) {
+			log.L.Error("error removing database file", zap.String("path", dsn+suffix), zap.Error(err))
+			return s.reopen(dsn, err)
+		}
+	}
+	if err := os.Rename(path, dsn); err != nil {
+		log.L.Error("error replacing database file", zap.String("path", path), zap.Error(err))
+		return s.reopen(dsn, err)
+	}
+	db, err := initialise(dsn, migrations.Migrations)
+	if err != nil {
+		log.L.Error("error reopening database", zap.Error(err))
+		return err
+	}
+	s.DB = db
+	log.L.Info("database replaced", zap.String("path", dsn))
+	return nil
+}
+
+// reopen reopens the current database after a failed replacement, and
+// returns the error that caused it.
+func (s *Store) reopen(dsn string, cause error) error {
+	db, err := initialise(dsn, migrations.Migrations)
+	if err != nil {
+		log.L.Error("error reopening database", zap.Error(err))
+		return cause
+	}
+	s.DB = db
+	return cause
+}
+
 // initialise opens and initialises an SQLite3 DB with all
 // correct settings.
 func initialise(dsn string, migrations fs.FS) (db *sql.DB, err error) {
@@ -0,0 +1,122 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+
+	"github.com/dihedron/brokerd/log"
+	"github.com/dihedron/brokerd/web/openapi"
+	"github.com/gin-gonic/gin"
+	"github.com/hashicorp/raft"
+	"go.uber.org/zap"
+)
+
+// localPrefix is the prefix of the API paths of the operations that act on
+// the node serving the request, which are never forwarded to the leader.
+const localPrefix = "/api/v1/cluster/self"
+
+// ForwardedByHeader is the header that a follower adds to the requests it
+// forwards to the leader; a node receiving a forwarded request that it
+// cannot serve does not forward it again, so that requests cannot bounce
+// between nodes while the leadership is changing.
+const ForwardedByHeader = "X-Brokerd-Forwarded-By"
+
+// forward returns the middleware that, when this node is not the leader,
+// forwards mutating requests to the leader or redirects clients to it,
+// according to the configured forwarding mode; read requests, and those
+// acting on this node only, are always served locally.
+func (w *Server) forward() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if w.forwarding == ForwardingNone || w.resolver == nil || !isMutating(c.Request.Method) ||
+			strings.HasPrefix(c.Request.URL.Path, localPrefix) {
+			c.Next()
+			return
+		}
+		if w.cluster.Raft.State() == raft.Leader {
+			c.Next()
+			return
+		}
+		if by := c.GetHeader(ForwardedByHeader); by != "" {
+			log.L.Warn("forwarded request reached a follower, not forwarding it again", zap.String("forwarded by", by))
+			abortNotLeader(c, fmt.Sprintf("request forwarded by %s but this node is not the leader", by), w.leaderURL())
+			return
+		}
+		leader := string(w.cluster.Raft.Leader())
+		if leader == "" {
+			abortNotLeader(c, "there is no leader in the cluster", "")
+			return
+		}
+		address, err := w.resolver(leader)
+		if err != nil {
+			log.L.Error("error resolving leader API address", zap.String("leader", leader), zap.Error(err))
+			abortNotLeader(c, fmt.Sprintf("the API address of the leader (%s) is unknown", leader), w.leaderURL())
+			return
+		}
+		switch w.forwarding {
+		case ForwardingRedirect:
+			location := "http://" + address + c.Request.URL.RequestURI()
+			log.L.Debug("redirecting request to leader", zap.String("location", location))
+			c.Redirect(http.StatusTemporaryRedirect, location)
+			c.Abort()
+		case ForwardingProxy:
+			log.L.Debug("forwarding request to leader", zap.String("address", address), zap.String("path", c.Request.URL.Path))
+			proxy := &httputil.ReverseProxy{
+				Director: func(request *http.Request) {
+					request.URL.Scheme = "http"
+					request.URL.Host = address
+					request.Host = address
+					request.Header.Set(ForwardedByHeader, w.cluster.NodeID)
+				},
+				ErrorHandler: func(rw http.ResponseWriter, request *http.Request, err error) {
+					log.L.Error("error forwarding request to leader", zap.String("address", address), zap.Error(err))
+					c.AbortWithStatusJSON(http.StatusBadGateway, openapi.Error{
+						Code:    "bad gateway",
+						Message: err.Error(),
+					})
+				},
+			}
+			proxy.ServeHTTP(c.Writer, c.Request)
+			c.Abort()
+		default:
+			c.Next()
+		}
+	}
+}
+
+// isMutating checks whether requests with the given method change the
+// state of the store, and can therefore only be served by the leader.
+func isMutating(method string) bool {
+	return method == http.MethodPost || method == http.MethodPut || method == http.MethodDelete || method == http.MethodPatch
+}
+
+// leaderURL returns the URL of the HTTP API of the leader, as recorded in
+// the registry, or the empty string if it is not known.
+func (w *Server) leaderURL() string {
+	leader := string(w.cluster.Raft.Leader())
+	if leader == "" {
+		return ""
+	}
+	nodes, err := w.store.Nodes()
+	if err != nil {
+		log.L.Error("error reading node registry", zap.Error(err))
+		return ""
+	}
+	for _, node := range nodes {
+		if node.RaftAddress == leader {
+			return node.URL()
+		}
+	}
+	return ""
+}
+
+// abortNotLeader writes a "not leader" error to the client, along with the
+// URL of the leader API, if known.
+func abortNotLeader(c *gin.Context, message string, leader string) {
+	c.AbortWithStatusJSON(http.StatusServiceUnavailable, openapi.Error{
+		Code:    "not leader",
+		Message: message,
+		Leader:  leader,
+	})
+}
@@ -0,0 +1,175 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dihedron/brokerd/cluster"
+	"github.com/dihedron/brokerd/kvstore"
+	"github.com/dihedron/brokerd/sqlite"
+	"github.com/dihedron/brokerd/web/openapi"
+	"github.com/gin-gonic/gin"
+	"github.com/hashicorp/raft"
+)
+
+// newTestFollower creates a cluster of two in-memory Raft nodes, where
+// "node0" is the leader, and returns the cluster as seen by "node1", the
+// follower.
+func newTestFollower(t *testing.T) *cluster.Cluster {
+	t.Helper()
+	rafts := []*raft.Raft{}
+	transports := []*raft.InmemTransport{}
+	for i := 0; i < 2; i++ {
+		id := fmt.Sprintf("node%d", i)
+		address, transport := raft.NewInmemTransport(raft.ServerAddress(id))
+		for _, other := range transports {
+			transport.Connect(other.LocalAddr(), other)
+			other.Connect(address, transport)
+		}
+		transports = append(transports, transport)
+		config := raft.DefaultConfig()
+		config.LocalID = raft.ServerID(id)
+		config.HeartbeatTimeout = 50 * time.Millisecond
+		config.ElectionTimeout = 50 * time.Millisecond
+		config.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.CommitTimeout = 5 * time.Millisecond
+		config.LogOutput = ioutil.Discard
+		r, err := raft.NewRaft(config, &raft.MockFSM{}, raft.NewInmemStore(), raft.NewInmemStore(), raft.NewInmemSnapshotStore(), transport)
+		if err != nil {
+			t.Fatalf("failed to create Raft node %s: %v", id, err)
+		}
+		t.Cleanup(func() { r.Shutdown().Error() })
+		rafts = append(rafts, r)
+	}
+	configuration := raft.Configuration{Servers: []raft.Server{{ID: "node0", Address: "node0"}}}
+	if err := rafts[0].BootstrapCluster(configuration).Error(); err != nil {
+		t.Fatalf("failed to bootstrap cluster: %v", err)
+	}
+	waitFor(t, func() bool { return rafts[0].State() == raft.Leader })
+	if err := rafts[0].AddVoter("node1", "node1", 0, 0).Error(); err != nil {
+		t.Fatalf("failed to add voter: %v", err)
+	}
+	waitFor(t, func() bool { return rafts[1].Leader() == "node0" })
+	return &cluster.Cluster{NodeID: "node1", Raft: rafts[1]}
+}
+
+// waitFor waits for the condition to hold, failing the test if it does
+// not within a few seconds.
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if condition() {
+			return
+		}
+	}
+	t.Fatalf("condition not met in time")
+}
+
+// Test_Forward tests that the mutating requests received by a follower are
+// forwarded or redirected to the leader, according to the forwarding mode,
+// unless they have been forwarded already.
+func Test_Forward(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	follower := newTestFollower(t)
+
+	// the leader API records the requests it receives
+	var forwardedBy string
+	leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwardedBy = r.Header.Get(ForwardedByHeader)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, "leader")
+	}))
+	defer leader.Close()
+	address := strings.TrimPrefix(leader.URL, "http://")
+
+	store, err := kvstore.NewLocalStore(sqlite.WithStoreDirectory(t.TempDir()))
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	defer store.Close()
+	if err := store.RegisterNode(kvstore.NodeInfo{ID: "node0", RaftAddress: "node0", HTTPAddress: address}); err != nil {
+		t.Fatalf("failed to register leader: %v", err)
+	}
+	resolver := func(raftAddress string) (string, error) {
+		if raftAddress != "node0" {
+			return "", kvstore.ErrNodeNotFound
+		}
+		return address, nil
+	}
+
+	tests := []struct {
+		name        string
+		forwarding  Forwarding
+		method      string
+		forwardedBy string
+		status      int
+		body        string
+		location    string
+		leader      string
+		forwarded   string
+	}{
+		{name: "proxy", forwarding: ForwardingProxy, method: http.MethodPost, status: http.StatusCreated, body: "leader", forwarded: "node1"},
+		{name: "redirect", forwarding: ForwardingRedirect, method: http.MethodPost, status: http.StatusTemporaryRedirect, location: leader.URL + "/api/v1/properties?x=1"},
+		{name: "none", forwarding: ForwardingNone, method: http.MethodPost, status: http.StatusOK, body: "follower"},
+		{name: "read", forwarding: ForwardingProxy, method: http.MethodGet, status: http.StatusOK, body: "follower"},
+		{name: "loop", forwarding: ForwardingProxy, method: http.MethodPost, forwardedBy: "node2", status: http.StatusServiceUnavailable, leader: leader.URL},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			forwardedBy = ""
+			w := &Server{store: store, cluster: follower, forwarding: test.forwarding, resolver: resolver}
+			router := gin.New()
+			router.Use(w.forward())
+			router.Any("/api/v1/properties", func(c *gin.Context) {
+				c.String(http.StatusOK, "follower")
+			})
+			server := httptest.NewServer(router)
+			defer server.Close()
+
+			request, err := http.NewRequest(test.method, server.URL+"/api/v1/properties?x=1", nil)
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+			if test.forwardedBy != "" {
+				request.Header.Set(ForwardedByHeader, test.forwardedBy)
+			}
+			client := &http.Client{
+				CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+			}
+			response, err := client.Do(request)
+			if err != nil {
+				t.Fatalf("failed to send request: %v", err)
+			}
+			defer response.Body.Close()
+			body, _ := ioutil.ReadAll(response.Body)
+
+			if response.StatusCode != test.status {
+				t.Fatalf("wrong status: %d (expected %d)", response.StatusCode, test.status)
+			}
+			if test.body != "" && string(body) != test.body {
+				t.Fatalf("wrong body: %q (expected %q)", body, test.body)
+			}
+			if location := response.Header.Get("Location"); location != test.location {
+				t.Fatalf("wrong location: %q (expected %q)", location, test.location)
+			}
+			if test.leader != "" {
+				var e openapi.Error
+				if err := json.Unmarshal(body, &e); err != nil {
+					t.Fatalf("failed to parse error: %v", err)
+				}
+				if e.Leader != test.leader {
+					t.Fatalf("wrong leader: %q (expected %q)", e.Leader, test.leader)
+				}
+			}
+			if forwardedBy != test.forwarded {
+				t.Fatalf("wrong forwarding node: %q (expected %q)", forwardedBy, test.forwarded)
+			}
+		})
+	}
+}
@@ -11,12 +11,370 @@
 package openapi
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/dihedron/brokerd/cluster"
+	"github.com/dihedron/brokerd/kvstore"
+	"github.com/dihedron/brokerd/log"
 	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
 )
 
+// nodeStateTimeout is the maximum time to wait for a node to report its
+// state.
+const nodeStateTimeout = 2 * time.Second
+
+// nodeStatuses are the values accepted by the status filter.
+var nodeStatuses = map[string]bool{
+	"leader":    true,
+	"follower":  true,
+	"candidate": true,
+}
+
+// AddNode - Add a node to the Raft cluster.
+//
+// The node is added as a voter, unless its suffrage is "nonvoter", in
+// which case it is added as a read replica that takes no part in elections.
+func AddNode(c *gin.Context) {
+	var node Node
+	if err := c.ShouldBindJSON(&node); err != nil {
+		abortWithError(c, http.StatusBadRequest, "bad request", err.Error())
+		return
+	}
+	if node.Id == "" || node.Address == "" {
+		abortWithError(c, http.StatusBadRequest, "bad request", "the node id and address must be specified")
+		return
+	}
+	var err error
+	switch node.Suffrage {
+	case "", "voter":
+		node.Suffrage = "voter"
+		err = getCluster(c).Join(node.Id, node.Address)
+	case "nonvoter":
+		err = getCluster(c).AddNonvoter(node.Id, node.Address)
+	default:
+		abortWithError(c, http.StatusBadRequest, "bad request", "the suffrage must be either voter or nonvoter")
+		return
+	}
+	if err != nil {
+		abortWithClusterError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, Node{
+		Id:       node.Id,
+		Address:  node.Address,
+		Suffrage: node.Suffrage,
+	})
+}
+
+// RemoveNode - Remove a node from the Raft cluster.
+func RemoveNode(c *gin.Context) {
+	force, err := getForce(c)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, "bad request", err.Error())
+		return
+	}
+	if err := getCluster(c).RemoveNode(c.Param("id"), force); err != nil {
+		abortWithClusterError(c, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// DemoteNode - Turn a voter into a non-voter.
+func DemoteNode(c *gin.Context) {
+	force, err := getForce(c)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, "bad request", err.Error())
+		return
+	}
+	if err := getCluster(c).DemoteNode(c.Param("id"), force); err != nil {
+		abortWithClusterError(c, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// getForce retrieves the force query parameter, which overrides the
+// quorum safety checks on membership changes.
+func getForce(c *gin.Context) (bool, error) {
+	force, err := strconv.ParseBool(c.DefaultQuery("force", "false"))
+	if err != nil {
+		return false, fmt.Errorf("the force parameter must be a boolean")
+	}
+	return force, nil
+}
+
+// TransferLeadership - Move the leadership to another node.
+//
+// The response is only sent once the new leader is confirmed, so that
+// the former leader can be safely taken down for maintenance.
+func TransferLeadership(c *gin.Context) {
+	var transfer LeadershipTransfer
+	// the body is optional
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&transfer); err != nil {
+			abortWithError(c, http.StatusBadRequest, "bad request", err.Error())
+			return
+		}
+	}
+	leader, err := getCluster(c).TransferLeadership(transfer.Id)
+	if err != nil {
+		abortWithClusterError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, Node{
+		Id:       string(leader.ID),
+		Address:  string(leader.Address),
+		Status:   "leader",
+		Suffrage: strings.ToLower(leader.Suffrage.String()),
+	})
+}
+
+// GetLeaderPreference - Return the nodes that should lead the cluster.
+func GetLeaderPreference(c *gin.Context) {
+	ids, err := getCluster(c).LeaderPreference()
+	if err != nil {
+		abortWithStoreError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, LeaderPreference{Nodes: ids})
+}
+
+// SetLeaderPreference - Set the nodes that should lead the cluster.
+//
+// The preference is replicated to all nodes; the leader hands the
+// leadership over to the most preferred node once it is healthy.
+func SetLeaderPreference(c *gin.Context) {
+	var preference LeaderPreference
+	if err := c.ShouldBindJSON(&preference); err != nil {
+		abortWithError(c, http.StatusBadRequest, "bad request", err.Error())
+		return
+	}
+	if preference.Nodes == nil {
+		preference.Nodes = []string{}
+	}
+	if err := getStore(c).SetLeaderPreference(preference.Nodes); err != nil {
+		abortWithStoreError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, preference)
+}
+
+// GetSelf - Return the state of this node.
+func GetSelf(c *gin.Context) {
+	self := getCluster(c).Self()
+	c.JSON(http.StatusOK, nodeFromState(self))
+}
+
+// GetAutopilotState - Return the health of the cluster, as tracked by the autopilot.
+func GetAutopilotState(c *gin.Context) {
+	cluster := getCluster(c)
+	if cluster.Autopilot == nil {
+		abortWithError(c, http.StatusNotFound, "not found", "the autopilot is not enabled")
+		return
+	}
+	state, err := cluster.Autopilot.State()
+	if err != nil {
+		abortWithClusterError(c, err)
+		return
+	}
+	result := AutopilotState{
+		Healthy:          state.Healthy,
+		FailureTolerance: state.FailureTolerance,
+		Servers:          make([]ServerHealth, 0, len(state.Servers)),
+	}
+	for _, server := range state.Servers {
+		health := ServerHealth{
+			Id:          server.ID,
+			Address:     server.Address,
+			Suffrage:    strings.ToLower(server.Suffrage.String()),
+			Status:      server.State,
+			Healthy:     server.Healthy,
+			Lag:         server.Lag,
+			StableSince: server.StableSince,
+			Error:       server.Error,
+		}
+		if server.LastContact >= 0 {
+			contact := server.LastContact.Milliseconds()
+			health.LastContact = &contact
+		}
+		result.Servers = append(result.Servers, health)
+	}
+	c.JSON(http.StatusOK, result)
+}
+
 // ListNodes - Return the list of all nodes in the Raft cluster.
+//
+// The nodes are those in the current Raft configuration; the state of
+// each node is reported by the node itself, through its API as recorded
+// in the node registry. If a node cannot be reached, only its state as
+// known to this node is returned.
 func ListNodes(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{})
+	status := c.Query("status")
+	if status != "" && !nodeStatuses[status] {
+		abortWithError(c, http.StatusBadRequest, "bad request", "the status must be one of leader, follower or candidate")
+		return
+	}
+	cluster := getCluster(c)
+	servers, err := cluster.Servers()
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, "internal error", err.Error())
+		return
+	}
+	registry, err := getStore(c).Nodes()
+	if err != nil {
+		abortWithStoreError(c, err)
+		return
+	}
+	addresses := map[string]string{}
+	for _, node := range registry {
+		addresses[node.ID] = node.HTTPAddress
+	}
+	leader := string(cluster.Raft.Leader())
+
+	nodes := make([]Node, len(servers))
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		nodes[i] = Node{
+			Id:       string(server.ID),
+			Address:  string(server.Address),
+			Suffrage: strings.ToLower(server.Suffrage.String()),
+		}
+		if string(server.Address) == leader {
+			nodes[i].Status = "leader"
+		}
+		if string(server.ID) == cluster.NodeID {
+			setState(&nodes[i], nodeFromState(cluster.Self()))
+			continue
+		}
+		if address := addresses[string(server.ID)]; address != "" {
+			wg.Add(1)
+			go func(node *Node, address string) {
+				defer wg.Done()
+				state, err := FetchNodeState(address)
+				if err != nil {
+					log.L.Warn("error retrieving node state", zap.String("id", node.Id), zap.String("address", address), zap.Error(err))
+					return
+				}
+				setState(node, nodeFromState(*state))
+			}(&nodes[i], address)
+		}
+	}
+	wg.Wait()
+
+	result := make([]Node, 0, len(nodes))
+	for _, node := range nodes {
+		if status == "" || node.Status == status {
+			result = append(result, node)
+		}
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// nodeFromState converts the state of a node into the Node model.
+func nodeFromState(state cluster.NodeState) Node {
+	node := Node{
+		Id:           state.ID,
+		Address:      state.Address,
+		Status:       state.State,
+		AppliedIndex: state.AppliedIndex,
+		CommitIndex:  state.CommitIndex,
+	}
+	if state.LastContact >= 0 {
+		contact := state.LastContact.Milliseconds()
+		node.LastContact = &contact
+	}
+	return node
+}
+
+// setState copies the state reported by a node into its Node model.
+func setState(node *Node, state Node) {
+	node.Status = state.Status
+	node.LastContact = state.LastContact
+	node.AppliedIndex = state.AppliedIndex
+	node.CommitIndex = state.CommitIndex
+}
+
+// FetchNodeState asks the node whose API is at the given address to
+// report its own state.
+func FetchNodeState(address string) (*cluster.NodeState, error) {
+	client := http.Client{Timeout: nodeStateTimeout}
+	response, err := client.Get("http://" + address + "/api/v1/cluster/self")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response: %s", response.Status)
+	}
+	node := Node{}
+	if err := json.NewDecoder(response.Body).Decode(&node); err != nil {
+		return nil, err
+	}
+	state := &cluster.NodeState{
+		ID:           node.Id,
+		Address:      node.Address,
+		State:        node.Status,
+		LastContact:  -1,
+		AppliedIndex: node.AppliedIndex,
+		CommitIndex:  node.CommitIndex,
+	}
+	if node.LastContact != nil {
+		state.LastContact = time.Duration(*node.LastContact) * time.Millisecond
+	}
+	return state, nil
+}
+
+// ListRegisteredNodes - Return the nodes in the registry.
+func ListRegisteredNodes(c *gin.Context) {
+	nodes, err := getStore(c).Nodes()
+	if err != nil {
+		abortWithStoreError(c, err)
+		return
+	}
+	registrations := make([]NodeRegistration, 0, len(nodes))
+	for _, node := range nodes {
+		registrations = append(registrations, NodeRegistration{
+			Id:          node.ID,
+			RaftAddress: node.RaftAddress,
+			HttpAddress: node.HTTPAddress,
+			GrpcAddress: node.GRPCAddress,
+			Tags:        node.Tags,
+		})
+	}
+	c.JSON(http.StatusOK, registrations)
+}
+
+// RegisterNode - Add a node to the registry, or update its information.
+func RegisterNode(c *gin.Context) {
+	id := c.Param("id")
+	var registration NodeRegistration
+	if err := c.ShouldBindJSON(&registration); err != nil {
+		abortWithError(c, http.StatusBadRequest, "bad request", err.Error())
+		return
+	}
+	if registration.Id != "" && registration.Id != id {
+		abortWithError(c, http.StatusBadRequest, "bad request", "the node id does not match the id in the path")
+		return
+	}
+	registration.Id = id
+	err := getStore(c).RegisterNode(kvstore.NodeInfo{
+		ID:          registration.Id,
+		RaftAddress: registration.RaftAddress,
+		HTTPAddress: registration.HttpAddress,
+		GRPCAddress: registration.GrpcAddress,
+		Tags:        registration.Tags,
+	})
+	if err != nil {
+		abortWithStoreError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, registration)
 }
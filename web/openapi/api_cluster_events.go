@@ -0,0 +1,145 @@
+/*
+ * Brokerd API
+ *
+ * This API allows to interact with the `brokerd` daemon in its three different capacities:  1. as a **key/value store for properties**, holding key/value pairs; 2. as a **Raft cluster member**, through cluster managemenet APIs thata llow to check the state and   interact with the cluster (e.g. moving the master to another node, forcing a sync-up of the   cluster nodes, etc.) 3. as a **relational store for virtual machines and network ports**, as reported by OpenStack via its    notification exchanges inside RabbitMQ.  The **Properties API** allows to manage the lifecycle of key/value pairs; the kes part can encode a pseudo-hierarchical organisation of the information by adopting conventional characters as field separators, the way it is usually done in Java properties files, e.g.: ``` key-part-1.key-part-2.key-part-3....key-part-N=value ```  where each part of the key (`key-part-X`) can encode some part of a taxonomy.  The **Cluster API** provides a way to interact with the Raft cluster that guarantees that the Finite State Machines (FSM) holding the state of the several `brokerd` instances running on different  OpenStack controller nodes are all kept in sync and moving in lock-step. Through the API it is possible  to check the health and the status (*leader*, *follower*) of the nodes in the cluster, move the cluster leadership from the current master to a different node, force a sync-up of the cluster nodes, trigger the snaphotting of the current FSM state, etc.  The **Store API** provides a way to interact with the SQLite database holding information about  Virtual Machines and Network Ports.
+ *
+ * API version: 1.0
+ * Contact: support@example.com
+ * Generated by: OpenAPI Generator (https://openapi-generator.tech)
+ */
+
+package openapi
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dihedron/brokerd/cluster"
+	"github.com/gin-gonic/gin"
+)
+
+// clusterEventTypes are the values accepted by the type filter.
+var clusterEventTypes = map[string]bool{
+	string(cluster.EventLeaderElected):    true,
+	string(cluster.EventLeaderLost):       true,
+	string(cluster.EventStateChanged):     true,
+	string(cluster.EventPeerAdded):        true,
+	string(cluster.EventPeerRemoved):      true,
+	string(cluster.EventHeartbeatFailed):  true,
+	string(cluster.EventHeartbeatResumed): true,
+	string(cluster.EventSnapshotTaken):    true,
+	string(cluster.EventSnapshotRestored): true,
+}
+
+// ListClusterEvents - Return the history of the cluster events observed by this node.
+func ListClusterEvents(c *gin.Context) {
+	since, kind, err := getEventFilter(c, c.Query("since"))
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, "bad request", err.Error())
+		return
+	}
+	events, _, _, _ := getCluster(c).Events.Since(since)
+	result := []ClusterEvent{}
+	for _, event := range events {
+		if kind == "" || string(event.Type) == kind {
+			result = append(result, clusterEvent(event))
+		}
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// StreamClusterEvents - Stream the cluster events observed by this node as Server-Sent Events.
+//
+// Each cluster event is sent as an "event" event, whose ID is its sequence
+// number; clients can resume from the last sequence number they received,
+// either through the since query parameter or the Last-Event-ID header.
+// If none is given, only the events from now on are streamed. If some of
+// the requested events have already been dropped from the history, a
+// "dropped" event is sent with the sequence number the stream can be
+// resumed from, and the stream is closed.
+func StreamClusterEvents(c *gin.Context) {
+	value := c.Query("since")
+	if value == "" {
+		value = c.GetHeader("Last-Event-ID")
+	}
+	since, kind, err := getEventFilter(c, value)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, "bad request", err.Error())
+		return
+	}
+	history := getCluster(c).Events
+	if value == "" {
+		// only stream the events from now on
+		_, since, _, _ = history.Since(^uint64(0))
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	stopping := getStopping(c)
+	ticker := time.NewTicker(watchKeepAlive)
+	defer ticker.Stop()
+	for {
+		events, sequence, wait, err := history.Since(since)
+		if errors.Is(err, cluster.ErrEventsDropped) {
+			c.SSEvent("dropped", gin.H{"sequence": events[0].Sequence - 1})
+			c.Writer.Flush()
+			return
+		}
+		for _, event := range events {
+			if kind == "" || string(event.Type) == kind {
+				c.Writer.WriteString("id:" + strconv.FormatUint(event.Sequence, 10) + "\n")
+				c.SSEvent("event", clusterEvent(event))
+			}
+		}
+		since = sequence
+		c.Writer.Flush()
+		select {
+		case <-wait:
+		case <-ticker.C:
+			c.Writer.WriteString(": keep-alive\n\n")
+			c.Writer.Flush()
+		case <-c.Request.Context().Done():
+			return
+		case <-stopping:
+			return
+		}
+	}
+}
+
+// getEventFilter parses the sequence number after which events are
+// requested, and retrieves the type of the requested events.
+func getEventFilter(c *gin.Context, value string) (uint64, string, error) {
+	var since uint64
+	if value != "" {
+		var err error
+		if since, err = strconv.ParseUint(value, 10, 64); err != nil {
+			return 0, "", fmt.Errorf("the sequence number must be a non-negative integer")
+		}
+	}
+	kind := c.Query("type")
+	if kind != "" && !clusterEventTypes[kind] {
+		return 0, "", fmt.Errorf("unknown event type: %s", kind)
+	}
+	return since, kind, nil
+}
+
+// clusterEvent converts a cluster event into the ClusterEvent model.
+func clusterEvent(event cluster.Event) ClusterEvent {
+	return ClusterEvent{
+		Sequence:  event.Sequence,
+		Type:      string(event.Type),
+		Timestamp: event.Timestamp,
+		Term:      event.Term,
+		NodeId:    event.NodeID,
+		Address:   event.Address,
+		State:     event.State,
+		Error:     event.Error,
+	}
+}
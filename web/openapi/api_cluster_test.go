@@ -0,0 +1,70 @@
+package openapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dihedron/brokerd/kvstore"
+	"github.com/hashicorp/raft"
+)
+
+// Test_ListNodes tests that the nodes in the cluster are listed with their
+// status, as reported by the nodes themselves, and filtered by status.
+func Test_ListNodes(t *testing.T) {
+	leader, store := newTestCluster(t)
+	follower, followerStore := newTestNode(t, "node1")
+	api := httptest.NewServer(newTestRouter(followerStore, follower))
+	defer api.Close()
+	if err := leader.Join("node1", string(follower.Transport.LocalAddr())); err != nil {
+		t.Fatalf("failed to join node: %v", err)
+	}
+	// node2 is not running, and its API is not known
+	if err := leader.Raft.AddNonvoter("node2", "127.0.0.1:1", 0, 0).Error(); err != nil {
+		t.Fatalf("failed to add non-voter: %v", err)
+	}
+	if err := store.RegisterNode(kvstore.NodeInfo{ID: "node1", RaftAddress: string(follower.Transport.LocalAddr()), HTTPAddress: strings.TrimPrefix(api.URL, "http://")}); err != nil {
+		t.Fatalf("failed to register node: %v", err)
+	}
+	waitFor(t, func() bool { return follower.Raft.Leader() == leader.Transport.LocalAddr() })
+
+	tests := []struct {
+		name     string
+		status   string
+		code     int
+		expected []string
+	}{
+		{"any", "", http.StatusOK, []string{"node0 leader", "node1 follower", "node2 "}},
+		{"leader", "leader", http.StatusOK, []string{"node0 leader"}},
+		{"follower", "follower", http.StatusOK, []string{"node1 follower"}},
+		{"candidate", "candidate", http.StatusOK, []string{}},
+		{"wrong case", "Leader", http.StatusBadRequest, nil},
+		{"unknown", "unknown", http.StatusBadRequest, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := serve(store, leader, http.MethodGet, "/api/v1/cluster/nodes?status="+test.status, nil)
+			assertStatus(t, response, test.code)
+			if test.code != http.StatusOK {
+				return
+			}
+			nodes := []Node{}
+			if err := json.Unmarshal(response.Body.Bytes(), &nodes); err != nil {
+				t.Fatalf("failed to parse nodes: %v", err)
+			}
+			actual := []string{}
+			for _, node := range nodes {
+				actual = append(actual, node.Id+" "+node.Status)
+			}
+			if !reflect.DeepEqual(actual, test.expected) {
+				t.Fatalf("wrong nodes: %v (expected %v)", actual, test.expected)
+			}
+		})
+	}
+	if leader.Raft.State() != raft.Leader {
+		t.Fatal("leadership lost during the test")
+	}
+}
@@ -11,37 +11,304 @@
 package openapi
 
 import (
+	"encoding/base64"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/dihedron/brokerd/kvstore"
 	"github.com/gin-gonic/gin"
 )
 
 // CreateProperty - Create a new property.
 func CreateProperty(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{})
+	var property Property
+	if err := c.ShouldBindJSON(&property); err != nil {
+		abortWithError(c, http.StatusBadRequest, "bad request", err.Error())
+		return
+	}
+	if property.Key == "" {
+		abortWithError(c, http.StatusBadRequest, "bad request", "the property key must be specified")
+		return
+	}
+	if property.Ttl < 0 {
+		abortWithError(c, http.StatusBadRequest, "bad request", "the property time to live must not be negative")
+		return
+	}
+	// the property is only created if it does not exist yet; the check
+	// and the creation are performed atomically by the store
+	result, err := getStore(c).Transact(kvstore.Transaction{
+		Guards: []kvstore.Guard{
+			{Type: kvstore.Absent, Key: property.Key},
+		},
+		Operations: []kvstore.Operation{
+			{Type: kvstore.Set, Key: property.Key, Value: property.Value, TTL: time.Duration(property.Ttl) * time.Second},
+		},
+	})
+	if err != nil {
+		abortWithStoreError(c, err)
+		return
+	}
+	if !result.Committed {
+		abortWithError(c, http.StatusConflict, "conflict", "a property with the given key already exists")
+		return
+	}
+	c.Header("Location", "/api/v1/settings/"+property.Key)
+	c.Header("ETag", formatETag(result.Index))
+	c.JSON(http.StatusCreated, property)
 }
 
 // DeleteProperties - Delete multiple properties.
+//
+// All the properties selected by the filter are deleted atomically; to
+// delete all properties, no filter must be specified and all must be true,
+// so that an empty filter cannot wipe out the store by mistake.
 func DeleteProperties(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{})
+	filter := kvstore.Filter{
+		Prefix:  c.Query("prefix"),
+		Start:   c.Query("start"),
+		End:     c.Query("end"),
+		Pattern: c.Query("pattern"),
+	}
+	all, err := strconv.ParseBool(c.DefaultQuery("all", "false"))
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, "bad request", "all must be either true or false")
+		return
+	}
+	if filter == (kvstore.Filter{}) && !all {
+		abortWithError(c, http.StatusBadRequest, "bad request", "a non-empty filter is required, unless all is true")
+		return
+	}
+	count, err := getStore(c).DeleteMatching(filter)
+	if err != nil {
+		abortWithStoreError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"deleted": count,
+	})
 }
 
 // DeleteProperty - Delete a property given its key.
 func DeleteProperty(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{})
+	key := c.Param("key")
+	if _, ok := modifyExisting(c, kvstore.Operation{Type: kvstore.Delete, Key: key}); !ok {
+		return
+	}
+	c.Status(http.StatusOK)
 }
 
 // GetProperty - Retrieve the value of a specific property.
 func GetProperty(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{})
+	key := c.Param("key")
+	level, err := getConsistency(c)
+	if err != nil {
+		abortWithStoreError(c, err)
+		return
+	}
+	setApplied(c)
+	pair, err := getStore(c).Lookup(key, level)
+	if err != nil {
+		abortWithStoreError(c, err)
+		return
+	}
+	c.Header("ETag", formatETag(pair.Index))
+	if tag := c.GetHeader("If-None-Match"); tag != "" {
+		if index, err := ParseETag(tag, true); tag == "*" || (err == nil && index == pair.Index) {
+			c.Status(http.StatusNotModified)
+			return
+		}
+	}
+	c.JSON(http.StatusOK, Property{
+		Key:   pair.Key,
+		Value: pair.Value,
+		Ttl:   remainingTTL(pair),
+	})
+}
+
+// GetPropertyHistory - Retrieve the history of the changes to a property.
+func GetPropertyHistory(c *gin.Context) {
+	key := c.Param("key")
+	setApplied(c)
+	history, err := getStore(c).History(key)
+	if err != nil {
+		abortWithStoreError(c, err)
+		return
+	}
+	revisions := make([]Revision, 0, len(history))
+	for _, revision := range history {
+		revisions = append(revisions, Revision{
+			Key:       revision.Key,
+			Revision:  revision.Index,
+			Timestamp: revision.Timestamp,
+			Operation: revision.Operation,
+			Value:     revision.Value,
+			Previous:  revision.Previous,
+		})
+	}
+	c.JSON(http.StatusOK, revisions)
 }
 
 // ListProperties - Return a (possibly filtered) list of properties.
+//
+// Properties are returned in lexical order of their keys; when a limit
+// is specified and there are more properties to retrieve, the cursor to
+// the following page is returned in the X-Next-Cursor header. Paging by
+// cursor is stable even when properties are being added or removed,
+// whereas paging by offset may skip or repeat properties.
 func ListProperties(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{})
+	filter := kvstore.Filter{
+		Prefix:  c.Query("prefix"),
+		Start:   c.Query("start"),
+		End:     c.Query("end"),
+		Pattern: c.Query("pattern"),
+	}
+	level, err := getConsistency(c)
+	if err != nil {
+		abortWithStoreError(c, err)
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "0"))
+	if err != nil || limit < 0 {
+		abortWithError(c, http.StatusBadRequest, "bad request", "the limit must be a non-negative integer")
+		return
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		abortWithError(c, http.StatusBadRequest, "bad request", "the offset must be a non-negative integer")
+		return
+	}
+	cursor, err := base64.RawURLEncoding.DecodeString(c.Query("cursor"))
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, "bad request", "the cursor is not valid")
+		return
+	}
+	if offset > 0 && (limit == 0 || len(cursor) > 0) {
+		abortWithError(c, http.StatusBadRequest, "bad request", "the offset requires a limit and cannot be used with a cursor")
+		return
+	}
+	setApplied(c)
+	// the offset is the number of the page, thus all the pairs in the
+	// preceding pages must be skipped
+	pairs, next, err := getStore(c).List(filter, string(cursor), (offset+1)*limit, level)
+	if err != nil {
+		abortWithStoreError(c, err)
+		return
+	}
+	if skip := offset * limit; skip < len(pairs) {
+		pairs = pairs[skip:]
+	} else {
+		pairs = pairs[:0]
+	}
+	if next != "" {
+		c.Header("X-Next-Cursor", base64.RawURLEncoding.EncodeToString([]byte(next)))
+	}
+	properties := make([]Property, 0, len(pairs))
+	for _, pair := range pairs {
+		properties = append(properties, Property{
+			Key:   pair.Key,
+			Value: pair.Value,
+			Ttl:   remainingTTL(&pair),
+		})
+	}
+	c.JSON(http.StatusOK, properties)
+}
+
+// RollbackProperty - Restore a property to a previous revision.
+func RollbackProperty(c *gin.Context) {
+	key := c.Param("key")
+	var rollback Rollback
+	if err := c.ShouldBindJSON(&rollback); err != nil {
+		abortWithError(c, http.StatusBadRequest, "bad request", err.Error())
+		return
+	}
+	index, err := getStore(c).Rollback(key, rollback.Revision)
+	if err != nil {
+		abortWithStoreError(c, err)
+		return
+	}
+	c.Header("ETag", formatETag(index))
+	c.Status(http.StatusOK)
 }
 
 // UpdateProperty - Update the value of an existing property.
 func UpdateProperty(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{})
+	key := c.Param("key")
+	var property Property
+	if err := c.ShouldBindJSON(&property); err != nil {
+		abortWithError(c, http.StatusBadRequest, "bad request", err.Error())
+		return
+	}
+	if property.Key != "" && property.Key != key {
+		abortWithError(c, http.StatusBadRequest, "bad request", "the property key does not match the key in the path")
+		return
+	}
+	if property.Ttl < 0 {
+		abortWithError(c, http.StatusBadRequest, "bad request", "the property time to live must not be negative")
+		return
+	}
+	property.Key = key
+	result, ok := modifyExisting(c, kvstore.Operation{Type: kvstore.Set, Key: key, Value: property.Value, TTL: time.Duration(property.Ttl) * time.Second})
+	if !ok {
+		return
+	}
+	c.Header("ETag", formatETag(result.Index))
+	c.JSON(http.StatusOK, property)
+}
+
+// modifyExisting applies the operation to an existing property, provided
+// that the preconditions in the If-Match and If-None-Match headers hold;
+// the existence of the property and the preconditions are checked by the
+// store atomically with the operation. If the operation cannot be applied,
+// the appropriate error is written to the client and false is returned.
+func modifyExisting(c *gin.Context, operation kvstore.Operation) (*kvstore.TransactionResult, bool) {
+	guards, err := preconditions(c, operation.Key)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, "bad request", err.Error())
+		return nil, false
+	}
+	result, err := getStore(c).Transact(kvstore.Transaction{
+		Guards:     append([]kvstore.Guard{{Type: kvstore.Exists, Key: operation.Key}}, guards...),
+		Operations: []kvstore.Operation{operation},
+	})
+	if err != nil {
+		abortWithStoreError(c, err)
+		return nil, false
+	}
+	if !result.Committed {
+		if !result.Guards[0].Passed {
+			abortWithStoreError(c, kvstore.ErrNotFound)
+		} else {
+			abortWithError(c, http.StatusPreconditionFailed, "precondition failed", "the property does not satisfy the request preconditions")
+		}
+		return nil, false
+	}
+	return result, true
+}
+
+// remainingTTL returns the number of seconds (rounded up) before the pair
+// expires, or 0 if the pair never expires.
+func remainingTTL(pair *kvstore.Pair) int64 {
+	if pair.ExpiresAt.IsZero() {
+		return 0
+	}
+	remaining := time.Until(pair.ExpiresAt)
+	if remaining <= 0 {
+		// the pair is expiring right now
+		return 1
+	}
+	return int64((remaining + time.Second - 1) / time.Second)
+}
+
+// setApplied sets the X-Brokerd-Applied-Index and X-Brokerd-Applied-Term
+// headers to the index and term of the latest log entry applied to the
+// store; as they are read before the data, the response reflects at least
+// all the entries up to them.
+func setApplied(c *gin.Context) {
+	index, term, err := getStore(c).Applied()
+	if err != nil {
+		return
+	}
+	c.Header("X-Brokerd-Applied-Index", strconv.FormatUint(index, 10))
+	c.Header("X-Brokerd-Applied-Term", strconv.FormatUint(term, 10))
 }
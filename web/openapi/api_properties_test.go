@@ -0,0 +1,137 @@
+package openapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dihedron/brokerd/kvstore"
+)
+
+// Test_RemainingTTL tests that the remaining TTL of a pair is reported in
+// seconds, rounded up, and as at least 1 second until it is deleted.
+func Test_RemainingTTL(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name      string
+		expiresAt time.Time
+		expected  int64
+	}{
+		{"never expires", time.Time{}, 0},
+		{"fraction of a second", now.Add(10*time.Second + 500*time.Millisecond), 11},
+		{"less than a second", now.Add(100 * time.Millisecond), 1},
+		{"expired", now.Add(-time.Minute), 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ttl := remainingTTL(&kvstore.Pair{Key: "a", Value: "1", ExpiresAt: test.expiresAt})
+			if ttl != test.expected {
+				t.Fatalf("wrong TTL: %d (expected %d)", ttl, test.expected)
+			}
+		})
+	}
+}
+
+// Test_DeleteProperties tests that the properties selected by the filter
+// are deleted, and that all of them are only deleted if explicitly asked.
+func Test_DeleteProperties(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		status   int
+		deleted  int
+		expected []string
+	}{
+		{"no filter", "", http.StatusBadRequest, 0, []string{"a", "a.b", "b"}},
+		{"no filter and not all", "?all=false", http.StatusBadRequest, 0, []string{"a", "a.b", "b"}},
+		{"invalid all", "?all=maybe", http.StatusBadRequest, 0, []string{"a", "a.b", "b"}},
+		{"all", "?all=true", http.StatusOK, 3, []string{}},
+		{"prefix", "?prefix=a", http.StatusOK, 2, []string{"b"}},
+		{"pattern", "?pattern=%5Eb", http.StatusOK, 1, []string{"a", "a.b"}},
+		{"no match", "?prefix=c", http.StatusOK, 0, []string{"a", "a.b", "b"}},
+		{"invalid pattern", "?pattern=(", http.StatusBadRequest, 0, []string{"a", "a.b", "b"}},
+	}
+	c, store := newTestCluster(t)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := store.DeleteMatching(kvstore.Filter{}); err != nil {
+				t.Fatalf("failed to clear store: %v", err)
+			}
+			for _, key := range []string{"a", "a.b", "b"} {
+				if err := store.Set(key, "1"); err != nil {
+					t.Fatalf("failed to set key %s: %v", key, err)
+				}
+			}
+			response := serve(store, c, http.MethodDelete, "/api/v1/properties"+test.query, nil)
+			assertStatus(t, response, test.status)
+			if test.status == http.StatusOK {
+				result := map[string]int{}
+				if err := json.Unmarshal(response.Body.Bytes(), &result); err != nil {
+					t.Fatalf("failed to parse response: %v", err)
+				}
+				if result["deleted"] != test.deleted {
+					t.Fatalf("wrong count: %d (expected %d)", result["deleted"], test.deleted)
+				}
+			}
+			pairs, _, err := store.List(kvstore.Filter{}, "", 0, kvstore.ConsistencyStrong)
+			if err != nil {
+				t.Fatalf("failed to list pairs: %v", err)
+			}
+			actual := []string{}
+			for _, pair := range pairs {
+				actual = append(actual, pair.Key)
+			}
+			if !reflect.DeepEqual(actual, test.expected) {
+				t.Fatalf("wrong keys left: %v (expected %v)", actual, test.expected)
+			}
+		})
+	}
+}
+
+// Test_PropertyLifecycle tests the status codes of the requests creating,
+// reading, updating and deleting a property, in sequence.
+func Test_PropertyLifecycle(t *testing.T) {
+	c, store := newTestCluster(t)
+	steps := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		status int
+	}{
+		{"create", http.MethodPost, "/api/v1/properties", `{"key":"a","value":"1"}`, http.StatusCreated},
+		{"create existing", http.MethodPost, "/api/v1/properties", `{"key":"a","value":"2"}`, http.StatusConflict},
+		{"create with no key", http.MethodPost, "/api/v1/properties", `{"value":"1"}`, http.StatusBadRequest},
+		{"create with negative TTL", http.MethodPost, "/api/v1/properties", `{"key":"b","value":"1","ttl":-1}`, http.StatusBadRequest},
+		{"get", http.MethodGet, "/api/v1/settings/a", "", http.StatusOK},
+		{"get missing", http.MethodGet, "/api/v1/settings/b", "", http.StatusNotFound},
+		{"update", http.MethodPut, "/api/v1/settings/a", `{"value":"2"}`, http.StatusOK},
+		{"update missing", http.MethodPut, "/api/v1/settings/b", `{"value":"2"}`, http.StatusNotFound},
+		{"update with another key", http.MethodPut, "/api/v1/settings/a", `{"key":"b","value":"2"}`, http.StatusBadRequest},
+		{"delete missing", http.MethodDelete, "/api/v1/settings/b", "", http.StatusNotFound},
+		{"delete", http.MethodDelete, "/api/v1/settings/a", "", http.StatusOK},
+		{"get deleted", http.MethodGet, "/api/v1/settings/a", "", http.StatusNotFound},
+		{"create deleted", http.MethodPost, "/api/v1/properties", `{"key":"a","value":"3"}`, http.StatusCreated},
+	}
+	for _, step := range steps {
+		response := serve(store, c, step.method, step.target, strings.NewReader(step.body))
+		if response.Code != step.status {
+			t.Fatalf("%s: wrong status: %d (expected %d): %s", step.name, response.Code, step.status, response.Body.String())
+		}
+		if step.status == http.StatusCreated {
+			if location := response.Header().Get("Location"); location != "/api/v1/settings/a" {
+				t.Fatalf("%s: wrong location: %q", step.name, location)
+			}
+			if response.Header().Get("ETag") == "" {
+				t.Fatalf("%s: no ETag", step.name)
+			}
+		}
+	}
+	value, err := store.Get("a", kvstore.ConsistencyStrong)
+	if err != nil || value != "3" {
+		t.Fatalf("wrong value: %q, %v (expected %q)", value, err, "3")
+	}
+}
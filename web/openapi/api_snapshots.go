@@ -0,0 +1,91 @@
+/*
+ * Brokerd API
+ *
+ * This API allows to interact with the `brokerd` daemon in its three different capacities:  1. as a **key/value store for properties**, holding key/value pairs; 2. as a **Raft cluster member**, through cluster managemenet APIs thata llow to check the state and   interact with the cluster (e.g. moving the master to another node, forcing a sync-up of the   cluster nodes, etc.) 3. as a **relational store for virtual machines and network ports**, as reported by OpenStack via its    notification exchanges inside RabbitMQ.  The **Properties API** allows to manage the lifecycle of key/value pairs; the kes part can encode a pseudo-hierarchical organisation of the information by adopting conventional characters as field separators, the way it is usually done in Java properties files, e.g.: ``` key-part-1.key-part-2.key-part-3....key-part-N=value ```  where each part of the key (`key-part-X`) can encode some part of a taxonomy.  The **Cluster API** provides a way to interact with the Raft cluster that guarantees that the Finite State Machines (FSM) holding the state of the several `brokerd` instances running on different  OpenStack controller nodes are all kept in sync and moving in lock-step. Through the API it is possible  to check the health and the status (*leader*, *follower*) of the nodes in the cluster, move the cluster leadership from the current master to a different node, force a sync-up of the cluster nodes, trigger the snaphotting of the current FSM state, etc.  The **Store API** provides a way to interact with the SQLite database holding information about  Virtual Machines and Network Ports.
+ *
+ * API version: 1.0
+ * Contact: support@example.com
+ * Generated by: OpenAPI Generator (https://openapi-generator.tech)
+ */
+
+package openapi
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hashicorp/raft"
+)
+
+// TakeSnapshot - Take a snapshot of the state of this node.
+func TakeSnapshot(c *gin.Context) {
+	meta, err := getCluster(c).TakeSnapshot()
+	if err != nil {
+		abortWithClusterError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, snapshotFromMeta(meta))
+}
+
+// ListSnapshots - Return the snapshots kept by this node.
+func ListSnapshots(c *gin.Context) {
+	snapshots, err := getCluster(c).ListSnapshots()
+	if err != nil {
+		abortWithClusterError(c, err)
+		return
+	}
+	result := make([]Snapshot, 0, len(snapshots))
+	for _, meta := range snapshots {
+		result = append(result, snapshotFromMeta(meta))
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// DownloadSnapshot - Return the contents of a snapshot kept by this node.
+//
+// The contents can be used as a backup, to restore the cluster later.
+func DownloadSnapshot(c *gin.Context) {
+	meta, reader, err := getCluster(c).OpenSnapshot(c.Param("id"))
+	if err != nil {
+		abortWithClusterError(c, err)
+		return
+	}
+	defer reader.Close()
+	c.Header("Content-Disposition", "attachment; filename=\""+meta.ID+".snapshot\"")
+	c.Header("X-Brokerd-Snapshot-Index", strconv.FormatUint(meta.Index, 10))
+	c.Header("X-Brokerd-Snapshot-Term", strconv.FormatUint(meta.Term, 10))
+	c.DataFromReader(http.StatusOK, meta.Size, "application/octet-stream", reader, nil)
+}
+
+// RestoreSnapshot - Replace the state of the whole cluster with a snapshot.
+//
+// This is a disaster recovery operation, run by the leader, which discards
+// the current state of all nodes; it must be explicitly confirmed.
+func RestoreSnapshot(c *gin.Context) {
+	confirm, err := strconv.ParseBool(c.DefaultQuery("confirm", "false"))
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, "bad request", "the confirm parameter must be a boolean")
+		return
+	}
+	if !confirm {
+		abortWithError(c, http.StatusPreconditionFailed, "precondition failed", "restoring a snapshot discards the current state of the cluster and must be confirmed")
+		return
+	}
+	if err := getCluster(c).RestoreSnapshot(c.Request.Body); err != nil {
+		abortWithClusterError(c, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// snapshotFromMeta converts the metadata of a snapshot into the Snapshot
+// model.
+func snapshotFromMeta(meta *raft.SnapshotMeta) Snapshot {
+	return Snapshot{
+		Id:    meta.ID,
+		Index: meta.Index,
+		Term:  meta.Term,
+		Size:  meta.Size,
+	}
+}
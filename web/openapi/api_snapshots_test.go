@@ -0,0 +1,87 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/dihedron/brokerd/kvstore"
+)
+
+// Test_RestoreSnapshot tests that a snapshot downloaded from a node can be
+// restored, once confirmed, and that damaged snapshots are rejected and
+// leave the state of the cluster as it was.
+func Test_RestoreSnapshot(t *testing.T) {
+	c, store := newTestCluster(t)
+	if err := store.Set("a", "before"); err != nil {
+		t.Fatalf("failed to set key: %v", err)
+	}
+	response := serve(store, c, http.MethodPost, "/api/v1/cluster/self/snapshots", nil)
+	assertStatus(t, response, http.StatusOK)
+	snapshot := Snapshot{}
+	if err := json.Unmarshal(response.Body.Bytes(), &snapshot); err != nil {
+		t.Fatalf("failed to parse snapshot: %v", err)
+	}
+	response = serve(store, c, http.MethodGet, "/api/v1/cluster/self/snapshots/"+snapshot.Id, nil)
+	assertStatus(t, response, http.StatusOK)
+	data := response.Body.Bytes()
+	if err := store.Set("a", "after"); err != nil {
+		t.Fatalf("failed to set key: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		query    string
+		data     []byte
+		status   int
+		message  string
+		expected string
+	}{
+		{
+			name:     "not confirmed",
+			data:     data,
+			status:   http.StatusPreconditionFailed,
+			expected: "after",
+		},
+		{
+			name:     "invalid confirmation",
+			query:    "?confirm=maybe",
+			data:     data,
+			status:   http.StatusBadRequest,
+			expected: "after",
+		},
+		{
+			name:     "checksum mismatch",
+			query:    "?confirm=true",
+			data:     bytes.Replace(data, []byte("before"), []byte("BEFORE"), 1),
+			status:   http.StatusBadRequest,
+			message:  "checksum mismatch",
+			expected: "after",
+		},
+		{
+			name:     "valid",
+			query:    "?confirm=true",
+			data:     data,
+			status:   http.StatusOK,
+			expected: "before",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := serve(store, c, http.MethodPost, "/api/v1/cluster/restore"+test.query, bytes.NewReader(test.data))
+			assertStatus(t, response, test.status)
+			if !strings.Contains(response.Body.String(), test.message) {
+				t.Fatalf("wrong message: %s (expected %q)", response.Body.String(), test.message)
+			}
+			value, err := store.Get("a", kvstore.ConsistencyStrong)
+			if err != nil {
+				t.Fatalf("failed to get key: %v", err)
+			}
+			if value != test.expected {
+				t.Fatalf("wrong value: %q (expected %q)", value, test.expected)
+			}
+		})
+	}
+}
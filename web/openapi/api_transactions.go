@@ -0,0 +1,103 @@
+/*
+ * Brokerd API
+ *
+ * This API allows to interact with the `brokerd` daemon in its three different capacities:  1. as a **key/value store for properties**, holding key/value pairs; 2. as a **Raft cluster member**, through cluster managemenet APIs thata llow to check the state and   interact with the cluster (e.g. moving the master to another node, forcing a sync-up of the   cluster nodes, etc.) 3. as a **relational store for virtual machines and network ports**, as reported by OpenStack via its    notification exchanges inside RabbitMQ.  The **Properties API** allows to manage the lifecycle of key/value pairs; the kes part can encode a pseudo-hierarchical organisation of the information by adopting conventional characters as field separators, the way it is usually done in Java properties files, e.g.: ``` key-part-1.key-part-2.key-part-3....key-part-N=value ```  where each part of the key (`key-part-X`) can encode some part of a taxonomy.  The **Cluster API** provides a way to interact with the Raft cluster that guarantees that the Finite State Machines (FSM) holding the state of the several `brokerd` instances running on different  OpenStack controller nodes are all kept in sync and moving in lock-step. Through the API it is possible  to check the health and the status (*leader*, *follower*) of the nodes in the cluster, move the cluster leadership from the current master to a different node, force a sync-up of the cluster nodes, trigger the snaphotting of the current FSM state, etc.  The **Store API** provides a way to interact with the SQLite database holding information about  Virtual Machines and Network Ports.
+ *
+ * API version: 1.0
+ * Contact: support@example.com
+ * Generated by: OpenAPI Generator (https://openapi-generator.tech)
+ */
+
+package openapi
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dihedron/brokerd/kvstore"
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	guardTypes = map[string]kvstore.GuardType{
+		"exists":           kvstore.Exists,
+		"absent":           kvstore.Absent,
+		"equals":           kvstore.Equals,
+		"index-equals":     kvstore.IndexEquals,
+		"index-not-equals": kvstore.IndexNotEquals,
+	}
+
+	operationTypes = map[string]kvstore.CommandType{
+		"set":    kvstore.Set,
+		"delete": kvstore.Delete,
+	}
+)
+
+// ApplyTransaction - Apply multiple operations atomically.
+func ApplyTransaction(c *gin.Context) {
+	var transaction Transaction
+	if err := c.ShouldBindJSON(&transaction); err != nil {
+		abortWithError(c, http.StatusBadRequest, "bad request", err.Error())
+		return
+	}
+	t, err := transaction.toStore()
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, "bad request", err.Error())
+		return
+	}
+	result, err := getStore(c).Transact(t)
+	if err != nil {
+		abortWithStoreError(c, err)
+		return
+	}
+	response := TransactionResult{
+		Committed: result.Committed,
+		Index:     result.Index,
+		Guards:    make([]GuardResult, 0, len(result.Guards)),
+	}
+	for i, guard := range result.Guards {
+		response.Guards = append(response.Guards, GuardResult{
+			Guard:  transaction.Guards[i],
+			Passed: guard.Passed,
+		})
+	}
+	if !result.Committed {
+		c.JSON(http.StatusConflict, response)
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// toStore converts the Transaction model into a key/value store transaction.
+func (t Transaction) toStore() (kvstore.Transaction, error) {
+	transaction := kvstore.Transaction{
+		Guards:     make([]kvstore.Guard, 0, len(t.Guards)),
+		Operations: make([]kvstore.Operation, 0, len(t.Operations)),
+	}
+	for _, guard := range t.Guards {
+		gt, ok := guardTypes[guard.Type]
+		if !ok {
+			return transaction, fmt.Errorf("unrecognized guard type: %q", guard.Type)
+		}
+		transaction.Guards = append(transaction.Guards, kvstore.Guard{
+			Type:  gt,
+			Key:   guard.Key,
+			Value: guard.Value,
+			Index: guard.Index,
+		})
+	}
+	for _, operation := range t.Operations {
+		ot, ok := operationTypes[operation.Type]
+		if !ok {
+			return transaction, fmt.Errorf("unrecognized operation type: %q", operation.Type)
+		}
+		transaction.Operations = append(transaction.Operations, kvstore.Operation{
+			Type:  ot,
+			Key:   operation.Key,
+			Value: operation.Value,
+			TTL:   time.Duration(operation.Ttl) * time.Second,
+		})
+	}
+	return transaction, nil
+}
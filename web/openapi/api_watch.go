@@ -0,0 +1,122 @@
+/*
+ * Brokerd API
+ *
+ * This API allows to interact with the `brokerd` daemon in its three different capacities:  1. as a **key/value store for properties**, holding key/value pairs; 2. as a **Raft cluster member**, through cluster managemenet APIs thata llow to check the state and   interact with the cluster (e.g. moving the master to another node, forcing a sync-up of the   cluster nodes, etc.) 3. as a **relational store for virtual machines and network ports**, as reported by OpenStack via its    notification exchanges inside RabbitMQ.  The **Properties API** allows to manage the lifecycle of key/value pairs; the kes part can encode a pseudo-hierarchical organisation of the information by adopting conventional characters as field separators, the way it is usually done in Java properties files, e.g.: ``` key-part-1.key-part-2.key-part-3....key-part-N=value ```  where each part of the key (`key-part-X`) can encode some part of a taxonomy.  The **Cluster API** provides a way to interact with the Raft cluster that guarantees that the Finite State Machines (FSM) holding the state of the several `brokerd` instances running on different  OpenStack controller nodes are all kept in sync and moving in lock-step. Through the API it is possible  to check the health and the status (*leader*, *follower*) of the nodes in the cluster, move the cluster leadership from the current master to a different node, force a sync-up of the cluster nodes, trigger the snaphotting of the current FSM state, etc.  The **Store API** provides a way to interact with the SQLite database holding information about  Virtual Machines and Network Ports.
+ *
+ * API version: 1.0
+ * Contact: support@example.com
+ * Generated by: OpenAPI Generator (https://openapi-generator.tech)
+ */
+
+package openapi
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dihedron/brokerd/kvstore"
+	"github.com/gin-gonic/gin"
+)
+
+// watchKeepAlive is the interval at which a comment is sent to watching
+// clients when there are no changes, so that idle connections are not
+// dropped by proxies.
+const watchKeepAlive = 15 * time.Second
+
+// WatchProperties - Stream the changes to properties as Server-Sent Events.
+//
+// Each change is sent as a "change" event; the last of the changes applied
+// by a Raft log entry has the index of the entry as its ID, so that clients
+// can resume watching from the last ID they received, either through the
+// since query parameter or the Last-Event-ID header, without missing any
+// change applied by the same entry. If the changes following that index
+// are no longer available, a "compacted" event is sent with the current
+// index and the stream is closed: clients must then list the properties
+// again and resume watching from that index.
+func WatchProperties(c *gin.Context) {
+	store := getStore(c)
+	prefix := c.Query("prefix")
+	since := c.Query("since")
+	if since == "" {
+		since = c.GetHeader("Last-Event-ID")
+	}
+	var index uint64
+	if since == "" {
+		// only watch for changes from now on
+		changes, err := store.Changes(^uint64(0))
+		if err != nil {
+			abortWithStoreError(c, err)
+			return
+		}
+		index = changes.Index
+	} else {
+		var err error
+		if index, err = strconv.ParseUint(since, 10, 64); err != nil {
+			abortWithError(c, http.StatusBadRequest, "bad request", "the index must be a non-negative integer")
+			return
+		}
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	stopping := getStopping(c)
+	ticker := time.NewTicker(watchKeepAlive)
+	defer ticker.Stop()
+	for {
+		changes, err := store.Changes(index)
+		if errors.Is(err, kvstore.ErrCompacted) {
+			c.SSEvent("compacted", gin.H{"index": changes.Index})
+			c.Writer.Flush()
+			return
+		} else if err != nil {
+			c.SSEvent("error", Error{Code: "internal error", Message: err.Error()})
+			c.Writer.Flush()
+			return
+		}
+		events := changes.Events
+		for len(events) > 0 {
+			// the feed always holds all the changes applied by an entry
+			n := 1
+			for n < len(events) && events[n].Index == events[0].Index {
+				n++
+			}
+			matching := []kvstore.Event{}
+			for _, event := range events[:n] {
+				if strings.HasPrefix(event.Key, prefix) {
+					matching = append(matching, event)
+				}
+			}
+			for i, event := range matching {
+				if i == len(matching)-1 {
+					c.Writer.WriteString("id:" + strconv.FormatUint(event.Index, 10) + "\n")
+				}
+				c.SSEvent("change", Event{
+					Index:     event.Index,
+					Key:       event.Key,
+					Operation: event.Operation,
+					Value:     event.Value,
+				})
+			}
+			index = events[0].Index
+			events = events[n:]
+		}
+		c.Writer.Flush()
+		select {
+		case <-changes.Wait:
+		case <-ticker.C:
+			c.Writer.WriteString(": keep-alive\n\n")
+			c.Writer.Flush()
+		case <-c.Request.Context().Done():
+			return
+		case <-stopping:
+			return
+		}
+	}
+}
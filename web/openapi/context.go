@@ -0,0 +1,107 @@
+package openapi
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/dihedron/brokerd/cluster"
+	"github.com/dihedron/brokerd/kvstore"
+	"github.com/dihedron/brokerd/log"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// getStore retrieves the key/value store that the web server injects
+// into the gin Context.
+func getStore(c *gin.Context) kvstore.KVStore {
+	return c.MustGet("store").(kvstore.KVStore)
+}
+
+// getCluster retrieves the Raft cluster that the web server injects
+// into the gin Context.
+func getCluster(c *gin.Context) *cluster.Cluster {
+	return c.MustGet("cluster").(*cluster.Cluster)
+}
+
+// getStopping retrieves the channel that the web server closes when it is
+// shut down, so that long-running requests can end; it returns nil if the
+// web server does not provide one.
+func getStopping(c *gin.Context) <-chan struct{} {
+	if stopping, ok := c.Get("stopping"); ok {
+		return stopping.(<-chan struct{})
+	}
+	return nil
+}
+
+// consistencyLevels maps the values of the level query parameter onto
+// the store consistency levels.
+var consistencyLevels = map[string]kvstore.Consistency{
+	"":       kvstore.ConsistencyDefault,
+	"none":   kvstore.ConsistencyNone,
+	"weak":   kvstore.ConsistencyWeak,
+	"strong": kvstore.ConsistencyStrong,
+}
+
+// getConsistency retrieves the level of consistency requested by the
+// client in the level query parameter; if none is specified, the store
+// default applies.
+func getConsistency(c *gin.Context) (kvstore.Consistency, error) {
+	level, ok := consistencyLevels[c.Query("level")]
+	if !ok {
+		return level, fmt.Errorf("%w: %q", kvstore.ErrInvalidConsistency, c.Query("level"))
+	}
+	return level, nil
+}
+
+// abortWithError writes the given error to the client as an Error
+// model, with the given HTTP status code.
+func abortWithError(c *gin.Context, status int, code string, message string) {
+	c.AbortWithStatusJSON(status, Error{
+		Code:    code,
+		Message: message,
+	})
+}
+
+// abortWithClusterError maps the errors returned by the Raft cluster
+// onto the appropriate HTTP status codes and Error models.
+func abortWithClusterError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, cluster.ErrUnknownNode), errors.Is(err, cluster.ErrSnapshotNotFound):
+		abortWithError(c, http.StatusNotFound, "not found", err.Error())
+	case errors.Is(err, cluster.ErrInvalidTarget), errors.Is(err, cluster.ErrInvalidSnapshot):
+		abortWithError(c, http.StatusBadRequest, "bad request", err.Error())
+	case errors.Is(err, cluster.ErrQuorum), errors.Is(err, cluster.ErrNothingToSnapshot):
+		abortWithError(c, http.StatusConflict, "conflict", err.Error())
+	case errors.Is(err, cluster.ErrNotLeader):
+		abortWithError(c, http.StatusServiceUnavailable, "not leader", err.Error())
+	default:
+		log.L.Error("error accessing the cluster", zap.Error(err))
+		abortWithError(c, http.StatusInternalServerError, "internal error", err.Error())
+	}
+}
+
+// abortWithStoreError maps the errors returned by the key/value store
+// onto the appropriate HTTP status codes and Error models.
+func abortWithStoreError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, kvstore.ErrNotFound), errors.Is(err, kvstore.ErrRevisionNotFound), errors.Is(err, kvstore.ErrNodeNotFound):
+		abortWithError(c, http.StatusNotFound, "not found", err.Error())
+	case errors.Is(err, kvstore.ErrInvalidFilter), errors.Is(err, kvstore.ErrInvalidTransaction), errors.Is(err, kvstore.ErrInvalidConsistency), errors.Is(err, kvstore.ErrInvalidNode),
+		errors.Is(err, kvstore.ErrInvalidPreference):
+		abortWithError(c, http.StatusBadRequest, "bad request", err.Error())
+	case errors.Is(err, kvstore.ErrNotLeader):
+		response := Error{
+			Code:    "not leader",
+			Message: err.Error(),
+		}
+		var notLeader *kvstore.NotLeaderError
+		if errors.As(err, &notLeader) {
+			response.Leader = notLeader.Leader
+		}
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, response)
+	default:
+		log.L.Error("error accessing the store", zap.Error(err))
+		abortWithError(c, http.StatusInternalServerError, "internal error", err.Error())
+	}
+}
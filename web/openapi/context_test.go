@@ -0,0 +1,98 @@
+package openapi
+
+import (
+	"io"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dihedron/brokerd/cluster"
+	"github.com/dihedron/brokerd/kvstore"
+	"github.com/dihedron/brokerd/sqlite"
+	"github.com/gin-gonic/gin"
+	"github.com/hashicorp/raft"
+)
+
+// newTestNode creates a node, with its own store and the replicated store
+// on top of it, which is neither bootstrapped nor part of a cluster yet.
+func newTestNode(t *testing.T, id string) (*cluster.Cluster, *kvstore.ReplicatedStore) {
+	t.Helper()
+	store, err := kvstore.NewLocalStore(sqlite.WithStoreDirectory(t.TempDir()))
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	c, err := cluster.New(id, kvstore.NewReplicatedStoreFSM(store), cluster.WithRaftDirectory(t.TempDir()), cluster.WithRaftBindAddress(freeAddress(t)))
+	if err != nil {
+		t.Fatalf("failed to create cluster: %v", err)
+	}
+	t.Cleanup(func() { c.Shutdown() })
+	return c, kvstore.NewReplicatedStore(false, store, c)
+}
+
+// freeAddress returns an address on the loopback interface, on a port that
+// is not in use.
+func freeAddress(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// newTestCluster creates a single node cluster, which leads itself, and
+// the replicated store on top of it.
+func newTestCluster(t *testing.T) (*cluster.Cluster, *kvstore.ReplicatedStore) {
+	t.Helper()
+	c, store := newTestNode(t, "node0")
+	if err := c.Bootstrap(); err != nil {
+		t.Fatalf("failed to bootstrap cluster: %v", err)
+	}
+	waitFor(t, func() bool { return c.Raft.State() == raft.Leader })
+	return c, store
+}
+
+// waitFor waits for the condition to hold, failing the test if it does
+// not within a few seconds.
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if condition() {
+			return
+		}
+	}
+	t.Fatalf("condition not met in time")
+}
+
+// newTestRouter creates a router with the API handlers, which are given
+// the store and cluster as by the web server.
+func newTestRouter(store kvstore.KVStore, c *cluster.Cluster) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(func(ctx *gin.Context) {
+		ctx.Set("store", store)
+		ctx.Set("cluster", c)
+	})
+	AddAPIHandlers(router)
+	return router
+}
+
+// serve sends the request to the API handlers, as the web server does,
+// with the given store and cluster, and returns the response.
+func serve(store kvstore.KVStore, c *cluster.Cluster, method string, target string, body io.Reader) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	newTestRouter(store, c).ServeHTTP(recorder, httptest.NewRequest(method, target, body))
+	return recorder
+}
+
+// assertStatus fails the test if the response does not have the given
+// status code.
+func assertStatus(t *testing.T, response *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if response.Code != status {
+		t.Fatalf("wrong status: %d (expected %d): %s", response.Code, status, response.Body.String())
+	}
+}
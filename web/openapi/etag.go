@@ -0,0 +1,65 @@
+package openapi
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/dihedron/brokerd/kvstore"
+	"github.com/gin-gonic/gin"
+)
+
+// formatETag formats the modification index of a property as a strong
+// entity tag.
+func formatETag(index uint64) string {
+	return `"` + strconv.FormatUint(index, 10) + `"`
+}
+
+// ParseETag parses an entity tag into the modification index of a
+// property; weak entity tags are only accepted if weak is true.
+func ParseETag(tag string, weak bool) (uint64, error) {
+	if strings.HasPrefix(tag, "W/") {
+		if !weak {
+			return 0, fmt.Errorf("weak entity tag %s cannot be used here", tag)
+		}
+		tag = strings.TrimPrefix(tag, "W/")
+	}
+	if len(tag) < 2 || !strings.HasPrefix(tag, `"`) || !strings.HasSuffix(tag, `"`) {
+		return 0, fmt.Errorf("invalid entity tag: %s", tag)
+	}
+	index, err := strconv.ParseUint(tag[1:len(tag)-1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid entity tag: %s", tag)
+	}
+	return index, nil
+}
+
+// preconditions translates the If-Match and If-None-Match request headers
+// into guards on the given key, so that they can be evaluated atomically
+// by the store along with the operations they protect.
+func preconditions(c *gin.Context, key string) ([]kvstore.Guard, error) {
+	guards := []kvstore.Guard{}
+	if tag := strings.TrimSpace(c.GetHeader("If-Match")); tag != "" {
+		if tag == "*" {
+			guards = append(guards, kvstore.Guard{Type: kvstore.Exists, Key: key})
+		} else {
+			index, err := ParseETag(tag, false)
+			if err != nil {
+				return nil, err
+			}
+			guards = append(guards, kvstore.Guard{Type: kvstore.IndexEquals, Key: key, Index: index})
+		}
+	}
+	if tag := strings.TrimSpace(c.GetHeader("If-None-Match")); tag != "" {
+		if tag == "*" {
+			guards = append(guards, kvstore.Guard{Type: kvstore.Absent, Key: key})
+		} else {
+			index, err := ParseETag(tag, true)
+			if err != nil {
+				return nil, err
+			}
+			guards = append(guards, kvstore.Guard{Type: kvstore.IndexNotEquals, Key: key, Index: index})
+		}
+	}
+	return guards, nil
+}
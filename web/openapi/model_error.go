@@ -14,4 +14,7 @@ type Error struct {
 	Code string `json:"code"`
 
 	Message string `json:"message"`
+
+	// The URL of the API of the leader, when the operation must be retried there.
+	Leader string `json:"leader,omitempty"`
 }
@@ -18,5 +18,18 @@ type Node struct {
 	// The network address of the node.
 	Address string `json:"address,omitempty"`
 
+	// The state of the node in the cluster, if known.
 	Status string `json:"status,omitempty"`
+
+	// Whether the node is a voter or a non-voter.
+	Suffrage string `json:"suffrage,omitempty"`
+
+	// The time (in milliseconds) elapsed since the node last heard from the leader, if known.
+	LastContact *int64 `json:"lastContact,omitempty"`
+
+	// The index of the last log entry applied by the node, if known.
+	AppliedIndex uint64 `json:"appliedIndex,omitempty"`
+
+	// The index of the last log entry known by the node to be committed, if known.
+	CommitIndex uint64 `json:"commitIndex,omitempty"`
 }
@@ -17,4 +17,7 @@ type Property struct {
 
 	// The value of the property.
 	Value string `json:"value,omitempty"`
+
+	// The time to live of the property, in seconds; when the property is retrieved, it is the remaining time to live.
+	Ttl int64 `json:"ttl,omitempty"`
 }
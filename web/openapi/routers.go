@@ -98,6 +98,13 @@ var routes = Routes{
 		GetProperty,
 	},
 
+	{
+		"GetPropertyHistory",
+		http.MethodGet,
+		"/api/v1/settings/:key/history",
+		GetPropertyHistory,
+	},
+
 	{
 		"ListProperties",
 		http.MethodGet,
@@ -105,10 +112,143 @@ var routes = Routes{
 		ListProperties,
 	},
 
+	{
+		"RollbackProperty",
+		http.MethodPost,
+		"/api/v1/settings/:key/rollback",
+		RollbackProperty,
+	},
+
 	{
 		"UpdateProperty",
 		http.MethodPut,
 		"/api/v1/settings/:key",
 		UpdateProperty,
 	},
+
+	{
+		"ApplyTransaction",
+		http.MethodPost,
+		"/api/v1/transactions",
+		ApplyTransaction,
+	},
+
+	{
+		"AddNode",
+		http.MethodPost,
+		"/api/v1/cluster/nodes",
+		AddNode,
+	},
+
+	{
+		"RemoveNode",
+		http.MethodDelete,
+		"/api/v1/cluster/nodes/:id",
+		RemoveNode,
+	},
+
+	{
+		"DemoteNode",
+		http.MethodPost,
+		"/api/v1/cluster/nodes/:id/demote",
+		DemoteNode,
+	},
+
+	{
+		"TransferLeadership",
+		http.MethodPost,
+		"/api/v1/cluster/leader/transfer",
+		TransferLeadership,
+	},
+
+	{
+		"GetLeaderPreference",
+		http.MethodGet,
+		"/api/v1/cluster/leader/preference",
+		GetLeaderPreference,
+	},
+
+	{
+		"SetLeaderPreference",
+		http.MethodPut,
+		"/api/v1/cluster/leader/preference",
+		SetLeaderPreference,
+	},
+
+	{
+		"GetSelf",
+		http.MethodGet,
+		"/api/v1/cluster/self",
+		GetSelf,
+	},
+
+	{
+		"GetAutopilotState",
+		http.MethodGet,
+		"/api/v1/cluster/autopilot",
+		GetAutopilotState,
+	},
+
+	{
+		"TakeSnapshot",
+		http.MethodPost,
+		"/api/v1/cluster/self/snapshots",
+		TakeSnapshot,
+	},
+
+	{
+		"ListSnapshots",
+		http.MethodGet,
+		"/api/v1/cluster/self/snapshots",
+		ListSnapshots,
+	},
+
+	{
+		"DownloadSnapshot",
+		http.MethodGet,
+		"/api/v1/cluster/self/snapshots/:id",
+		DownloadSnapshot,
+	},
+
+	{
+		"RestoreSnapshot",
+		http.MethodPost,
+		"/api/v1/cluster/restore",
+		RestoreSnapshot,
+	},
+
+	{
+		"ListClusterEvents",
+		http.MethodGet,
+		"/api/v1/cluster/events",
+		ListClusterEvents,
+	},
+
+	{
+		"StreamClusterEvents",
+		http.MethodGet,
+		"/api/v1/cluster/events/stream",
+		StreamClusterEvents,
+	},
+
+	{
+		"ListRegisteredNodes",
+		http.MethodGet,
+		"/api/v1/cluster/registry",
+		ListRegisteredNodes,
+	},
+
+	{
+		"RegisterNode",
+		http.MethodPut,
+		"/api/v1/cluster/registry/:id",
+		RegisterNode,
+	},
+
+	{
+		"WatchProperties",
+		http.MethodGet,
+		"/api/v1/watch",
+		WatchProperties,
+	},
 }
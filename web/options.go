@@ -0,0 +1,40 @@
+package web
+
+// Forwarding is the way a follower handles the mutating requests, which
+// can only be served by the leader.
+type Forwarding string
+
+const (
+	// ForwardingNone rejects mutating requests on followers with a "not
+	// leader" error; clients must find out the leader themselves.
+	ForwardingNone Forwarding = "none"
+	// ForwardingProxy forwards mutating requests to the leader and relays
+	// its response back to the client.
+	ForwardingProxy Forwarding = "proxy"
+	// ForwardingRedirect redirects clients to the leader with a 307
+	// (Temporary Redirect) response.
+	ForwardingRedirect Forwarding = "redirect"
+)
+
+// LeaderResolver returns the address of the HTTP API of the node with the
+// given Raft address.
+type LeaderResolver func(raftAddress string) (string, error)
+
+// Option represents the optional function.
+type Option func(server *Server)
+
+// WithForwarding sets up the way mutating requests are handled when this
+// node is not the leader.
+func WithForwarding(value Forwarding) Option {
+	return func(server *Server) {
+		server.forwarding = value
+	}
+}
+
+// WithLeaderResolver sets up the function that maps the Raft address of
+// the leader onto the address of its HTTP API.
+func WithLeaderResolver(value LeaderResolver) Option {
+	return func(server *Server) {
+		server.resolver = value
+	}
+}
@@ -17,18 +17,22 @@ import (
 
 // Server represents the HTTP web server.
 type Server struct {
-	server   *http.Server
-	listener net.Listener
-	store    kvstore.KVStore
-	cluster  *cluster.Cluster
+	server     *http.Server
+	listener   net.Listener
+	store      kvstore.KVStore
+	cluster    *cluster.Cluster
+	forwarding Forwarding
+	resolver   LeaderResolver
+	stopping   chan struct{}
 }
 
 // TODO: consider using https://github.com/Depado/ginprom
 // to add Prometheus instrumentation.
 
 // New creates a new WebServer struct and starts the network
-// connections listener on the provided address.
-func New(address string, store kvstore.KVStore, cluster *cluster.Cluster) (*Server, error) {
+// connections listener on the provided address; unless otherwise
+// configured, mutating requests are rejected on followers.
+func New(address string, store kvstore.KVStore, cluster *cluster.Cluster, options ...Option) (*Server, error) {
 
 	if address == "" {
 		log.L.Debug("using default address for HTTP server")
@@ -36,6 +40,18 @@ func New(address string, store kvstore.KVStore, cluster *cluster.Cluster) (*Serv
 	}
 	log.L.Debug("creating HTTP server", zap.String("address", address))
 
+	// setup with defaults
+	w := &Server{
+		store:      store,
+		cluster:    cluster,
+		forwarding: ForwardingNone,
+		stopping:   make(chan struct{}),
+	}
+	// apply functional options to override
+	for _, option := range options {
+		option(w)
+	}
+
 	router := gin.New()
 	router.Use(
 		ginzap.Ginzap(log.L, time.RFC3339, true),
@@ -44,7 +60,9 @@ func New(address string, store kvstore.KVStore, cluster *cluster.Cluster) (*Serv
 			// inject global variables into gin Context
 			ctx.Set("store", store)
 			ctx.Set("cluster", cluster)
+			ctx.Set("stopping", (<-chan struct{})(w.stopping))
 		},
+		w.forward(),
 	)
 	// register Properties API, Cluster API and Store API
 	openapi.AddAPIHandlers(router)
@@ -86,14 +104,16 @@ func New(address string, store kvstore.KVStore, cluster *cluster.Cluster) (*Serv
 	// 	})
 	// }
 
-	return &Server{
-		server: &http.Server{
-			Addr:    address,
-			Handler: router,
-		},
-		store:   store,
-		cluster: cluster,
-	}, nil
+	w.server = &http.Server{
+		Addr:    address,
+		Handler: router,
+	}
+	// streams of Server-Sent Events never complete on their own, so they
+	// are told to end when the server is shut down
+	w.server.RegisterOnShutdown(func() {
+		close(w.stopping)
+	})
+	return w, nil
 }
 
 // Start starts the web server; it is blocking, so it ok to call